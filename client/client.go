@@ -1,121 +1,418 @@
 package client
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"github.com/andysctu/go-tunnel/helper"
+	"github.com/andysctu/go-tunnel/inspector"
 	pb "github.com/andysctu/go-tunnel/protobuf"
-	"github.com/golang/protobuf/proto"
+	"github.com/andysctu/go-tunnel/recorder"
+	"github.com/andysctu/go-tunnel/transport"
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minReconnectDelay = 1 * time.Second
+	maxReconnectDelay = 30 * time.Second
+	// How long dialing the protected server may take before the user's
+	// stream is reset
+	dialTimeout = 10 * time.Second
+	// How long a refused HTTP user has to send their request's headers
+	// before they are just disconnected
+	requestTimeout = 10 * time.Second
 )
 
 type GoRpsClient struct {
-	ServerTCPAddr         *net.TCPAddr
-	ConnToRpsServer       *net.TCPConn
-	ConnToProtectedServer map[int32]*net.TCPConn // UserID -> connection to PS
-	ExposedPort           int
-	protectedServerPort   int
+	ServerTCPAddr       *net.TCPAddr
+	ServerHost          string // Optional, the name the rps server was given by, which its TLS certificate is verified for instead of ServerTCPAddr's IP
+	ServerURL           string // Optional, a ws:// or wss:// URL to reach the rps server through instead of dialing ServerTCPAddr, which users still connect to
+	ConnToRpsServer     net.Conn
+	ExposedPort         int
+	Token               string               // Optional, presented to the rps server when opening a tunnel
+	RequestedPort       int                  // Optional, the port to ask the rps server to expose, random if 0
+	Group               string               // Optional, share one exposed port with every client naming this group
+	Private             string               // Optional, publish the tunnel under this name to visitors only, instead of on a port
+	Secret              string               // Optional, what visitors of a Private tunnel must present, and what Visit presents
+	Protocol            string               // Optional, "http" if users speak HTTP, so they get a 503 while the protected server is down, or "socks5" to let users pick their destination
+	HTTPS               bool                 // Optional, for http tunnels: users connect over https, which the rps server terminates
+	AllowTargets        []string             // The destinations users of a socks5 tunnel may connect to: IPs, CIDRs, host names or *.domain, each with an optional :port, or * for anywhere
+	HealthCheck         *HealthCheck         // Optional, check the protected server and stop getting users while it is down
+	TargetHost          string               // Optional, the host the protected server runs on, defaults to localhost
+	TargetTLS           *tls.Config          // Optional, connect to the protected server over TLS, e.g. when it only speaks HTTPS
+	TLSConfig           *tls.Config          // Optional, connect to the rps server over TLS
+	Proxy               string               // Optional, http:// or socks5:// proxy to reach the rps server through, defaults to ProxyFromEnvironment
+	Inspector           *inspector.Inspector // Optional, records HTTP traffic going through the tunnel
+	Recorder            *recorder.Recorder   // Optional, captures the bytes of every stream
+	Events              chan<- Event         // Optional, receives tunnel events
+	AutoReconnect       bool                 // Re-open the tunnel if the connection to the rps server is lost or drained
+	WriteTimeout        time.Duration        // Optional, how long a write to the rps server may take, defaults to helper.DefaultWriteTimeout
+	Transport           string               // Optional, transport.Frames to carry users the old way, defaults to transport.Mux where the rps server has it
+	protectedServerPort int
+	allow               []targetRule    // Parsed from AllowTargets
+	listener            *tunnelListener // Set when users are handed to Listen instead of a protected server
+
+	mu           sync.Mutex // Guards the fields below up to ctx, ConnToRpsServer, ExposedPort and every tunnel's streams
+	tunnel       *tunnel    // The one new users arrive on
+	tunnels      map[*tunnel]bool
+	reconnecting bool
+	unhealthy    string // Why the last health check failed
+	stopped      bool
+	ctx          context.Context // Cancelled by Shutdown
+	cancel       context.CancelFunc
+	wg           sync.WaitGroup
 }
 
 // Returns the port to hit on the server to reach the protected server
 func (c *GoRpsClient) OpenTunnel(protectedServerPort int) (err error) {
+	return c.OpenTunnelContext(context.Background(), protectedServerPort)
+}
+
+// OpenTunnelContext is like OpenTunnel, but gives up on reaching the rps
+// server once ctx is cancelled or its deadline passes
+func (c *GoRpsClient) OpenTunnelContext(ctx context.Context, protectedServerPort int) (err error) {
 	c.protectedServerPort = protectedServerPort
-	c.ConnToProtectedServer = make(map[int32]*net.TCPConn)
+	if c.Protocol == "socks5" {
+		c.allow, err = parseAllowTargets(c.AllowTargets)
+		if err != nil {
+			return err
+		}
+	}
+	c.tunnels = make(map[*tunnel]bool)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
 
-	// Connect to rps server
+	t, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	if !c.addTunnel(t) {
+		c.closeTunnel(t)
+		return errors.New("Client stopped.")
+	}
+	c.emit(Event{Type: TunnelReady, ExposedPort: t.exposedPort})
+	c.serve(t)
+	if c.HealthCheck != nil {
+		c.spawn(c.checkHealth)
+	}
+	return nil
+}
+
+// The TLS config to connect with, naming the rps server if it doesn't
+func (c *GoRpsClient) tlsConfig() *tls.Config {
+	if c.TLSConfig.ServerName != "" || c.TLSConfig.InsecureSkipVerify {
+		return c.TLSConfig
+	}
+	config := c.TLSConfig.Clone()
+	config.ServerName = c.ServerHost
+	if config.ServerName == "" {
+		config.ServerName = c.ServerTCPAddr.IP.String()
+	}
+	return config
+}
+
+// ResolveServer parses the address of an rps server, either host:port or a
+// ws:// or wss:// URL for reaching it over a WebSocket. It returns the
+// server's address, which users connect to, the host as given, for
+// GoRpsClient.ServerHost, and the URL, if there is one.
+func ResolveServer(address string) (*net.TCPAddr, string, string, error) {
+	if !strings.HasPrefix(address, "ws://") && !strings.HasPrefix(address, "wss://") {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, "", "", err
+		}
+		tcpAddr, err := net.ResolveTCPAddr("tcp", address)
+		return tcpAddr, host, "", err
+	}
+	serverURL, err := url.Parse(address)
+	if err != nil {
+		return nil, "", "", err
+	}
+	port := serverURL.Port()
+	if port == "" {
+		port = "80"
+		if serverURL.Scheme == "wss" {
+			port = "443"
+		}
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(serverURL.Hostname(), port))
+	return tcpAddr, serverURL.Hostname(), address, err
+}
+
+// Connect to the rps server, over a WebSocket if ServerURL is set
+func (c *GoRpsClient) dial(ctx context.Context) (net.Conn, error) {
+	if c.ServerURL != "" {
+		log.Printf("Dialing rps server @: %s\n", c.ServerURL)
+		return transport.DialWebSocket(ctx, c.ServerURL, c.TLSConfig, c.dialServer)
+	}
 	log.Printf("Dialing rps server @: %s\n", c.ServerTCPAddr.String())
-	c.ConnToRpsServer, err = net.DialTCP("tcp", nil, c.ServerTCPAddr)
+	conn, err := c.dialServer(ctx, "tcp", c.ServerTCPAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	if c.TLSConfig != nil {
+		conn = tls.Client(conn, c.tlsConfig())
+	}
+	return conn, nil
+}
+
+// Open a TCP connection to the rps server at addr, through a proxy if there
+// is one
+func (c *GoRpsClient) dialServer(ctx context.Context, network string, addr string) (net.Conn, error) {
+	proxy := c.Proxy
+	if proxy == "" {
+		proxy = ProxyFromEnvironment(addr)
+	}
+	if proxy == "" {
+		dialer := &net.Dialer{}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	proxyURL, err := parseProxy(proxy)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Dialing through proxy @: %s\n", proxyURL.Redacted())
+	return dialProxy(ctx, proxyURL, addr)
+}
+
+// Dial the rps server, say hello and return its answer, unless it was a
+// refusal
+func (c *GoRpsClient) hello(ctx context.Context, hello *pb.TestMessage) (net.Conn, *pb.TestMessage, error) {
+	// Connect to rps server
+	conn, err := c.dial(ctx)
 	if err != nil {
 		log.Printf("Error dialing rps server: %s\n", err.Error())
-		return err
+		return nil, nil, err
 	}
 
-	// Wait for rps server to tell us which port is exposed
-	msg, err := helper.ReceiveProtobuf(c.ConnToRpsServer)
+	// Unblock the handshake below if ctx ends first
+	stop := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	err = helper.SendProtobuf(conn, hello)
+	var msg *pb.TestMessage
+	if err == nil {
+		msg, err = helper.ReceiveProtobuf(conn)
+	}
+	close(stop)
+	<-exited
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
 	if err != nil {
-		log.Printf("Error receiving exposed port from rps server: %s\n", err.Error())
-		return err
+		log.Printf("Error receiving answer from rps server: %s\n", err.Error())
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	if msg.Type == pb.TestMessage_ConnectionClose {
+		conn.Close()
+		err = fmt.Errorf("Tunnel refused: %s", msg.Data)
+		log.Printf("%s\n", err.Error())
+		return nil, nil, err
+	}
+	return conn, msg, nil
+}
+
+// Dial the rps server and wait for it to tell us the exposed port
+func (c *GoRpsClient) connect(ctx context.Context) (*tunnel, error) {
+	// Say hello, then wait for rps server to tell us which port is exposed
+	hello := &pb.TestMessage{
+		Type:      pb.TestMessage_ConnectionOpen,
+		Id:        -1,
+		Token:     c.Token,
+		Group:     c.Group,
+		Protocol:  c.Protocol,
+		Transport: c.Transport,
+		Private:   c.Private,
+		Secret:    c.Secret,
+	}
+	if hello.Transport == "" {
+		hello.Transport = transport.Mux
+	}
+	if c.Protocol == "http" && c.HTTPS {
+		hello.Protocol = "https"
+	}
+	if c.RequestedPort != 0 {
+		hello.Data = []byte(strconv.Itoa(c.RequestedPort))
+	}
+	conn, msg, err := c.hello(ctx, hello)
+	if err != nil {
+		return nil, err
+	}
+	exposedPort, err := strconv.Atoi(string(msg.Data))
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
 
-	c.ExposedPort, err = strconv.Atoi(string(msg.Data))
+	// Rps servers that can't multiplex don't say
+	name := msg.Transport
+	if name == "" {
+		name = transport.Frames
+	}
+	session, err := transport.New(name, conn, false, c.WriteTimeout)
 	if err != nil {
-		return err
+		log.Printf("Error opening tunnel: %s\n", err.Error())
+		conn.Close()
+		return nil, err
 	}
-	go c.handleServerConn()
-	return nil
+
+	t := &tunnel{
+		conn:        conn,
+		session:     session,
+		exposedPort: exposedPort,
+		streams:     make(map[int32]*clientStream),
+	}
+	if c.Recorder != nil {
+		t.recording = c.Recorder.Session()
+	}
+	if c.Inspector != nil {
+		t.inspecting = c.Inspector.Session()
+	}
+	return t, nil
 }
 
 func (c *GoRpsClient) Stop() (err error) {
-	// Tell server that client has stopped so server can close all users connected
-	msg := &pb.TestMessage{
-		Type: pb.TestMessage_ConnectionClose,
-		Data: []byte(pb.TestMessage_ConnectionClose.String()),
-		Id:   -1,
-	}
+	return c.Shutdown(context.Background())
+}
 
-	bytes, err2 := proto.Marshal(msg)
-	if err2 != nil {
-		log.Printf("Error marshalling msg: %s\n", err2.Error())
-		return
+// Shutdown closes the tunnel and every connection to the protected server,
+// then waits for all of the client's goroutines to exit or for ctx to end.
+// Every error encountered along the way is returned together.
+func (c *GoRpsClient) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	if c.stopped {
+		c.mu.Unlock()
+		return nil
+	}
+	c.stopped = true
+	c.mu.Unlock()
+	if c.cancel == nil {
+		// The tunnel was never opened
+		return nil
+	}
+	c.cancel()
+	if c.listener != nil {
+		c.listener.stop()
 	}
-	c.ConnToRpsServer.Write(bytes)
-	for _, connToPS := range c.ConnToProtectedServer {
-		err = connToPS.Close()
+
+	var errs []error
+	for _, t := range c.allTunnels() {
+		streams, _, ok := c.removeTunnel(t)
+		if !ok {
+			continue
+		}
+
+		// Tell server that client has stopped so server can close all users connected
+		msg := &pb.TestMessage{
+			Type: pb.TestMessage_ConnectionClose,
+			Data: []byte(pb.TestMessage_ConnectionClose.String()),
+			Id:   -1,
+		}
+		err := t.session.Send(msg)
+		if err != nil && err != helper.ErrWriterClosed && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+		// Closing the session flushes the message above
+		err = t.session.Close()
 		if err != nil {
-			log.Printf("Error closing conn to ps: %s\n", err.Error())
-			return err
+			errs = append(errs, err)
+		}
+
+		for _, stream := range streams {
+			err = stream.conn.Close()
+			if err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Error closing conn to ps: %s\n", err.Error())
+				errs = append(errs, err)
+			}
+			c.streamClosed(stream, nil)
 		}
 	}
-	return nil
+
+	err := helper.Wait(ctx, &c.wg)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Run f in a goroutine that Shutdown waits for
+func (c *GoRpsClient) spawn(f func()) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		f()
+	}()
+}
+
+func (c *GoRpsClient) isStopped() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stopped
 }
 
-func (c *GoRpsClient) handleServerConn() {
+// Handle what the rps server sends on t until the tunnel closes
+func (c *GoRpsClient) serve(t *tunnel) {
+	c.spawn(func() {
+		c.handleServerConn(t)
+	})
+	c.spawn(func() {
+		c.acceptUsers(t)
+	})
+}
+
+func (c *GoRpsClient) handleServerConn(t *tunnel) {
 	for {
-		// Blocks until we receive a message from the server
-		msg, err := helper.ReceiveProtobuf(c.ConnToRpsServer)
+		// Blocks until we receive a control message from the server
+		msg, err := t.session.Receive()
 		if err != nil {
+			if c.isStopped() {
+				return
+			}
+			if !c.closeTunnel(t) {
+				// A drained tunnel the rps server has finished with
+				log.Printf("Drained tunnel on port %d closed\n", t.exposedPort)
+				return
+			}
 			log.Printf("Error receiving from rps server: %s\n", err.Error())
+			c.emit(Event{Type: ControlConnectionLost, Err: err})
+			if c.AutoReconnect {
+				c.reconnect(minReconnectDelay)
+			}
 			return
 		}
 
-		connToPS, ok := c.ConnToProtectedServer[msg.Id]
 		switch msg.Type {
-		// Start a new connection to protected server
-		case pb.TestMessage_ConnectionOpen:
-			{
-				if connToPS == nil {
-					c.openConnection(msg.Id)
-				} else {
-					log.Printf("Connection for user <%d> already exists.\n", msg.Id)
-				}
-				break
-			}
-		case pb.TestMessage_ConnectionClose:
+		// The rps server is going away. Users already connected keep using
+		// this tunnel while a new one is opened for everyone else.
+		case pb.TestMessage_Drain:
 			{
-				if ok {
-					log.Printf("Closing connection to PS for user <%d>\n", msg.Id)
-					err = connToPS.Close()
-					if err != nil {
-						log.Printf("Error closing connection to PS for user <%d>\n", msg.Id)
-						break
-					}
-					delete(c.ConnToProtectedServer, msg.Id)
-				} else {
-					log.Printf("Connection to PS for user <%d> is already nil\n", msg.Id)
-				}
-				break
-			}
-		case pb.TestMessage_Data:
-			{
-				if !ok {
-					c.openConnection(msg.Id)
-					connToPS = c.ConnToProtectedServer[msg.Id]
-				}
-				// Forward data to protected server
-				_, err = connToPS.Write([]byte(msg.Data))
-				if err != nil {
-					log.Printf("Error forwarding data to PS: %s\n", err.Error())
+				log.Printf("RPS server on port %d is draining\n", t.exposedPort)
+				current := c.markDraining(t)
+				c.emit(Event{Type: Draining, ExposedPort: t.exposedPort})
+				if current && c.AutoReconnect {
+					c.spawn(func() {
+						c.reconnect(0)
+					})
 				}
 				break
 			}
@@ -124,64 +421,260 @@ func (c *GoRpsClient) handleServerConn() {
 	}
 }
 
-func (c *GoRpsClient) listenToProtectedServer(id int32) {
+// Start a connection to the protected server for every user the rps server
+// opens a stream for on t
+func (c *GoRpsClient) acceptUsers(t *tunnel) {
 	for {
-		currentConn, ok := c.ConnToProtectedServer[id]
-		if !ok {
-			log.Printf("Connection for user <%d> has closed.\n", id)
+		user, err := t.session.Accept()
+		if err != nil {
 			return
 		}
-		msg, err := helper.GenerateProtobuf(currentConn, id)
-		if err != nil {
-			if err == io.EOF {
-				currentConn.Close()
+		c.spawn(func() {
+			c.openConnection(t, user)
+		})
+	}
+}
 
-				// Tell server that it has closed so server can close all users connected
-				msg := &pb.TestMessage{
-					Type: pb.TestMessage_ConnectionClose,
-					Data: []byte(pb.TestMessage_ConnectionClose.String()),
-				}
+// Keep trying to open a new tunnel until it works or the client is stopped,
+// waiting delay before the first attempt. Does nothing if another reconnect
+// is already running.
+func (c *GoRpsClient) reconnect(delay time.Duration) {
+	c.mu.Lock()
+	if c.reconnecting || c.stopped {
+		c.mu.Unlock()
+		return
+	}
+	c.reconnecting = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.reconnecting = false
+		c.mu.Unlock()
+	}()
 
-				bytes, err2 := proto.Marshal(msg)
-				if err2 != nil {
-					log.Printf("Error marshalling msg: %s\n", err2.Error())
-					return
-				}
-				c.ConnToRpsServer.Write(bytes)
+	for {
+		select {
+		case <-time.After(delay):
+		case <-c.ctx.Done():
+			return
+		}
+		t, err := c.connect(c.ctx)
+		if err == nil {
+			if !c.addTunnel(t) {
+				t.session.Close()
 				return
 			}
-			log.Printf("Connection to PS closed: %s\n", err.Error())
+			log.Printf("Tunnel re-opened on port: %d\n", t.exposedPort)
+			c.reportHealth(t)
+			c.emit(Event{Type: Reconnected, ExposedPort: t.exposedPort})
+			c.serve(t)
 			return
 		}
+		delay *= 2
+		if delay < minReconnectDelay {
+			delay = minReconnectDelay
+		}
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// Close t and every stream on it. Returns whether it was the current tunnel.
+func (c *GoRpsClient) closeTunnel(t *tunnel) bool {
+	streams, current, _ := c.removeTunnel(t)
+	t.session.Close()
+
+	// Users of the tunnel are gone along with it
+	for _, stream := range streams {
+		stream.conn.Close()
+		c.streamClosed(stream, nil)
+	}
+	return current
+}
+
+// Carry the user's bytes between the rps server and the protected server
+// until either side is done
+func (c *GoRpsClient) relay(stream *clientStream) {
+	c.spawn(func() {
+		// Forward data to protected server
+		_, err := io.Copy(&helper.Tap{Writer: stream.conn, See: func(data []byte) {
+			stream.counter.addIn(len(data))
+			if stream.tunnel.inspecting != nil {
+				stream.tunnel.inspecting.Request(stream.id, data)
+			}
+			if stream.tunnel.recording != nil {
+				stream.tunnel.recording.Data(stream.id, recorder.Inbound, data)
+			}
+		}}, stream.user)
+		c.closeStream(stream, err)
+	})
 
-		// Send back to server
-		c.Send(msg)
+	// Send back to server
+	_, err := io.Copy(&helper.Tap{Writer: stream.user, See: func(data []byte) {
+		stream.counter.addOut(len(data))
+		if stream.tunnel.inspecting != nil {
+			stream.tunnel.inspecting.Response(stream.id, data)
+		}
+		if stream.tunnel.recording != nil {
+			stream.tunnel.recording.Data(stream.id, recorder.Outbound, data)
+		}
+	}}, stream.conn)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("Connection to PS closed: %s\n", err.Error())
 	}
+	c.closeStream(stream, nil)
 }
 
-func (c *GoRpsClient) openConnection(id int32) {
-	address := &net.TCPAddr{
-		IP:   net.IPv4(127, 0, 0, 1),
-		Port: c.protectedServerPort,
+// Close the user's connection to the protected server and their stream,
+// unless that was already done. err is what ended it, if the rps server
+// reset it.
+func (c *GoRpsClient) closeStream(stream *clientStream, err error) {
+	if c.removeStream(stream.tunnel, stream.id) == nil {
+		// Nothing to do if the stream was already closed by someone else
+		return
+	}
+	var reset *helper.ResetError
+	if errors.As(err, &reset) {
+		log.Printf("Resetting connection to PS for user <%d>: %s\n", stream.id, reset.Error())
+		err = reset
+	} else {
+		log.Printf("Closing connection to PS for user <%d>\n", stream.id)
+		err = nil
 	}
+	stream.conn.Close()
+	stream.user.Close()
+	c.streamClosed(stream, err)
+}
+
+// Open a connection to the protected server for the user of stream <user>
+// on t, or to the destination they asked for if this is a socks5 tunnel.
+// If it can't be opened the stream is reset.
+func (c *GoRpsClient) openConnection(t *tunnel, user transport.Stream) {
+	var conn net.Conn
 	var err error
-	log.Printf("Dialing protected server @: %s\n", address.String())
-	c.ConnToProtectedServer[id], err = net.DialTCP("tcp", nil, address)
+	remoteAddr := user.RemoteAddr().String()
+	switch {
+	case c.listener != nil:
+		conn, err = c.listener.open(remoteAddr)
+	case c.Protocol == "socks5":
+		conn, err = c.dialTarget(user.Target())
+		if err == errTargetNotAllowed {
+			log.Printf("Refusing user <%d> a connection to %s\n", user.Id(), user.Target())
+			c.refuseUser(user, &helper.ResetError{Code: pb.TestMessage_PolicyDenied, Reason: err.Error()})
+			return
+		}
+	default:
+		conn, err = c.dialProtectedServer()
+	}
 	if err != nil {
-		log.Printf("Error open: " + err.Error())
-		delete(c.ConnToProtectedServer, id)
+		log.Printf("Error open: %s\n", err.Error())
+		reason := "Protected server unavailable"
+		if c.Protocol == "socks5" {
+			reason = "Destination unavailable"
+		}
+		c.refuseUser(user, &helper.ResetError{Code: helper.DialResetCode(err), Reason: reason})
 		return
 	}
-	go c.listenToProtectedServer(id)
+	if c.Protocol == "socks5" {
+		// The user waits to hear the connection is made before sending
+		_, err = user.Write(helper.SOCKSReply(helper.SOCKSSucceeded))
+		if err != nil {
+			conn.Close()
+			user.Close()
+			return
+		}
+	}
+	stream := c.addStream(t, user, conn)
+	if stream == nil {
+		conn.Close()
+		user.Close()
+		return
+	}
+	if t.recording != nil {
+		t.recording.Opened(stream.id)
+	}
+	c.emit(Event{Type: UserConnected, UserId: stream.id, RemoteAddr: remoteAddr})
+	c.relay(stream)
 }
 
-func (c *GoRpsClient) Send(msg *pb.TestMessage) {
-	out, err := proto.Marshal(msg)
+// The host:port of the protected server
+func (c *GoRpsClient) targetAddr() string {
+	host := c.TargetHost
+	if host == "" {
+		// Whichever of 127.0.0.1 and ::1 the protected server is on
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(c.protectedServerPort))
+}
+
+// Dial the protected server, over TLS if TargetTLS is set. The handshake
+// counts against dialTimeout.
+func (c *GoRpsClient) dialProtectedServer() (net.Conn, error) {
+	address := c.targetAddr()
+	log.Printf("Dialing protected server @: %s\n", address)
+	if c.TargetTLS == nil {
+		return net.DialTimeout("tcp", address, dialTimeout)
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, dialTimeout)
+	defer cancel()
+	dialer := &tls.Dialer{Config: c.TargetTLS}
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// Dial where a socks5 user asked to go, if it is allowed
+func (c *GoRpsClient) dialTarget(target string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(c.ctx, dialTimeout)
+	defer cancel()
+	address, err := c.socksTarget(ctx, target)
 	if err != nil {
-		log.Printf("Error marshalling: %s\n", err.Error())
-		return
+		return nil, err
 	}
-	_, err = c.ConnToRpsServer.Write(out)
+	log.Printf("Dialing destination @: %s\n", address)
+	dialer := &net.Dialer{}
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// Reset the stream of a user that can't be served instead of leaving them
+// hanging. HTTP users are answered with an error page once their request's
+// headers arrive, as HTTP clients discard a response that comes before
+// them. SOCKS5 users are waiting for the answer to their connect request.
+func (c *GoRpsClient) refuseUser(user transport.Stream, reset *helper.ResetError) {
+	if c.Protocol == "socks5" {
+		user.Write(helper.SOCKSResetReply(reset.Code))
+	}
+	if c.Protocol == "http" {
+		user.SetReadDeadline(time.Now().Add(requestTimeout))
+		_, err := http.ReadRequest(bufio.NewReader(user))
+		if err != nil {
+			user.Close()
+			return
+		}
+		user.Write(helper.ResetResponse(reset.Code, reset.Reason))
+	}
+	user.Reset(reset.Code, reset.Reason)
+}
+
+// Clean up after the stream for a user has ended, err is the reset that
+// ended it if any
+func (c *GoRpsClient) streamClosed(stream *clientStream, err error) {
+	if stream.tunnel.inspecting != nil {
+		stream.tunnel.inspecting.Close(stream.id)
+	}
+	if stream.tunnel.recording != nil {
+		stream.tunnel.recording.Closed(stream.id)
+	}
+	in, out := stream.counter.totals()
+	c.emit(Event{Type: UserDisconnected, UserId: stream.id, BytesIn: in, BytesOut: out, Err: err})
+}
+
+// Send queues a control message for the rps server
+func (c *GoRpsClient) Send(msg *pb.TestMessage) {
+	c.send(c.currentTunnel(), msg)
+}
+
+func (c *GoRpsClient) send(t *tunnel, msg *pb.TestMessage) {
+	err := t.session.Send(msg)
 	if err != nil {
 		log.Printf("Error writing to rps server: %s\n", err.Error())
 	}
@@ -0,0 +1,275 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProxyFromEnvironment returns the proxy to reach addr through, taken from
+// $HTTPS_PROXY or else $ALL_PROXY (or their lower case forms), unless
+// $NO_PROXY names addr's host. Returns "" for none.
+func ProxyFromEnvironment(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	for _, pattern := range strings.Split(getenv("NO_PROXY"), ",") {
+		pattern = strings.TrimPrefix(strings.TrimSpace(pattern), ".")
+		if pattern == "*" || pattern != "" && (host == pattern || strings.HasSuffix(host, "."+pattern)) {
+			return ""
+		}
+	}
+	proxy := getenv("HTTPS_PROXY")
+	if proxy == "" {
+		proxy = getenv("ALL_PROXY")
+	}
+	return proxy
+}
+
+func getenv(name string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		value = os.Getenv(strings.ToLower(name))
+	}
+	return value
+}
+
+// Parse a proxy address, http://[user:password@]host[:port] or
+// socks5://[user:password@]host[:port]. A bare host:port is an HTTP proxy.
+func parseProxy(proxy string) (*url.URL, error) {
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	port := proxyURL.Port()
+	switch proxyURL.Scheme {
+	case "http":
+		if port == "" {
+			port = "80"
+		}
+	case "socks5", "socks5h":
+		if port == "" {
+			port = "1080"
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported proxy %q, expected http or socks5", proxyURL.Scheme)
+	}
+	proxyURL.Host = net.JoinHostPort(proxyURL.Hostname(), port)
+	return proxyURL, nil
+}
+
+// Open a connection to addr through the proxy at proxyURL, giving up once
+// ctx ends
+func dialProxy(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	// Unblock the handshake if ctx ends first
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	if proxyURL.Scheme == "http" {
+		conn, err = connectHTTP(conn, proxyURL, addr)
+	} else {
+		err = connectSOCKS5(conn, proxyURL, addr)
+	}
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Ask an HTTP proxy to CONNECT to addr
+func connectHTTP(conn net.Conn, proxyURL *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		req.SetBasicAuth(proxyURL.User.Username(), password)
+		req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+		delete(req.Header, "Authorization")
+	}
+	err := req.Write(conn)
+	if err != nil {
+		return conn, err
+	}
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return conn, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("Proxy refused to connect: %s", res.Status)
+	}
+	if reader.Buffered() > 0 {
+		// The rps server never speaks first, but don't lose anything if it did
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// A connection with bytes already read into reader
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// SOCKS5 protocol values, RFC 1928 and 1929
+const (
+	socks5Version    = 5
+	socks5NoAuth     = 0
+	socks5PasswdAuth = 2
+	socks5NoMethod   = 0xff
+	socks5Connect    = 1
+	socks5IPv4       = 1
+	socks5Domain     = 3
+	socks5IPv6       = 4
+)
+
+var socks5Replies = []string{
+	"succeeded",
+	"general failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+// Ask a SOCKS5 proxy to connect to addr, logging in if proxyURL has a user
+func connectSOCKS5(conn net.Conn, proxyURL *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+
+	method := byte(socks5NoAuth)
+	if proxyURL.User != nil {
+		method = socks5PasswdAuth
+	}
+	_, err = conn.Write([]byte{socks5Version, 1, method})
+	if err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("Not a SOCKS5 proxy")
+	}
+	if reply[1] != method {
+		return errors.New("SOCKS5 proxy refused to authenticate that way")
+	}
+	if method == socks5PasswdAuth {
+		user := proxyURL.User.Username()
+		password, _ := proxyURL.User.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return errors.New("SOCKS5 user or password too long")
+		}
+		msg := []byte{1, byte(len(user))}
+		msg = append(msg, user...)
+		msg = append(msg, byte(len(password)))
+		msg = append(msg, password...)
+		_, err = conn.Write(msg)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(conn, reply)
+		if err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("SOCKS5 proxy rejected the user and password")
+		}
+	}
+
+	// Names are resolved by the proxy, which may see DNS we can't
+	msg := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("SOCKS5 host name too long")
+		}
+		msg = append(msg, socks5Domain, byte(len(host)))
+		msg = append(msg, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		msg = append(msg, socks5IPv4)
+		msg = append(msg, ip4...)
+	} else {
+		msg = append(msg, socks5IPv6)
+		msg = append(msg, ip...)
+	}
+	msg = binary.BigEndian.AppendUint16(msg, uint16(port))
+	_, err = conn.Write(msg)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		reason := "unknown error"
+		if int(header[1]) < len(socks5Replies) {
+			reason = socks5Replies[header[1]]
+		}
+		return fmt.Errorf("SOCKS5 proxy couldn't connect: %s", reason)
+	}
+	// Skip the address the proxy connected from
+	var skip int
+	switch header[3] {
+	case socks5IPv4:
+		skip = net.IPv4len
+	case socks5IPv6:
+		skip = net.IPv6len
+	case socks5Domain:
+		length := make([]byte, 1)
+		_, err = io.ReadFull(conn, length)
+		if err != nil {
+			return err
+		}
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("SOCKS5 proxy sent unknown address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+type EventType int
+
+const (
+	// The tunnel is open and ExposedPort is set
+	TunnelReady EventType = iota
+	// A user connected to the exposed port
+	UserConnected
+	// A user's connection to the protected server has ended
+	UserDisconnected
+	// The connection to the rps server was lost
+	ControlConnectionLost
+	// The tunnel was re-opened after losing the connection to the rps server,
+	// or after the rps server started draining
+	Reconnected
+	// The rps server is shutting down. Users already connected carry on, and
+	// with AutoReconnect a new tunnel is opened for new users.
+	Draining
+	// A health check of the protected server failed, Err says why. The rps
+	// server stops sending users until it is healthy again.
+	Unhealthy
+	// The protected server passed a health check after failing one
+	Healthy
+)
+
+var eventTypeNames = map[EventType]string{
+	TunnelReady:           "TunnelReady",
+	UserConnected:         "UserConnected",
+	UserDisconnected:      "UserDisconnected",
+	ControlConnectionLost: "ControlConnectionLost",
+	Reconnected:           "Reconnected",
+	Draining:              "Draining",
+	Unhealthy:             "Unhealthy",
+	Healthy:               "Healthy",
+}
+
+func (t EventType) String() string {
+	return eventTypeNames[t]
+}
+
+// An Event describes something that happened to the tunnel. Only the
+// fields relevant to its Type are set.
+type Event struct {
+	Type        EventType
+	ExposedPort int    // TunnelReady, Reconnected, Draining
+	UserId      int32  // UserConnected, UserDisconnected
+	RemoteAddr  string // UserConnected: the user's address as seen by the rps server
+	BytesIn     int64  // UserDisconnected: bytes sent by the user to the protected server
+	BytesOut    int64  // UserDisconnected: bytes sent by the protected server to the user
+	Err         error  // ControlConnectionLost, Unhealthy, UserDisconnected: the *helper.ResetError that ended the stream
+}
+
+// Byte counts for one user's stream
+type streamCounter struct {
+	in  int64
+	out int64
+}
+
+func (sc *streamCounter) addIn(n int) {
+	atomic.AddInt64(&sc.in, int64(n))
+}
+
+func (sc *streamCounter) addOut(n int) {
+	atomic.AddInt64(&sc.out, int64(n))
+}
+
+func (sc *streamCounter) totals() (int64, int64) {
+	return atomic.LoadInt64(&sc.in), atomic.LoadInt64(&sc.out)
+}
+
+// Events are delivered without blocking the tunnel, so a full channel drops them
+func (c *GoRpsClient) emit(event Event) {
+	if c.Events == nil {
+		return
+	}
+	select {
+	case c.Events <- event:
+	default:
+		log.Printf("Events channel is full, dropping %s event\n", event.Type)
+	}
+}
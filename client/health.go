@@ -0,0 +1,130 @@
+package client
+
+import (
+	"crypto/tls"
+	"fmt"
+	pb "github.com/andysctu/go-tunnel/protobuf"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthTimeout  = 2 * time.Second
+)
+
+// A HealthCheck has the client check its protected server periodically.
+// While it is down, the rps server stops sending it users.
+type HealthCheck struct {
+	Interval time.Duration `yaml:"interval"` // Optional, time between checks, defaults to 10s
+	Timeout  time.Duration `yaml:"timeout"`  // Optional, how long a check may take, defaults to 2s
+	Path     string        `yaml:"path"`     // Optional, GET this path and expect a status below 400, otherwise just connect
+	Addr     string        `yaml:"-"`        // Optional, host:port to check, defaults to the protected server
+}
+
+// Returns why the protected server at addr is unhealthy, or nil. It is
+// checked over TLS if tlsConfig is set.
+func (hc *HealthCheck) check(addr string, tlsConfig *tls.Config) error {
+	timeout := hc.Timeout
+	if timeout == 0 {
+		timeout = defaultHealthTimeout
+	}
+	if hc.Path == "" {
+		var conn net.Conn
+		var err error
+		if tlsConfig != nil {
+			conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, tlsConfig)
+		} else {
+			conn, err = net.DialTimeout("tcp", addr, timeout)
+		}
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	client := &http.Client{Timeout: timeout}
+	scheme := "http://"
+	if tlsConfig != nil {
+		scheme = "https://"
+		client.Transport = &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true}
+	}
+	res, err := client.Get(scheme + addr + hc.Path)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("%s returned %s", hc.Path, res.Status)
+	}
+	return nil
+}
+
+// Check the protected server until the client stops, telling the rps
+// server whenever its health changes
+func (c *GoRpsClient) checkHealth() {
+	addr := c.HealthCheck.Addr
+	if addr == "" {
+		addr = c.targetAddr()
+	}
+	interval := c.HealthCheck.Interval
+	if interval == 0 {
+		interval = defaultHealthInterval
+	}
+	for {
+		c.setHealth(c.HealthCheck.check(addr, c.TargetTLS))
+		select {
+		case <-time.After(interval):
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *GoRpsClient) setHealth(err error) {
+	reason := ""
+	if err != nil {
+		reason = err.Error()
+	}
+	c.mu.Lock()
+	if reason == c.unhealthy {
+		c.mu.Unlock()
+		return
+	}
+	c.unhealthy = reason
+	c.mu.Unlock()
+
+	if err != nil {
+		log.Printf("Protected server is unhealthy: %s\n", reason)
+		c.emit(Event{Type: Unhealthy, Err: err})
+	} else {
+		log.Printf("Protected server is healthy again\n")
+		c.emit(Event{Type: Healthy})
+	}
+	for _, t := range c.allTunnels() {
+		c.send(t, healthMessage(reason))
+	}
+}
+
+// Tell the rps server about an unhealthy protected server on a tunnel that
+// was just opened. New tunnels start out healthy.
+func (c *GoRpsClient) reportHealth(t *tunnel) {
+	c.mu.Lock()
+	reason := c.unhealthy
+	c.mu.Unlock()
+	if reason != "" {
+		c.send(t, healthMessage(reason))
+	}
+}
+
+// Data carries why the protected server is unhealthy, empty once it is
+// healthy again
+func healthMessage(reason string) *pb.TestMessage {
+	return &pb.TestMessage{
+		Type: pb.TestMessage_Health,
+		Data: []byte(reason),
+		Id:   -1,
+	}
+}
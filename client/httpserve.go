@@ -0,0 +1,61 @@
+package client
+
+import (
+	"crypto/subtle"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// Serve the users of an http tunnel by proxying their requests to its
+// protected server. Returns once the listener is closed.
+func serveHTTP(listener net.Listener, t *TunnelConfig) {
+	target := &url.URL{Scheme: "http", Host: t.TargetAddr()}
+	if t.tlsConfig != nil {
+		target.Scheme = "https"
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	if t.tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = t.tlsConfig
+		proxy.Transport = transport
+	}
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		for name, value := range t.Headers {
+			req.Header.Set(name, value)
+		}
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		log.Printf("Error proxying to %s: %s\n", target.Host, err.Error())
+		http.Error(w, "Service Unavailable: Protected server unavailable", http.StatusServiceUnavailable)
+	}
+
+	handler := http.Handler(proxy)
+	if t.Auth != "" {
+		user, password := splitAuth(t.Auth)
+		handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			u, p, ok := req.BasicAuth()
+			if !ok ||
+				subtle.ConstantTimeCompare([]byte(u), []byte(user)) != 1 ||
+				subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="`+t.Name+`"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			// The protected server doesn't need the tunnel's credentials
+			req.Header.Del("Authorization")
+			proxy.ServeHTTP(w, req)
+		})
+	}
+	http.Serve(listener, handler)
+}
+
+func splitAuth(auth string) (string, string) {
+	i := strings.Index(auth, ":")
+	return auth[:i], auth[i+1:]
+}
@@ -0,0 +1,120 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// Users waiting to be accepted before new ones are turned away
+const acceptBacklog = 64
+
+var (
+	errListenerClosed = errors.New("Tunnel listener closed")
+	errBacklogFull    = errors.New("Too many users waiting to be accepted")
+)
+
+// Listen opens a tunnel like OpenTunnel, but instead of dialing a protected
+// server for each user, hands every user's connection to the returned
+// listener. A Go program can serve it directly, e.g. with http.Serve.
+// Closing the listener stops the client.
+func (c *GoRpsClient) Listen() (net.Listener, error) {
+	return c.ListenContext(context.Background())
+}
+
+// ListenContext is like Listen, but gives up on reaching the rps server
+// once ctx is cancelled or its deadline passes
+func (c *GoRpsClient) ListenContext(ctx context.Context) (net.Listener, error) {
+	listener := &tunnelListener{
+		client: c,
+		conns:  make(chan net.Conn, acceptBacklog),
+		closed: make(chan struct{}),
+	}
+	c.listener = listener
+	err := c.OpenTunnelContext(ctx, 0)
+	if err != nil {
+		c.listener = nil
+		return nil, err
+	}
+	return listener, nil
+}
+
+type tunnelListener struct {
+	client *GoRpsClient
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *tunnelListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *tunnelListener) Close() error {
+	l.stop()
+	return l.client.Stop()
+}
+
+// Turn away users waiting in Accept and any that arrive after
+func (l *tunnelListener) stop() {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+}
+
+// Addr is the address users connect to on the rps server
+func (l *tunnelListener) Addr() net.Addr {
+	return &net.TCPAddr{
+		IP:   l.client.ServerTCPAddr.IP,
+		Port: l.client.exposedPort(),
+	}
+}
+
+// Create an in-memory connection for a new user and queue it for Accept.
+// Returns the end the tunnel reads from and writes to.
+func (l *tunnelListener) open(remoteAddr string) (net.Conn, error) {
+	local, remote := net.Pipe()
+	userAddr, err := net.ResolveTCPAddr("tcp", remoteAddr)
+	if err != nil {
+		userAddr = &net.TCPAddr{}
+	}
+	conn := &tunnelConn{
+		Conn:       remote,
+		localAddr:  l.Addr(),
+		remoteAddr: userAddr,
+	}
+
+	err = errBacklogFull
+	select {
+	case l.conns <- conn:
+		return local, nil
+	case <-l.closed:
+		err = errListenerClosed
+	default:
+	}
+	local.Close()
+	remote.Close()
+	return nil, err
+}
+
+// tunnelConn is the listener's side of a user's connection, reporting the
+// user's address instead of the pipe's
+type tunnelConn struct {
+	net.Conn
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func (tc *tunnelConn) LocalAddr() net.Addr {
+	return tc.localAddr
+}
+
+func (tc *tunnelConn) RemoteAddr() net.Addr {
+	return tc.remoteAddr
+}
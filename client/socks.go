@@ -0,0 +1,140 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var errTargetNotAllowed = errors.New("Destination not allowed")
+
+// One entry of AllowTargets. A destination matches if its port does, when
+// the rule has one, and its host is in network or matches name.
+type targetRule struct {
+	network *net.IPNet
+	name    string // A host name, "*.domain" for any host under domain, or "*" for any host
+	port    int    // 0 for any port
+}
+
+// Parse the allow list of a socks5 tunnel. Each entry is an IP, a CIDR, a
+// host name or *.domain, any of them with an optional :port, or * for any
+// destination at all.
+func parseAllowTargets(entries []string) ([]targetRule, error) {
+	if len(entries) == 0 {
+		return nil, errors.New("Socks5 tunnels need destinations to allow")
+	}
+	rules := make([]targetRule, 0, len(entries))
+	for _, entry := range entries {
+		rule, err := parseTargetRule(entry)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseTargetRule(entry string) (targetRule, error) {
+	var rule targetRule
+	host := entry
+	// Bare IPv6 addresses are full of colons, they only have a port in brackets
+	if h, portStr, err := net.SplitHostPort(entry); err == nil {
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port <= 0 || port > 65535 {
+			return rule, fmt.Errorf("Invalid port in allowed destination %q", entry)
+		}
+		host, rule.port = h, port
+	}
+	if host == "" {
+		return rule, fmt.Errorf("Invalid allowed destination %q", entry)
+	}
+	if strings.Contains(host, "/") {
+		_, network, err := net.ParseCIDR(host)
+		if err != nil {
+			return rule, fmt.Errorf("Invalid allowed destination %q", entry)
+		}
+		rule.network = network
+		return rule, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * net.IPv4len
+		if ip.To4() == nil {
+			bits = 8 * net.IPv6len
+		}
+		rule.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		return rule, nil
+	}
+	rule.name = strings.ToLower(host)
+	return rule, nil
+}
+
+func (r targetRule) matchesName(host string, port int) bool {
+	if r.name == "" || (r.port != 0 && r.port != port) {
+		return false
+	}
+	host = strings.ToLower(host)
+	switch {
+	case r.name == "*":
+		return true
+	case strings.HasPrefix(r.name, "*."):
+		return strings.HasSuffix(host, r.name[1:])
+	}
+	return host == r.name
+}
+
+func (r targetRule) matchesIP(ip net.IP, port int) bool {
+	if r.network == nil || (r.port != 0 && r.port != port) {
+		return false
+	}
+	return r.network.Contains(ip)
+}
+
+// The address to dial for a socks5 user asking for target, or
+// errTargetNotAllowed. A host name that only an IP rule allows is resolved
+// here and the allowed IP is dialed, so the name can't change its answer in
+// between.
+func (c *GoRpsClient) socksTarget(ctx context.Context, target string) (string, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", err
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		for _, rule := range c.allow {
+			if rule.name == "*" || rule.matchesIP(ip, port) {
+				return target, nil
+			}
+		}
+		return "", errTargetNotAllowed
+	}
+
+	byIP := false
+	for _, rule := range c.allow {
+		if rule.matchesName(host, port) {
+			return target, nil
+		}
+		byIP = byIP || rule.network != nil
+	}
+	if !byIP {
+		return "", errTargetNotAllowed
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		for _, rule := range c.allow {
+			if rule.matchesIP(ip, port) {
+				return net.JoinHostPort(ip.String(), portStr), nil
+			}
+		}
+	}
+	return "", errTargetNotAllowed
+}
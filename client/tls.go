@@ -0,0 +1,46 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// TargetTLS is how the client connects to a protected server that only
+// speaks TLS. The zero value verifies its certificate against the system's
+// CAs, for the host the client dials.
+type TargetTLS struct {
+	ServerName         string `yaml:"server_name"`          // Optional, the name to ask for and verify instead of the target's host
+	CAFile             string `yaml:"ca_file"`              // Optional, PEM bundle of the CAs to trust instead of the system's
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"` // Optional, accept any certificate, e.g. a self-signed one in development
+	CertFile           string `yaml:"cert_file"`            // Optional, certificate to present to the protected server, with KeyFile
+	KeyFile            string `yaml:"key_file"`
+}
+
+// Config loads the files of tt into a config for GoRpsClient.TargetTLS
+func (tt *TargetTLS) Config() (*tls.Config, error) {
+	config := &tls.Config{ServerName: tt.ServerName, InsecureSkipVerify: tt.InsecureSkipVerify}
+	if tt.CAFile != "" {
+		data, err := ioutil.ReadFile(tt.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No certificates in %s", tt.CAFile)
+		}
+	}
+	if (tt.CertFile == "") != (tt.KeyFile == "") {
+		return nil, errors.New("cert_file and key_file must be set together")
+	}
+	if tt.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(tt.CertFile, tt.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"github.com/andysctu/go-tunnel/inspector"
+	"github.com/andysctu/go-tunnel/recorder"
+	"github.com/andysctu/go-tunnel/transport"
+	"net"
+)
+
+// A tunnel is one control connection to an rps server and the streams
+// opened through it. A client has one tunnel that new users arrive on, and
+// may still have older tunnels that the rps server is draining.
+type tunnel struct {
+	conn        net.Conn
+	session     transport.Session // Everything to and from the rps server goes through it
+	exposedPort int
+	recording   *recorder.Session       // Nil unless the client has a Recorder, user ids are only unique within a tunnel
+	inspecting  *inspector.Session      // Nil unless the client has an Inspector, likewise
+	streams     map[int32]*clientStream // UserID -> stream, guarded by c.mu
+	draining    bool                    // Guarded by c.mu
+}
+
+// A clientStream is one user's connection to the protected server (or to
+// the Listen listener), and the stream carrying it from the rps server
+type clientStream struct {
+	id      int32
+	conn    net.Conn
+	user    transport.Stream
+	tunnel  *tunnel
+	counter streamCounter
+}
+
+// Tunnels and their streams are guarded by c.mu. Whoever removes a tunnel or
+// stream owns it and is responsible for closing it, so each is closed
+// exactly once.
+
+// Make t the tunnel new users arrive on. Returns false if the client has
+// stopped.
+func (c *GoRpsClient) addTunnel(t *tunnel) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return false
+	}
+	c.tunnels[t] = true
+	c.tunnel = t
+	c.ConnToRpsServer = t.conn
+	c.ExposedPort = t.exposedPort
+	return true
+}
+
+// Forget t, returning its streams and whether it was the current tunnel.
+// Returns ok false if it was already removed.
+func (c *GoRpsClient) removeTunnel(t *tunnel) (streams []*clientStream, current bool, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.tunnels[t] {
+		return nil, false, false
+	}
+	delete(c.tunnels, t)
+	for id, stream := range t.streams {
+		streams = append(streams, stream)
+		delete(t.streams, id)
+	}
+	return streams, c.tunnel == t, true
+}
+
+// Returns every open tunnel
+func (c *GoRpsClient) allTunnels() []*tunnel {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tunnels := make([]*tunnel, 0, len(c.tunnels))
+	for t := range c.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	return tunnels
+}
+
+// Mark t as being drained by the rps server. Returns whether it was the
+// current tunnel.
+func (c *GoRpsClient) markDraining(t *tunnel) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t.draining = true
+	return c.tunnel == t
+}
+
+// Register the stream of a user on t, connected to the protected server by
+// conn. Returns nil if the client has stopped, t is gone or the user already
+// has a stream.
+func (c *GoRpsClient) addStream(t *tunnel, user transport.Stream, conn net.Conn) *clientStream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped || !c.tunnels[t] {
+		return nil
+	}
+	id := user.Id()
+	if _, ok := t.streams[id]; ok {
+		return nil
+	}
+	stream := &clientStream{id: id, conn: conn, user: user, tunnel: t}
+	t.streams[id] = stream
+	return stream
+}
+
+// Forget the stream for user <id> on t, returning it. Returns nil if it was
+// already removed.
+func (c *GoRpsClient) removeStream(t *tunnel, id int32) *clientStream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stream, ok := t.streams[id]
+	if !ok {
+		return nil
+	}
+	delete(t.streams, id)
+	return stream
+}
+
+// The tunnel new users arrive on
+func (c *GoRpsClient) currentTunnel() *tunnel {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tunnel
+}
+
+// The exposed port, which changes when the tunnel is re-opened
+func (c *GoRpsClient) exposedPort() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ExposedPort
+}
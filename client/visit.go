@@ -0,0 +1,57 @@
+package client
+
+import (
+	"context"
+	pb "github.com/andysctu/go-tunnel/protobuf"
+	"io"
+	"log"
+	"net"
+)
+
+// Visit connects to the private tunnel published under name, presenting
+// Secret. The connection it returns carries bytes to and from the tunnel's
+// protected server, through the rps server and the publishing client.
+func (c *GoRpsClient) Visit(ctx context.Context, name string) (net.Conn, error) {
+	hello := &pb.TestMessage{
+		Type:   pb.TestMessage_ConnectionOpen,
+		Id:     -1,
+		Token:  c.Token,
+		Visit:  name,
+		Secret: c.Secret,
+	}
+	conn, _, err := c.hello(ctx, hello)
+	return conn, err
+}
+
+// ServeVisitors visits the private tunnel published under name for every
+// connection to listener, so local programs can reach it as if it were on
+// listener's port. Returns once listener is closed.
+func (c *GoRpsClient) ServeVisitors(listener net.Listener, name string) error {
+	for {
+		localConn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go c.serveVisitor(localConn, name)
+	}
+}
+
+func (c *GoRpsClient) serveVisitor(localConn net.Conn, name string) {
+	defer localConn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	conn, err := c.Visit(ctx, name)
+	cancel()
+	if err != nil {
+		log.Printf("Error visiting %s: %s\n", name, err.Error())
+		return
+	}
+	defer conn.Close()
+	log.Printf("Visiting %s for %s\n", name, localConn.RemoteAddr().String())
+
+	// Either side hanging up ends the visit
+	go func() {
+		io.Copy(conn, localConn)
+		conn.Close()
+	}()
+	io.Copy(localConn, conn)
+}
@@ -1,43 +1,136 @@
 package helper
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	pb "github.com/andysctu/go-tunnel/protobuf"
 	"github.com/golang/protobuf/proto"
+	"io"
 	"net"
+	"net/http"
+	"strconv"
+	"sync"
 )
 
-func ReceiveProtobuf(conn *net.TCPConn) (*pb.TestMessage, error) {
+// Largest frame we accept on a control connection
+const maxFrameSize = 1024 * 1024
+
+// ErrUnframed is returned by ReceiveProtobuf when the peer sends bare
+// protobufs without a length, as versions from before frames did. The two
+// can't talk to each other.
+var ErrUnframed = errors.New("Peer speaks the old unframed protocol and must be upgraded.")
+
+// Every protobuf on a control connection is preceded by its length as a
+// 4 byte big endian integer, so messages can't run into each other
+func ReceiveProtobuf(conn net.Conn) (*pb.TestMessage, error) {
 	if conn == nil {
 		return nil, errors.New("Connection closed.")
 	}
-	bytes := make([]byte, 4096)
-	i, err := conn.Read(bytes)
+	header := make([]byte, 4)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > maxFrameSize {
+		if unframed(header) {
+			return nil, ErrUnframed
+		}
+		return nil, errors.New("Frame too large.")
+	}
+	bytes := make([]byte, size)
+	_, err = io.ReadFull(conn, bytes)
 	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return nil, err
 	}
 	msg := &pb.TestMessage{}
-	if err := proto.Unmarshal(bytes[0:i], msg); err != nil {
+	if err := proto.Unmarshal(bytes, msg); err != nil {
 		return nil, err
 	}
 	return msg, nil
 }
 
-func GenerateProtobuf(conn *net.TCPConn, userId int32) (*pb.TestMessage, error) {
+// Whether header, too large to be a frame's length, starts a bare protobuf
+// instead: its first byte is then a field's tag, and TestMessage's fields
+// are all varints or bytes
+func unframed(header []byte) bool {
+	field, wireType := header[0]>>3, header[0]&7
+	return field >= 1 && (wireType == 0 || wireType == 2)
+}
+
+// SendProtobuf writes msg as a single frame. A frame goes out in one Write,
+// so it is safe to call from several goroutines at once.
+func SendProtobuf(conn net.Conn, msg *pb.TestMessage) error {
 	if conn == nil {
-		return nil, errors.New("Connection closed.")
+		return errors.New("Connection closed.")
 	}
-	// Read info from user
-	bytes := make([]byte, 4096)
-	i, err := conn.Read(bytes)
+	frame, err := MarshalFrame(msg)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(frame)
+	return err
+}
+
+// MarshalFrame encodes msg with its length prefix
+func MarshalFrame(msg *pb.TestMessage) ([]byte, error) {
+	out, err := proto.Marshal(msg)
 	if err != nil {
 		return nil, err
 	}
+	frame := make([]byte, 4+len(out))
+	binary.BigEndian.PutUint32(frame, uint32(len(out)))
+	copy(frame[4:], out)
+	return frame, nil
+}
+
+// A Tap passes writes through to Writer, showing See what was written
+type Tap struct {
+	io.Writer
+	See func(p []byte)
+}
 
-	msg := &pb.TestMessage{
-		Type: pb.TestMessage_Data,
-		Data: bytes[0:i],
-		Id:   userId,
+func (t *Tap) Write(p []byte) (int, error) {
+	n, err := t.Writer.Write(p)
+	if n > 0 {
+		t.See(p[:n])
 	}
-	return msg, nil
+	return n, err
+}
+
+// Wait blocks until wg is done or ctx ends, whichever comes first
+func Wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ServiceUnavailable is the response HTTP users get while a tunnel can't
+// reach its protected server
+func ServiceUnavailable(reason string) []byte {
+	return ErrorResponse(http.StatusServiceUnavailable, reason)
+}
+
+// ErrorResponse is a complete HTTP response with the given status, after
+// which the connection is closed
+func ErrorResponse(status int, reason string) []byte {
+	text := http.StatusText(status)
+	body := text + ": " + reason + "\n"
+	return []byte("HTTP/1.1 " + strconv.Itoa(status) + " " + text + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"Connection: close\r\n" +
+		"\r\n" + body)
 }
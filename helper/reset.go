@@ -0,0 +1,61 @@
+package helper
+
+import (
+	"errors"
+	"fmt"
+	pb "github.com/andysctu/go-tunnel/protobuf"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// A ResetError is why one end of a tunnel reset a single user's stream
+type ResetError struct {
+	Code   pb.TestMessage_ResetCode
+	Reason string
+}
+
+func (e *ResetError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Reason)
+}
+
+// ResetMessage tells the other end to close only stream <id>, and why
+func ResetMessage(id int32, code pb.TestMessage_ResetCode, reason string) *pb.TestMessage {
+	return &pb.TestMessage{
+		Type: pb.TestMessage_Reset,
+		Data: []byte(reason),
+		Code: code,
+		Id:   id,
+	}
+}
+
+// ResetFrom returns the reset carried by msg
+func ResetFrom(msg *pb.TestMessage) *ResetError {
+	return &ResetError{Code: msg.Code, Reason: string(msg.Data)}
+}
+
+// DialResetCode classifies why dialing a protected server failed
+func DialResetCode(err error) pb.TestMessage_ResetCode {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return pb.TestMessage_DialRefused
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return pb.TestMessage_Timeout
+	}
+	return pb.TestMessage_Unknown
+}
+
+// ResetResponse is the error page HTTP users get when their stream is reset
+// before the protected server answered
+func ResetResponse(code pb.TestMessage_ResetCode, reason string) []byte {
+	switch code {
+	case pb.TestMessage_PolicyDenied:
+		return ErrorResponse(http.StatusForbidden, reason)
+	case pb.TestMessage_Timeout:
+		return ErrorResponse(http.StatusGatewayTimeout, reason)
+	case pb.TestMessage_ProtocolError:
+		return ErrorResponse(http.StatusBadGateway, reason)
+	}
+	return ServiceUnavailable(reason)
+}
@@ -0,0 +1,120 @@
+package helper
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	pb "github.com/andysctu/go-tunnel/protobuf"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS5 reply codes, RFC 1928
+const (
+	SOCKSSucceeded          = 0
+	SOCKSGeneralFailure     = 1
+	SOCKSNotAllowed         = 2
+	SOCKSHostUnreachable    = 4
+	SOCKSConnectionRefused  = 5
+	SOCKSCommandUnsupported = 7
+	SOCKSAddressUnsupported = 8
+)
+
+const (
+	socksVersion  = 5
+	socksNoAuth   = 0
+	socksNoMethod = 0xff
+	socksConnect  = 1
+	socksIPv4     = 1
+	socksDomain   = 3
+	socksIPv6     = 4
+)
+
+// ReadSOCKSRequest plays the server's part of a SOCKS5 handshake up to the
+// reply: it agrees to go on without logging in, then reads which host:port
+// the user wants to connect to. Users asking for anything else are answered
+// and an error is returned.
+func ReadSOCKSRequest(conn io.ReadWriter) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("Unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	offered := false
+	for _, method := range methods {
+		offered = offered || method == socksNoAuth
+	}
+	if !offered {
+		conn.Write([]byte{socksVersion, socksNoMethod})
+		return "", errors.New("SOCKS user wants to log in")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return "", err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	if request[1] != socksConnect {
+		conn.Write(SOCKSReply(SOCKSCommandUnsupported))
+		return "", fmt.Errorf("Unsupported SOCKS command %d", request[1])
+	}
+	var host string
+	switch request[3] {
+	case socksIPv4, socksIPv6:
+		ip := make([]byte, net.IPv4len)
+		if request[3] == socksIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		conn.Write(SOCKSReply(SOCKSAddressUnsupported))
+		return "", fmt.Errorf("Unsupported SOCKS address type %d", request[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// SOCKSReply answers a SOCKS5 connect request. The bound address is left
+// empty, as users of a tunnel have no use for it.
+func SOCKSReply(code byte) []byte {
+	return []byte{socksVersion, code, 0, socksIPv4, 0, 0, 0, 0, 0, 0}
+}
+
+// SOCKSResetReply is the reply SOCKS users get when their stream is reset
+// before the connection they asked for was made
+func SOCKSResetReply(code pb.TestMessage_ResetCode) []byte {
+	switch code {
+	case pb.TestMessage_PolicyDenied:
+		return SOCKSReply(SOCKSNotAllowed)
+	case pb.TestMessage_DialRefused:
+		return SOCKSReply(SOCKSConnectionRefused)
+	case pb.TestMessage_Timeout:
+		return SOCKSReply(SOCKSHostUnreachable)
+	}
+	return SOCKSReply(SOCKSGeneralFailure)
+}
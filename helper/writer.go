@@ -0,0 +1,185 @@
+package helper
+
+import (
+	"bufio"
+	"errors"
+	pb "github.com/andysctu/go-tunnel/protobuf"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Frames that may wait to be written before Send blocks
+	DefaultQueueSize = 256
+	// How long a write may take before the connection is given up on
+	DefaultWriteTimeout = 10 * time.Second
+)
+
+var ErrWriterClosed = errors.New("Writer closed.")
+
+// A FrameWriter is the only thing that writes to a control connection.
+// Messages from any number of goroutines are queued and written one frame
+// at a time by a single goroutine, so frames never interleave.
+//
+// Control messages jump ahead of queued data. A write that takes longer
+// than the write timeout fails the writer and closes the connection.
+type FrameWriter struct {
+	conn         net.Conn
+	writeTimeout time.Duration
+	control      chan []byte
+	data         chan []byte
+	closing      chan struct{}
+	done         chan struct{}
+	once         sync.Once
+
+	mu  sync.Mutex
+	err error
+}
+
+// NewFrameWriter starts writing to conn. queueSize and writeTimeout fall
+// back to DefaultQueueSize and DefaultWriteTimeout when zero.
+func NewFrameWriter(conn net.Conn, queueSize int, writeTimeout time.Duration) *FrameWriter {
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+	if writeTimeout <= 0 {
+		writeTimeout = DefaultWriteTimeout
+	}
+	w := &FrameWriter{
+		conn:         conn,
+		writeTimeout: writeTimeout,
+		control:      make(chan []byte, queueSize),
+		data:         make(chan []byte, queueSize),
+		closing:      make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Send queues msg, blocking while the queue is full. Returns an error if
+// the writer has failed or been closed.
+func (w *FrameWriter) Send(msg *pb.TestMessage) error {
+	frame, err := MarshalFrame(msg)
+	if err != nil {
+		return err
+	}
+	queue := w.data
+	if isControl(msg) {
+		queue = w.control
+	}
+	select {
+	case <-w.closing:
+		return ErrWriterClosed
+	case <-w.done:
+		return w.Err()
+	default:
+	}
+	select {
+	case queue <- frame:
+		return nil
+	case <-w.closing:
+		return ErrWriterClosed
+	case <-w.done:
+		return w.Err()
+	}
+}
+
+// Close writes any queued control messages, drops queued data and stops
+// the writer. It does not close the connection.
+func (w *FrameWriter) Close() error {
+	w.once.Do(func() {
+		close(w.closing)
+	})
+	<-w.done
+	err := w.Err()
+	if err == ErrWriterClosed {
+		return nil
+	}
+	return err
+}
+
+// Err returns why the writer stopped, or nil if it is still running
+func (w *FrameWriter) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Control messages are the ones about the whole tunnel or a new stream.
+// A stream's ConnectionClose or Reset waits behind the stream's data so it
+// can't cut the data short.
+func isControl(msg *pb.TestMessage) bool {
+	switch msg.Type {
+	case pb.TestMessage_Data:
+		return false
+	case pb.TestMessage_ConnectionClose, pb.TestMessage_Reset:
+		return msg.Id == -1
+	}
+	return true
+}
+
+func (w *FrameWriter) run() {
+	defer close(w.done)
+	buf := bufio.NewWriterSize(w.conn, 32*1024)
+	for {
+		select {
+		case <-w.closing:
+			w.stop(buf)
+			return
+		default:
+		}
+
+		var frame []byte
+		select {
+		case frame = <-w.control:
+		default:
+			select {
+			case frame = <-w.control:
+			case frame = <-w.data:
+			case <-w.closing:
+				w.stop(buf)
+				return
+			}
+		}
+
+		// Frames that are already waiting go out in the same write, which
+		// has to finish within the timeout
+		if buf.Buffered() == 0 {
+			w.conn.SetWriteDeadline(time.Now().Add(w.writeTimeout))
+		}
+		_, err := buf.Write(frame)
+		if err == nil && len(w.control) == 0 && len(w.data) == 0 {
+			err = buf.Flush()
+		}
+		if err != nil {
+			w.fail(err)
+			return
+		}
+	}
+}
+
+// Write what is buffered and the queued control messages, then stop
+func (w *FrameWriter) stop(buf *bufio.Writer) {
+	for len(w.control) > 0 {
+		buf.Write(<-w.control)
+	}
+	w.conn.SetWriteDeadline(time.Now().Add(w.writeTimeout))
+	err := buf.Flush()
+	if err != nil {
+		w.fail(err)
+		return
+	}
+	w.mu.Lock()
+	w.err = ErrWriterClosed
+	w.mu.Unlock()
+}
+
+// Give up on the connection, so its reader notices too
+func (w *FrameWriter) fail(err error) {
+	w.mu.Lock()
+	w.err = err
+	w.mu.Unlock()
+	w.conn.Close()
+}
@@ -0,0 +1,93 @@
+package helper
+
+import (
+	"bytes"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// DecodeYAML decodes a config file into v, rejecting unknown fields. The
+// returned node tree lets errors found afterwards point at their line.
+func DecodeYAML(data []byte, v interface{}) (*yaml.Node, error) {
+	root := &yaml.Node{}
+	err := yaml.Unmarshal(data, root)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err = decoder.Decode(v)
+	if err == io.EOF {
+		// Empty file
+		return root, nil
+	}
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		return nil, fmt.Errorf("%s", strings.Join(typeErr.Errors, "; "))
+	}
+	return root, err
+}
+
+// YAMLError describes a problem with the value at path, e.g. "allow",
+// "users", "1" for allow.users[1], giving its line in the file
+func YAMLError(root *yaml.Node, message string, path ...string) error {
+	name := ""
+	for _, elem := range path {
+		if _, err := strconv.Atoi(elem); err == nil {
+			name += "[" + elem + "]"
+		} else if name == "" {
+			name = elem
+		} else {
+			name += "." + elem
+		}
+	}
+	line := lineOf(root, path)
+	if line == 0 {
+		return fmt.Errorf("%s: %s", name, message)
+	}
+	return fmt.Errorf("line %d: %s: %s", line, name, message)
+}
+
+// The line of the value at path. A missing value is blamed on the line
+// of whatever should hold it.
+func lineOf(node *yaml.Node, path []string) int {
+	if node == nil {
+		return 0
+	}
+	if node.Kind == yaml.DocumentNode {
+		if len(node.Content) == 0 {
+			return 0
+		}
+		node = node.Content[0]
+	}
+	line := node.Line
+	for _, elem := range path {
+		var next *yaml.Node
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == elem {
+					// Keys and their values usually share a line, but
+					// nested mappings start on the next one
+					line = node.Content[i].Line
+					next = node.Content[i+1]
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			i, err := strconv.Atoi(elem)
+			if err == nil && i >= 0 && i < len(node.Content) {
+				next = node.Content[i]
+				line = next.Line
+			}
+		}
+		if next == nil {
+			return line
+		}
+		node = next
+	}
+	return line
+}
@@ -0,0 +1,405 @@
+package inspector
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxBodySize  = 64 * 1024
+	defaultMaxExchanges = 100
+	streamBuffer        = 256
+)
+
+// An Exchange is one HTTP request seen going through the tunnel and,
+// once it arrives, the response the protected server sent back
+type Exchange struct {
+	ID                int           `json:"id"`
+	Session           int           `json:"session,omitempty"`
+	StreamID          int32         `json:"stream_id"`
+	Start             time.Time     `json:"start"`
+	Duration          time.Duration `json:"duration"`
+	Method            string        `json:"method"`
+	URL               string        `json:"url"`
+	Proto             string        `json:"proto"`
+	Host              string        `json:"host"`
+	RequestHeader     http.Header   `json:"request_header"`
+	RequestBody       []byte        `json:"request_body"`
+	RequestTruncated  bool          `json:"request_truncated"`
+	Status            int           `json:"status"`
+	ResponseHeader    http.Header   `json:"response_header"`
+	ResponseBody      []byte        `json:"response_body"`
+	ResponseTruncated bool          `json:"response_truncated"`
+	Replayed          bool          `json:"replayed"`
+	Complete          bool          `json:"complete"`
+}
+
+// Inspector watches the bytes of each tunneled stream and records the
+// HTTP/1.1 exchanges it recognizes. Streams that don't parse as HTTP are
+// silently ignored, and a slow inspector never blocks the tunnel.
+type Inspector struct {
+	Target       string      // Address of the protected server, used for replays
+	TargetTLS    *tls.Config // Optional, replay over TLS to a protected server that only speaks HTTPS
+	MaxBodySize  int
+	MaxExchanges int
+
+	addr string // Where ListenAndServe serves the UI
+
+	mu        sync.Mutex
+	exchanges []*Exchange
+	streams   map[streamKey]*stream
+	sessions  int
+	nextID    int
+}
+
+// A Session inspects streams whose ids are unique within it, like those of
+// one tunnel. Ids restart on every tunnel, so without sessions the streams
+// of an old tunnel and its replacement would be parsed as one.
+type Session struct {
+	i  *Inspector
+	id int
+}
+
+type streamKey struct {
+	session int
+	id      int32
+}
+
+type stream struct {
+	key      streamKey
+	requests chan []byte
+	replies  chan []byte
+	pending  chan *pendingExchange
+	once     sync.Once
+	done     chan struct{}
+}
+
+type pendingExchange struct {
+	exchange *Exchange
+	method   string
+}
+
+func New(target string) *Inspector {
+	return &Inspector{
+		Target:       target,
+		MaxBodySize:  defaultMaxBodySize,
+		MaxExchanges: defaultMaxExchanges,
+		streams:      make(map[streamKey]*stream),
+	}
+}
+
+// Session starts a new session, for ids that may repeat those of other
+// sessions
+func (i *Inspector) Session() *Session {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.sessions++
+	return &Session{i: i, id: i.sessions}
+}
+
+// Request records bytes sent by the user on stream <id>, for ids that are
+// unique for as long as the inspector runs
+func (i *Inspector) Request(id int32, data []byte) {
+	i.request(streamKey{id: id}, data)
+}
+
+// Response records bytes sent back by the protected server on stream <id>
+func (i *Inspector) Response(id int32, data []byte) {
+	i.response(streamKey{id: id}, data)
+}
+
+// Close stops inspecting stream <id>
+func (i *Inspector) Close(id int32) {
+	i.close(streamKey{id: id})
+}
+
+// Request records bytes sent by the user on stream <id> of the session
+func (s *Session) Request(id int32, data []byte) {
+	s.i.request(streamKey{session: s.id, id: id}, data)
+}
+
+// Response records bytes sent back by the protected server on stream <id>
+// of the session
+func (s *Session) Response(id int32, data []byte) {
+	s.i.response(streamKey{session: s.id, id: id}, data)
+}
+
+// Close stops inspecting stream <id> of the session
+func (s *Session) Close(id int32) {
+	s.i.close(streamKey{session: s.id, id: id})
+}
+
+func (i *Inspector) request(key streamKey, data []byte) {
+	s := i.stream(key)
+	if s != nil {
+		s.feed(s.requests, data)
+	}
+}
+
+func (i *Inspector) response(key streamKey, data []byte) {
+	s := i.stream(key)
+	if s != nil {
+		s.feed(s.replies, data)
+	}
+}
+
+func (i *Inspector) close(key streamKey) {
+	i.mu.Lock()
+	s, ok := i.streams[key]
+	delete(i.streams, key)
+	i.mu.Unlock()
+	if ok {
+		s.stop()
+	}
+}
+
+// Exchanges returns the recorded exchanges, most recent first
+func (i *Inspector) Exchanges() []Exchange {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	list := make([]Exchange, 0, len(i.exchanges))
+	for j := len(i.exchanges) - 1; j >= 0; j-- {
+		list = append(list, *i.exchanges[j])
+	}
+	return list
+}
+
+// Exchange returns the recorded exchange with the given ID
+func (i *Inspector) Exchange(id int) (Exchange, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for _, ex := range i.exchanges {
+		if ex.ID == id {
+			return *ex, true
+		}
+	}
+	return Exchange{}, false
+}
+
+// Replay sends a captured request directly to the protected server and
+// records the result as a new exchange
+func (i *Inspector) Replay(id int) (Exchange, error) {
+	original, ok := i.Exchange(id)
+	if !ok {
+		return Exchange{}, errors.New("No such exchange: " + strconv.Itoa(id))
+	}
+	if original.RequestTruncated {
+		return Exchange{}, errors.New("Request body was truncated and cannot be replayed")
+	}
+
+	scheme := "http://"
+	if i.TargetTLS != nil {
+		scheme = "https://"
+	}
+	req, err := http.NewRequest(original.Method, scheme+i.Target+original.URL, bytes.NewReader(original.RequestBody))
+	if err != nil {
+		return Exchange{}, err
+	}
+	for key, values := range original.RequestHeader {
+		req.Header[key] = values
+	}
+	req.Host = original.Host
+
+	ex := &Exchange{
+		StreamID:      -1,
+		Start:         time.Now(),
+		Method:        original.Method,
+		URL:           original.URL,
+		Proto:         req.Proto,
+		Host:          original.Host,
+		RequestHeader: req.Header,
+		RequestBody:   original.RequestBody,
+		Replayed:      true,
+	}
+
+	transport := &http.Transport{TLSClientConfig: i.TargetTLS, DisableKeepAlives: true}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return Exchange{}, err
+	}
+	defer resp.Body.Close()
+
+	i.fillResponse(ex, resp)
+	i.add(ex)
+	return *ex, nil
+}
+
+func (i *Inspector) stream(key streamKey) *stream {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	s, ok := i.streams[key]
+	if !ok {
+		s = &stream{
+			key:      key,
+			requests: make(chan []byte, streamBuffer),
+			replies:  make(chan []byte, streamBuffer),
+			pending:  make(chan *pendingExchange, streamBuffer),
+			done:     make(chan struct{}),
+		}
+		i.streams[key] = s
+		go i.parseRequests(s)
+		go i.parseResponses(s)
+	}
+	return s
+}
+
+func (i *Inspector) add(ex *Exchange) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.nextID++
+	ex.ID = i.nextID
+	i.exchanges = append(i.exchanges, ex)
+	if len(i.exchanges) > i.MaxExchanges {
+		i.exchanges = i.exchanges[len(i.exchanges)-i.MaxExchanges:]
+	}
+}
+
+func (i *Inspector) parseRequests(s *stream) {
+	reader := bufio.NewReader(&chanReader{ch: s.requests, done: s.done})
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Inspector: stream <%d> is not HTTP, ignoring it\n", s.key.id)
+			}
+			s.stop()
+			return
+		}
+
+		ex := &Exchange{
+			Session:       s.key.session,
+			StreamID:      s.key.id,
+			Start:         time.Now(),
+			Method:        req.Method,
+			URL:           req.RequestURI,
+			Proto:         req.Proto,
+			Host:          req.Host,
+			RequestHeader: req.Header,
+		}
+		ex.RequestBody, ex.RequestTruncated = readBody(req.Body, i.MaxBodySize)
+		i.add(ex)
+
+		select {
+		case s.pending <- &pendingExchange{exchange: ex, method: req.Method}:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (i *Inspector) parseResponses(s *stream) {
+	reader := bufio.NewReader(&chanReader{ch: s.replies, done: s.done})
+	for {
+		var p *pendingExchange
+		select {
+		case p = <-s.pending:
+		default:
+			select {
+			case p = <-s.pending:
+			case <-s.done:
+				return
+			}
+		}
+
+		for {
+			resp, err := http.ReadResponse(reader, &http.Request{Method: p.method})
+			if err != nil {
+				s.stop()
+				return
+			}
+			// Skip informational responses such as 100 Continue
+			if resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+				continue
+			}
+			i.fillResponse(p.exchange, resp)
+			if resp.StatusCode == http.StatusSwitchingProtocols {
+				// Whatever follows is no longer HTTP
+				s.stop()
+				return
+			}
+			break
+		}
+	}
+}
+
+func (i *Inspector) fillResponse(ex *Exchange, resp *http.Response) {
+	body, truncated := readBody(resp.Body, i.MaxBodySize)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	ex.Duration = time.Since(ex.Start)
+	ex.Status = resp.StatusCode
+	ex.ResponseHeader = resp.Header
+	ex.ResponseBody = body
+	ex.ResponseTruncated = truncated
+	ex.Complete = true
+}
+
+// Queue a copy of data for the parser without ever blocking the tunnel.
+// If the parser falls behind, inspection of the stream is abandoned.
+func (s *stream) feed(ch chan []byte, data []byte) {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	select {
+	case ch <- buf:
+	default:
+		log.Printf("Inspector: falling behind on stream <%d>, ignoring it\n", s.key.id)
+		s.stop()
+	}
+}
+
+func (s *stream) stop() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+// Reads the whole body so the stream stays in sync, keeping at most max bytes
+func readBody(body io.ReadCloser, max int) ([]byte, bool) {
+	defer body.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(body, int64(max)))
+	n, _ := io.Copy(ioutil.Discard, body)
+	return data, n > 0
+}
+
+// chanReader turns the chunks fed to a stream back into an io.Reader
+type chanReader struct {
+	ch   chan []byte
+	done chan struct{}
+	buf  []byte
+}
+
+func (r *chanReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		// Drain whatever was queued before the stream was stopped
+		select {
+		case chunk := <-r.ch:
+			r.buf = chunk
+			continue
+		default:
+		}
+		select {
+		case chunk := <-r.ch:
+			r.buf = chunk
+		case <-r.done:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,163 @@
+package inspector
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ListenAndServe runs the inspector web UI on addr
+func (i *Inspector) ListenAndServe(addr string) error {
+	log.Printf("Inspector running on: http://%s\n", addr)
+	i.addr = addr
+	return http.ListenAndServe(addr, i)
+}
+
+// ServeHTTP serves the inspector UI and its JSON API:
+//
+//	GET  /                          list of recent exchanges
+//	GET  /api/requests              recent exchanges as JSON
+//	GET  /api/requests/<id>         one exchange as JSON
+//	POST /api/requests/<id>/replay  replay a captured request
+//
+// Only the UI's own pages may use it, see allowed.
+func (i *Inspector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !i.allowed(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case path == "":
+		i.serveIndex(w, r)
+	case path == "api/requests":
+		writeJSON(w, http.StatusOK, i.Exchanges())
+	case len(parts) == 3 && parts[0] == "api" && parts[1] == "requests":
+		id, err := strconv.Atoi(parts[2])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		ex, ok := i.Exchange(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, ex)
+	case len(parts) == 4 && parts[0] == "api" && parts[1] == "requests" && parts[3] == "replay":
+		if r.Method != "POST" {
+			http.Error(w, "Replay requires POST", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.Atoi(parts[2])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		ex, err := i.Replay(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		// Plain form posts from the UI go back to the list
+		if r.Header.Get("Accept") == "application/json" {
+			writeJSON(w, http.StatusOK, ex)
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Whether r comes from the UI itself rather than another site in the
+// user's browser. A Host other than the inspector's address, localhost or
+// a loopback IP means a name was rebound to get past the same-origin
+// policy, and a POST from another origin is a cross-site replay.
+func (i *Inspector) allowed(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = strings.Trim(r.Host, "[]")
+	}
+	ip := net.ParseIP(host)
+	if r.Host != i.addr && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return false
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		origin, err := url.Parse(r.Header.Get("Origin"))
+		if err != nil || origin.Host != r.Host {
+			return false
+		}
+	}
+	return true
+}
+
+func (i *Inspector) serveIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := indexTemplate.Execute(w, i.Exchanges())
+	if err != nil {
+		log.Printf("Inspector: error rendering UI: %s\n", err.Error())
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("Inspector: error encoding response: %s\n", err.Error())
+	}
+}
+
+var indexTemplate = template.Must(template.New("index").Funcs(template.FuncMap{
+	"str": func(b []byte) string { return string(b) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>rps inspector</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+details { border-bottom: 1px solid #ddd; padding: 0.5em 0; }
+summary { cursor: pointer; font-family: monospace; }
+pre { background: #f5f5f5; padding: 0.5em; overflow-x: auto; }
+.replayed { color: #888; }
+</style>
+</head>
+<body>
+<h1>Tunnel traffic</h1>
+{{if not .}}<p>No HTTP requests yet.</p>{{end}}
+{{range .}}
+<details>
+<summary{{if .Replayed}} class="replayed"{{end}}>
+#{{.ID}} {{.Start.Format "15:04:05.000"}} {{.Method}} {{.URL}} &rarr;
+{{if .Complete}}{{.Status}} in {{.Duration}}{{else}}pending{{end}}
+{{if .Replayed}}(replay){{end}}
+</summary>
+<h3>Request</h3>
+<pre>{{.Method}} {{.URL}} {{.Proto}}
+Host: {{.Host}}
+{{range $key, $values := .RequestHeader}}{{range $values}}{{$key}}: {{.}}
+{{end}}{{end}}
+{{str .RequestBody}}{{if .RequestTruncated}}
+[truncated]{{end}}</pre>
+{{if .Complete}}
+<h3>Response</h3>
+<pre>{{.Status}}
+{{range $key, $values := .ResponseHeader}}{{range $values}}{{$key}}: {{.}}
+{{end}}{{end}}
+{{str .ResponseBody}}{{if .ResponseTruncated}}
+[truncated]{{end}}</pre>
+{{end}}
+<form method="POST" action="/api/requests/{{.ID}}/replay"><button type="submit">Replay</button></form>
+</details>
+{{end}}
+</body>
+</html>
+`))
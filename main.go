@@ -1,10 +1,18 @@
 package main
 
 import (
+	"context"
+	"github.com/andysctu/go-tunnel/recorder"
 	. "github.com/andysctu/go-tunnel/server"
+	"github.com/andysctu/go-tunnel/webhook"
+	"io"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 )
 
 // Start rps server
@@ -15,7 +23,7 @@ func main() {
 		ip.IP = nil
 	} else {
 		var err error
-		ip, err = net.ResolveIPAddr("ip4", os.Args[1])
+		ip, err = net.ResolveIPAddr("ip", os.Args[1])
 		if err != nil {
 			log.Printf("Invalid Host IP: %s\n", os.Args[1])
 			return
@@ -23,10 +31,153 @@ func main() {
 	}
 
 	server := GoRpsServer{}
+
+	// Optionally configure the server from a file, reloaded on SIGHUP
+	configPath := os.Getenv("RPS_CONFIG")
+	if configPath != "" {
+		cfg, err := LoadConfig(configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = openLog(cfg.Log.File)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.Configure(cfg)
+		log.Printf("Loaded config: %s\n", configPath)
+	}
+
+	// The host IP argument is where clients connect, unless the config
+	// says otherwise. Users can be exposed on another interface.
+	if server.Addr == "" && ip.IP != nil {
+		port := "34567"
+		if os.Getenv("PORT") != "" {
+			port = os.Getenv("PORT")
+		}
+		server.Addr = net.JoinHostPort(ip.IP.String(), port)
+	}
+	// Clients that can only get out over HTTP connect with a WebSocket
+	if os.Getenv("RPS_WEBSOCKET_ADDR") != "" {
+		server.WebSocketAddr = os.Getenv("RPS_WEBSOCKET_ADDR")
+	}
+	if os.Getenv("RPS_WEBSOCKET_PATH") != "" {
+		server.WebSocketPath = os.Getenv("RPS_WEBSOCKET_PATH")
+	}
+	// Teammates without rps_cli open tunnels with ssh -R
+	if os.Getenv("RPS_SSH_ADDR") != "" {
+		server.SSHAddr = os.Getenv("RPS_SSH_ADDR")
+	}
+	if os.Getenv("RPS_SSH_HOST_KEY") != "" {
+		hostKey, err := LoadSSHHostKey(os.Getenv("RPS_SSH_HOST_KEY"))
+		if err != nil {
+			log.Fatalf("Invalid RPS_SSH_HOST_KEY: %s\n", err.Error())
+		}
+		server.SSHHostKey = hostKey
+	}
+	if os.Getenv("RPS_USER_ADDR") != "" {
+		server.UserAddr = os.Getenv("RPS_USER_ADDR")
+	}
+	if os.Getenv("RPS_PORT_RANGE") != "" {
+		portRange, err := ParsePortRange(os.Getenv("RPS_PORT_RANGE"))
+		if err != nil {
+			log.Fatalf("Invalid RPS_PORT_RANGE: %s\n", os.Getenv("RPS_PORT_RANGE"))
+		}
+		server.PortRange = portRange
+	}
+
+	// Optionally record every user stream to a capture file
+	if os.Getenv("RPS_CAPTURE_FILE") != "" {
+		rec, err := recorder.New(os.Getenv("RPS_CAPTURE_FILE"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if os.Getenv("RPS_CAPTURE_MAX_SIZE") != "" {
+			rec.MaxSize, err = strconv.ParseInt(os.Getenv("RPS_CAPTURE_MAX_SIZE"), 10, 64)
+			if err != nil {
+				log.Fatalf("Invalid RPS_CAPTURE_MAX_SIZE: %s\n", os.Getenv("RPS_CAPTURE_MAX_SIZE"))
+			}
+		}
+		server.Recorder = rec
+		log.Printf("Recording user streams to: %s\n", rec.Path)
+	}
+
+	// Optionally POST lifecycle events to a webhook
+	if os.Getenv("RPS_WEBHOOK_URL") != "" {
+		server.Webhook = webhook.New(os.Getenv("RPS_WEBHOOK_URL"), os.Getenv("RPS_WEBHOOK_SECRET"))
+		server.Webhook.PublicHost = os.Getenv("RPS_PUBLIC_HOST")
+		log.Printf("Sending events to: %s\n", server.Webhook.URL)
+	}
+
 	serverTCPAddr, err := server.Start()
 	if err != nil {
 		log.Fatal(err)
 	}
 	log.Printf("Server running on: %s\n", serverTCPAddr.String())
-	select {}
+
+	// On SIGTERM, let connected users finish before exiting
+	drainTimeout := 30 * time.Second
+	if os.Getenv("RPS_DRAIN_TIMEOUT") != "" {
+		drainTimeout, err = time.ParseDuration(os.Getenv("RPS_DRAIN_TIMEOUT"))
+		if err != nil {
+			log.Fatalf("Invalid RPS_DRAIN_TIMEOUT: %s\n", os.Getenv("RPS_DRAIN_TIMEOUT"))
+		}
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signals {
+		if sig == syscall.SIGTERM {
+			break
+		}
+		if configPath == "" {
+			continue
+		}
+
+		// Keep the running config if the new one is invalid
+		cfg, err := LoadConfig(configPath)
+		if err != nil {
+			log.Printf("Error reloading config: %s\n", err.Error())
+			continue
+		}
+		err = openLog(cfg.Log.File)
+		if err != nil {
+			log.Printf("Error reopening log: %s\n", err.Error())
+		}
+		server.Reload(cfg)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	err = server.Drain(ctx)
+	if err != nil {
+		log.Printf("Error draining server: %s\n", err.Error())
+	}
+	if server.Webhook != nil {
+		// Deliver the events of the tunnels and users drain just closed
+		server.Webhook.Close()
+	}
+	log.Printf("Server drained\n")
+}
+
+// The file currently logged to, closed when the log is reopened
+var logFile *os.File
+
+// Log to path, or to stderr if it is empty. Reopening the same path picks up
+// a file that was rotated away.
+func openLog(path string) error {
+	var output io.Writer = os.Stderr
+	var file *os.File
+	if path != "" {
+		var err error
+		file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		output = file
+	}
+	log.SetOutput(output)
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = file
+	return nil
 }
@@ -32,17 +32,26 @@ const (
 	TestMessage_ConnectionOpen  TestMessage_EventType = 0
 	TestMessage_ConnectionClose TestMessage_EventType = 1
 	TestMessage_Data            TestMessage_EventType = 2
+	TestMessage_Drain           TestMessage_EventType = 3
+	TestMessage_Health          TestMessage_EventType = 4
+	TestMessage_Reset           TestMessage_EventType = 5
 )
 
 var TestMessage_EventType_name = map[int32]string{
 	0: "ConnectionOpen",
 	1: "ConnectionClose",
 	2: "Data",
+	3: "Drain",
+	4: "Health",
+	5: "Reset",
 }
 var TestMessage_EventType_value = map[string]int32{
 	"ConnectionOpen":  0,
 	"ConnectionClose": 1,
 	"Data":            2,
+	"Drain":           3,
+	"Health":          4,
+	"Reset":           5,
 }
 
 func (x TestMessage_EventType) String() string {
@@ -50,10 +59,49 @@ func (x TestMessage_EventType) String() string {
 }
 func (TestMessage_EventType) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{0, 0} }
 
+type TestMessage_ResetCode int32
+
+const (
+	TestMessage_Unknown       TestMessage_ResetCode = 0
+	TestMessage_DialRefused   TestMessage_ResetCode = 1
+	TestMessage_Timeout       TestMessage_ResetCode = 2
+	TestMessage_PolicyDenied  TestMessage_ResetCode = 3
+	TestMessage_ProtocolError TestMessage_ResetCode = 4
+)
+
+var TestMessage_ResetCode_name = map[int32]string{
+	0: "Unknown",
+	1: "DialRefused",
+	2: "Timeout",
+	3: "PolicyDenied",
+	4: "ProtocolError",
+}
+var TestMessage_ResetCode_value = map[string]int32{
+	"Unknown":       0,
+	"DialRefused":   1,
+	"Timeout":       2,
+	"PolicyDenied":  3,
+	"ProtocolError": 4,
+}
+
+func (x TestMessage_ResetCode) String() string {
+	return proto.EnumName(TestMessage_ResetCode_name, int32(x))
+}
+func (TestMessage_ResetCode) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{0, 1} }
+
 type TestMessage struct {
-	Id   int32                 `protobuf:"varint,1,opt,name=id" json:"id,omitempty"`
-	Data []byte                `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
-	Type TestMessage_EventType `protobuf:"varint,3,opt,name=type,enum=protobuf.TestMessage_EventType" json:"type,omitempty"`
+	Id        int32                 `protobuf:"varint,1,opt,name=id" json:"id,omitempty"`
+	Data      []byte                `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	Type      TestMessage_EventType `protobuf:"varint,3,opt,name=type,enum=protobuf.TestMessage_EventType" json:"type,omitempty"`
+	Token     string                `protobuf:"bytes,4,opt,name=token" json:"token,omitempty"`
+	Group     string                `protobuf:"bytes,5,opt,name=group" json:"group,omitempty"`
+	Protocol  string                `protobuf:"bytes,6,opt,name=protocol" json:"protocol,omitempty"`
+	Code      TestMessage_ResetCode `protobuf:"varint,7,opt,name=code,enum=protobuf.TestMessage_ResetCode" json:"code,omitempty"`
+	Transport string                `protobuf:"bytes,8,opt,name=transport" json:"transport,omitempty"`
+	Private   string                `protobuf:"bytes,9,opt,name=private" json:"private,omitempty"`
+	Secret    string                `protobuf:"bytes,10,opt,name=secret" json:"secret,omitempty"`
+	Visit     string                `protobuf:"bytes,11,opt,name=visit" json:"visit,omitempty"`
+	Target    string                `protobuf:"bytes,12,opt,name=target" json:"target,omitempty"`
 }
 
 func (m *TestMessage) Reset()                    { *m = TestMessage{} }
@@ -64,19 +112,32 @@ func (*TestMessage) Descriptor() ([]byte, []int) { return fileDescriptor0, []int
 func init() {
 	proto.RegisterType((*TestMessage)(nil), "protobuf.TestMessage")
 	proto.RegisterEnum("protobuf.TestMessage_EventType", TestMessage_EventType_name, TestMessage_EventType_value)
+	proto.RegisterEnum("protobuf.TestMessage_ResetCode", TestMessage_ResetCode_name, TestMessage_ResetCode_value)
 }
 
 var fileDescriptor0 = []byte{
-	// 172 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xe2, 0x12, 0x0c, 0x49, 0x2d, 0x2e,
-	0xf1, 0x4d, 0x2d, 0x2e, 0x4e, 0x4c, 0x4f, 0xd5, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0xe2, 0x00,
-	0x53, 0x49, 0xa5, 0x69, 0x4a, 0xcb, 0x18, 0xb9, 0xb8, 0x91, 0xe4, 0x85, 0xf8, 0xb8, 0x98, 0x32,
-	0x53, 0x24, 0x18, 0x15, 0x18, 0x35, 0x58, 0x83, 0x80, 0x2c, 0x21, 0x21, 0x2e, 0x96, 0x94, 0xc4,
-	0x92, 0x44, 0x09, 0x26, 0xa0, 0x08, 0x4f, 0x10, 0x98, 0x2d, 0x64, 0xcc, 0xc5, 0x52, 0x52, 0x59,
-	0x90, 0x2a, 0xc1, 0x0c, 0x14, 0xe3, 0x33, 0x92, 0xd7, 0x83, 0x19, 0xa6, 0x87, 0x6c, 0x91, 0x6b,
-	0x59, 0x6a, 0x5e, 0x49, 0x08, 0x50, 0x59, 0x10, 0x58, 0xb1, 0x92, 0x1d, 0x17, 0x27, 0x5c, 0x08,
-	0x68, 0x2a, 0x9f, 0x73, 0x7e, 0x5e, 0x5e, 0x6a, 0x72, 0x49, 0x66, 0x7e, 0x9e, 0x7f, 0x41, 0x6a,
-	0x9e, 0x00, 0x83, 0x90, 0x30, 0x17, 0x3f, 0x42, 0xcc, 0x39, 0x27, 0xbf, 0x38, 0x55, 0x80, 0x51,
-	0x88, 0x83, 0x8b, 0xc5, 0x05, 0x68, 0xa5, 0x00, 0x53, 0x12, 0x1b, 0xd8, 0x16, 0x63, 0x40, 0x00,
-	0x00, 0x00, 0xff, 0xff, 0xa0, 0x52, 0xa0, 0x3f, 0xce, 0x00, 0x00, 0x00,
+	// 366 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7d, 0x50, 0x4d, 0x4f, 0xc2, 0x30,
+	0x18, 0x16, 0xd8, 0x06, 0x7b, 0x87, 0x30, 0xaa, 0x31, 0x8d, 0x31, 0xd1, 0x70, 0xf2, 0xc4, 0x41,
+	0x7e, 0x02, 0x23, 0xf1, 0x62, 0x24, 0x0b, 0x9e, 0xbc, 0x58, 0xb6, 0x17, 0x6c, 0x98, 0xed, 0xd2,
+	0x76, 0x18, 0xfe, 0x8d, 0x3f, 0xd5, 0xae, 0x43, 0xe0, 0xe4, 0xa9, 0x7d, 0x3e, 0xfa, 0xbc, 0x6f,
+	0x1f, 0x18, 0x2d, 0x51, 0x9b, 0x17, 0xd4, 0x9a, 0x6d, 0x70, 0x52, 0x2a, 0x69, 0x24, 0xe9, 0xb9,
+	0x63, 0x55, 0xad, 0xc7, 0x3f, 0x1e, 0x44, 0x67, 0x3a, 0x19, 0x40, 0x9b, 0xe7, 0xb4, 0xf5, 0xd0,
+	0x7a, 0xf4, 0x53, 0x7b, 0x23, 0x04, 0xbc, 0x9c, 0x19, 0x46, 0xdb, 0x96, 0xe9, 0xa7, 0xee, 0x4e,
+	0xa6, 0xe0, 0x99, 0x7d, 0x89, 0xb4, 0x63, 0xb9, 0xc1, 0xd3, 0xfd, 0xe4, 0x2f, 0x6c, 0x72, 0x3e,
+	0x68, 0xbe, 0x43, 0x61, 0x96, 0xd6, 0x96, 0x3a, 0x33, 0xb9, 0x06, 0xdf, 0xc8, 0x2d, 0x0a, 0xea,
+	0xd9, 0x57, 0x61, 0xda, 0x80, 0x9a, 0xdd, 0x28, 0x59, 0x95, 0xd4, 0x6f, 0x58, 0x07, 0xc8, 0x2d,
+	0x34, 0x0b, 0x66, 0xb2, 0xa0, 0x81, 0x13, 0x8e, 0xb8, 0x1e, 0x9e, 0xc9, 0x1c, 0x69, 0xf7, 0xbf,
+	0xe1, 0x29, 0x6a, 0x34, 0x33, 0x6b, 0x4b, 0x9d, 0x99, 0xdc, 0x41, 0x68, 0x14, 0x13, 0xba, 0x94,
+	0xca, 0xd0, 0x9e, 0x4b, 0x3c, 0x11, 0x84, 0x42, 0xb7, 0x54, 0x7c, 0xc7, 0x0c, 0xd2, 0xd0, 0x69,
+	0x7f, 0x90, 0xdc, 0x40, 0xa0, 0x31, 0x53, 0x68, 0x28, 0x38, 0xe1, 0x80, 0xea, 0xb5, 0x77, 0x5c,
+	0x73, 0x43, 0xa3, 0x66, 0x6d, 0x07, 0x6a, 0xb7, 0x61, 0x6a, 0x63, 0xdd, 0xfd, 0xc6, 0xdd, 0xa0,
+	0xf1, 0x07, 0x84, 0xc7, 0x36, 0x6c, 0xa1, 0x83, 0x99, 0x14, 0x02, 0x33, 0xc3, 0xa5, 0x78, 0x2d,
+	0x51, 0xc4, 0x17, 0xe4, 0x0a, 0x86, 0x27, 0x6e, 0x56, 0x48, 0x8d, 0x71, 0x8b, 0xf4, 0xc0, 0x4b,
+	0x6c, 0xdb, 0x71, 0x9b, 0x84, 0xe0, 0x27, 0x8a, 0x71, 0x11, 0x77, 0x08, 0x40, 0xf0, 0x8c, 0xac,
+	0x30, 0x9f, 0xb1, 0x57, 0xd3, 0xee, 0x9f, 0xb1, 0x3f, 0x7e, 0x87, 0xf0, 0xf8, 0x65, 0x12, 0x41,
+	0xf7, 0x4d, 0x6c, 0x85, 0xfc, 0xae, 0xa3, 0x87, 0x10, 0x25, 0x9c, 0x15, 0x29, 0xae, 0x2b, 0x8d,
+	0xb9, 0x8d, 0xb5, 0xea, 0x92, 0x7f, 0xa1, 0xac, 0x8c, 0x4d, 0x8e, 0xa1, 0xbf, 0x90, 0x05, 0xcf,
+	0xf6, 0x09, 0x0a, 0x6e, 0xe5, 0x0e, 0x19, 0xc1, 0xe5, 0xe2, 0x50, 0xf5, 0x5c, 0x29, 0xa9, 0x62,
+	0x6f, 0x15, 0xb8, 0x8a, 0xa7, 0xbf, 0x79, 0x6b, 0x96, 0x35, 0x48, 0x02, 0x00, 0x00,
 }
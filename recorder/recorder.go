@@ -0,0 +1,208 @@
+package recorder
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxSize    = 64 * 1024 * 1024
+	defaultMaxBackups = 5
+)
+
+type Direction string
+
+const (
+	// Bytes travelling from the user towards the protected server
+	Inbound Direction = "in"
+	// Bytes travelling from the protected server back to the user
+	Outbound Direction = "out"
+)
+
+type Event string
+
+const (
+	StreamOpen  Event = "open"
+	StreamClose Event = "close"
+	StreamData  Event = "data"
+)
+
+// A Record is one line of a capture file. Stream ids are only unique within
+// a session, see Session.
+type Record struct {
+	Time      time.Time `json:"time"`
+	Session   string    `json:"session,omitempty"`
+	Stream    int32     `json:"stream"`
+	Event     Event     `json:"event"`
+	Direction Direction `json:"dir,omitempty"`
+	Data      []byte    `json:"data,omitempty"`
+}
+
+// Recorder appends the bytes of every tunneled stream to a capture file,
+// one JSON record per line. Once the file grows past MaxSize it is rotated
+// to <path>.1, <path>.2, ... keeping at most MaxBackups old files.
+type Recorder struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	name     string // Unique to this recorder, so files it appends to can be shared
+	sessions int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// A Session records streams whose ids are unique within it, like those of
+// one tunnel. Ids restart on every tunnel, so without sessions the streams
+// of a capture spanning a reconnect would run together.
+type Session struct {
+	r    *Recorder
+	name string
+}
+
+func New(path string) (*Recorder, error) {
+	name := make([]byte, 4)
+	_, err := rand.Read(name)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{
+		Path:       path,
+		MaxSize:    defaultMaxSize,
+		MaxBackups: defaultMaxBackups,
+		name:       hex.EncodeToString(name),
+	}
+	err = r.open()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Session starts a new session, for ids that may repeat those of other
+// sessions
+func (r *Recorder) Session() *Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions++
+	return &Session{r: r, name: fmt.Sprintf("%s-%d", r.name, r.sessions)}
+}
+
+// Opened records that stream <id> has started, for ids that are unique
+// for as long as the recorder is open
+func (r *Recorder) Opened(id int32) {
+	r.write(&Record{Time: time.Now(), Session: r.name, Stream: id, Event: StreamOpen})
+}
+
+// Data records bytes sent on stream <id> in the given direction
+func (r *Recorder) Data(id int32, dir Direction, data []byte) {
+	r.write(&Record{Time: time.Now(), Session: r.name, Stream: id, Event: StreamData, Direction: dir, Data: data})
+}
+
+// Closed records that stream <id> has ended
+func (r *Recorder) Closed(id int32) {
+	r.write(&Record{Time: time.Now(), Session: r.name, Stream: id, Event: StreamClose})
+}
+
+// Opened records that stream <id> of the session has started
+func (s *Session) Opened(id int32) {
+	s.r.write(&Record{Time: time.Now(), Session: s.name, Stream: id, Event: StreamOpen})
+}
+
+// Data records bytes sent on stream <id> of the session in the given
+// direction
+func (s *Session) Data(id int32, dir Direction, data []byte) {
+	s.r.write(&Record{Time: time.Now(), Session: s.name, Stream: id, Event: StreamData, Direction: dir, Data: data})
+}
+
+// Closed records that stream <id> of the session has ended
+func (s *Session) Closed(id int32) {
+	s.r.write(&Record{Time: time.Now(), Session: s.name, Stream: id, Event: StreamClose})
+}
+
+// Close flushes and closes the capture file
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func (r *Recorder) write(record *Record) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Recorder: error encoding record: %s\n", err.Error())
+		return
+	}
+	line = append(line, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return
+	}
+	if r.MaxSize > 0 && r.size > 0 && r.size+int64(len(line)) > r.MaxSize {
+		err = r.rotate()
+		if err != nil {
+			log.Printf("Recorder: error rotating %s: %s\n", r.Path, err.Error())
+			return
+		}
+	}
+	n, err := r.file.Write(line)
+	r.size += int64(n)
+	if err != nil {
+		log.Printf("Recorder: error writing %s: %s\n", r.Path, err.Error())
+	}
+}
+
+func (r *Recorder) open() error {
+	file, err := os.OpenFile(r.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+// Shift <path>.N-1 to <path>.N, ..., <path> to <path>.1 and start a new file
+func (r *Recorder) rotate() error {
+	err := r.file.Close()
+	r.file = nil
+	if err != nil {
+		return err
+	}
+	if r.MaxBackups > 0 {
+		for n := r.MaxBackups - 1; n > 0; n-- {
+			os.Rename(backupName(r.Path, n), backupName(r.Path, n+1))
+		}
+		err = os.Rename(r.Path, backupName(r.Path, 1))
+	} else {
+		err = os.Remove(r.Path)
+	}
+	if err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func backupName(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
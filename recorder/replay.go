@@ -0,0 +1,157 @@
+package recorder
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Give up waiting for the target's side of a recorded exchange after this long
+const replayReadTimeout = 2 * time.Second
+
+// ReadFile parses every record of a capture file
+func ReadFile(path string) ([]Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Read(file)
+}
+
+// Read parses capture records, one JSON object per line
+func Read(r io.Reader) ([]Record, error) {
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		record := Record{}
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err.Error())
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// A StreamKey tells the streams of a capture apart
+type StreamKey struct {
+	Session string // Empty in captures from before sessions
+	Stream  int32
+}
+
+func (k StreamKey) String() string {
+	if k.Session == "" {
+		return strconv.Itoa(int(k.Stream))
+	}
+	return fmt.Sprintf("%s/%d", k.Session, k.Stream)
+}
+
+// Key is the stream record belongs to
+func (record *Record) Key() StreamKey {
+	return StreamKey{Session: record.Session, Stream: record.Stream}
+}
+
+// Streams returns the streams found in records, in order of appearance
+func Streams(records []Record) []StreamKey {
+	seen := make(map[StreamKey]bool)
+	var keys []StreamKey
+	for _, record := range records {
+		if !seen[record.Key()] {
+			seen[record.Key()] = true
+			keys = append(keys, record.Key())
+		}
+	}
+	return keys
+}
+
+// Print writes a human readable dump of records to w
+func Print(w io.Writer, records []Record) {
+	for _, record := range records {
+		timestamp := record.Time.Format("15:04:05.000000")
+		switch record.Event {
+		case StreamData:
+			fmt.Fprintf(w, "%s stream <%s> %-3s %d bytes: %q\n", timestamp, record.Key(), record.Direction, len(record.Data), record.Data)
+		default:
+			fmt.Fprintf(w, "%s stream <%s> %s\n", timestamp, record.Key(), record.Event)
+		}
+	}
+}
+
+// Replay re-sends the inbound bytes of each recorded stream to target,
+// one stream at a time. Where the recording shows the protected server
+// answering, Replay waits for the same number of bytes from target before
+// carrying on. It returns everything target sent back, per stream.
+func Replay(records []Record, target string) (map[StreamKey][]byte, error) {
+	replies := make(map[StreamKey][]byte)
+	for _, key := range Streams(records) {
+		reply, err := replayStream(records, key, target)
+		replies[key] = reply
+		if err != nil {
+			return replies, fmt.Errorf("stream <%s>: %s", key, err.Error())
+		}
+	}
+	return replies, nil
+}
+
+func replayStream(records []Record, key StreamKey, target string) ([]byte, error) {
+	conn, err := net.Dial("tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var reply []byte
+	expected := 0
+	for _, record := range records {
+		if record.Key() != key || record.Event != StreamData {
+			continue
+		}
+		if record.Direction == Outbound {
+			expected += len(record.Data)
+			continue
+		}
+
+		// Collect the answer to what was sent so far before sending more
+		reply, err = readAtLeast(conn, reply, expected)
+		if err != nil {
+			return reply, err
+		}
+		_, err = conn.Write(record.Data)
+		if err != nil {
+			return reply, err
+		}
+	}
+	return readAtLeast(conn, reply, expected)
+}
+
+func readAtLeast(conn net.Conn, buf []byte, n int) ([]byte, error) {
+	chunk := make([]byte, 4096)
+	for len(buf) < n {
+		conn.SetReadDeadline(time.Now().Add(replayReadTimeout))
+		i, err := conn.Read(chunk)
+		buf = append(buf, chunk[0:i]...)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				// The target answered differently than recorded
+				return buf, nil
+			}
+			if err == io.EOF {
+				return buf, nil
+			}
+			return buf, err
+		}
+	}
+	return buf, nil
+}
@@ -1,37 +1,251 @@
 package main
 
 import (
+	"crypto/tls"
+	"fmt"
 	. "github.com/andysctu/go-tunnel/client"
+	"github.com/andysctu/go-tunnel/inspector"
+	"github.com/andysctu/go-tunnel/recorder"
 	"github.com/codegangsta/cli"
 	"log"
 	"net"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 )
 
 func main() {
 	app := cli.NewApp()
 	app.Name = "rps_cli"
 	app.Usage = "Expose a local server hidden behind a firewall"
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "inspect",
+			Value: "127.0.0.1:4040",
+			Usage: "address for the traffic inspector web UI, empty to disable",
+		},
+		cli.StringFlag{
+			Name:  "record",
+			Usage: "record every tunneled stream to this capture file",
+		},
+		cli.Int64Flag{
+			Name:  "record-max-size",
+			Value: 64,
+			Usage: "rotate the capture file after this many megabytes",
+		},
+		cli.StringFlag{
+			Name:   "token",
+			Usage:  "token to present to the rps server",
+			EnvVar: "RPS_TOKEN",
+		},
+		cli.BoolFlag{
+			Name:  "tls",
+			Usage: "connect to the rps server over TLS",
+		},
+		cli.StringFlag{
+			Name:   "proxy",
+			Usage:  "reach the rps server through this http:// or socks5:// proxy, defaults to $HTTPS_PROXY or $ALL_PROXY",
+			EnvVar: "RPS_PROXY",
+		},
+		cli.StringFlag{
+			Name:  "group",
+			Usage: "share one exposed port with every client in this group",
+		},
+		cli.BoolFlag{
+			Name:  "http",
+			Usage: "users speak HTTP, answer them with a 503 while the local server is down",
+		},
+		cli.BoolFlag{
+			Name:  "https",
+			Usage: "users speak HTTP over TLS, which the rps server terminates with its own certificates, implies --http",
+		},
+		cli.StringFlag{
+			Name:  "private",
+			Usage: "publish the tunnel under this name to teammates running rps_cli visit, instead of on a public port",
+		},
+		cli.StringFlag{
+			Name:   "secret",
+			Usage:  "the secret visitors of a private tunnel must present",
+			EnvVar: "RPS_SECRET",
+		},
+		cli.DurationFlag{
+			Name:  "health-interval",
+			Usage: "check the local server this often and stop getting users while it is down, 0 to disable",
+		},
+		cli.StringFlag{
+			Name:  "health-path",
+			Usage: "check the local server with a GET of this path instead of just connecting",
+		},
+		cli.BoolFlag{
+			Name:  "target-tls",
+			Usage: "connect to the local server over TLS, for servers that only speak HTTPS",
+		},
+		cli.StringFlag{
+			Name:  "target-server-name",
+			Usage: "the name to ask the local server for and verify, implies --target-tls",
+		},
+		cli.StringFlag{
+			Name:  "target-ca",
+			Usage: "PEM file of the CAs to trust for the local server instead of the system's, implies --target-tls",
+		},
+		cli.BoolFlag{
+			Name:  "target-insecure",
+			Usage: "accept any certificate from the local server, e.g. a self-signed one, implies --target-tls",
+		},
+		cli.StringFlag{
+			Name:  "target-cert",
+			Usage: "certificate to present to the local server, with --target-key, implies --target-tls",
+		},
+		cli.StringFlag{
+			Name:  "target-key",
+			Usage: "key of --target-cert",
+		},
+	}
+	app.Commands = []cli.Command{
+		{
+			Name:      "replay",
+			Usage:     "Print a capture file, or re-send it to a target",
+			ArgsUsage: "<capture file>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "target",
+					Usage: "re-send the recorded streams to this host:port instead of printing them",
+				},
+			},
+			Action: replay,
+		},
+		{
+			Name:      "visit",
+			Usage:     "Reach a private tunnel on a local port",
+			ArgsUsage: "<tunnel> <local port>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "server",
+					Usage:  "the rps server the tunnel is published on, host:port or a ws(s):// URL",
+					EnvVar: "RPS_SERVER",
+				},
+				cli.StringFlag{
+					Name:  "bind",
+					Value: "127.0.0.1",
+					Usage: "the address to listen on",
+				},
+			},
+			Action: visit,
+		},
+		{
+			Name:      "start",
+			Usage:     "Open tunnels named in a config file",
+			ArgsUsage: "<name>...",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "config",
+					Value: "rps.yaml",
+					Usage: "the config file listing the rps server and tunnels",
+				},
+				cli.BoolFlag{
+					Name:  "all",
+					Usage: "open every tunnel in the config file",
+				},
+			},
+			Action: start,
+		},
+	}
+	// The server is host:port, or a ws:// or wss:// URL where only HTTP gets out
+	app.ArgsUsage = "<port or host:port> <server or ws(s)://server/path>"
 	app.Action = func(c *cli.Context) error {
-		portStr := c.Args()[0]
+		if c.NArg() < 2 {
+			cli.ShowAppHelp(c)
+			return cli.NewExitError("Expected a port and an rps server address", 1)
+		}
+		// A bare port is on this machine
+		host, portStr := "localhost", c.Args()[0]
+		if strings.Contains(portStr, ":") {
+			var err error
+			host, portStr, err = net.SplitHostPort(portStr)
+			if err != nil {
+				log.Printf("Invalid target: %s\n", c.Args()[0])
+				return nil
+			}
+		}
 		port, err := strconv.Atoi(portStr)
 		if err != nil {
 			log.Printf("Invalid port: %s\n", portStr)
 			return nil
 		}
-		log.Printf("Exposing whatever is currently running on port: %d\n", port)
+		target := net.JoinHostPort(host, portStr)
+		log.Printf("Exposing whatever is currently running on: %s\n", target)
 
 		serverTCPAddrStr := c.Args()[1]
-		serverTCPAddr, err := net.ResolveTCPAddr("tcp", serverTCPAddrStr)
+		serverTCPAddr, serverHost, serverURL, err := ResolveServer(serverTCPAddrStr)
 		log.Printf("Connecting to rps server @: %s\n", serverTCPAddrStr)
 		if err != nil {
 			log.Printf("Invalid server address: %s\n", serverTCPAddrStr)
 			return nil
 		}
 
+		events := make(chan Event, 16)
 		client := GoRpsClient{
 			ServerTCPAddr: serverTCPAddr,
+			ServerHost:    serverHost,
+			ServerURL:     serverURL,
+			Events:        events,
+			AutoReconnect: true,
+			Token:         c.String("token"),
+			Proxy:         c.String("proxy"),
+			TargetHost:    host,
+			Group:         c.String("group"),
+			Private:       c.String("private"),
+			Secret:        c.String("secret"),
+		}
+		if c.Bool("http") || c.Bool("https") {
+			client.Protocol = "http"
+			client.HTTPS = c.Bool("https")
+		}
+		if c.Duration("health-interval") > 0 {
+			client.HealthCheck = &HealthCheck{
+				Interval: c.Duration("health-interval"),
+				Path:     c.String("health-path"),
+			}
+		}
+		if c.Bool("tls") {
+			client.TLSConfig = &tls.Config{}
+		}
+		targetTLS := TargetTLS{
+			ServerName:         c.String("target-server-name"),
+			CAFile:             c.String("target-ca"),
+			InsecureSkipVerify: c.Bool("target-insecure"),
+			CertFile:           c.String("target-cert"),
+			KeyFile:            c.String("target-key"),
+		}
+		if c.Bool("target-tls") || targetTLS != (TargetTLS{}) {
+			client.TargetTLS, err = targetTLS.Config()
+			if err != nil {
+				log.Printf("Invalid target TLS: %s\n", err.Error())
+				return nil
+			}
+		}
+
+		if c.String("record") != "" {
+			client.Recorder, err = recorder.New(c.String("record"))
+			if err != nil {
+				log.Printf("Unable to open capture file: %s\n", err.Error())
+				return nil
+			}
+			client.Recorder.MaxSize = c.Int64("record-max-size") * 1024 * 1024
+			log.Printf("Recording tunneled streams to: %s\n", client.Recorder.Path)
+		}
+
+		inspectAddr := c.String("inspect")
+		if inspectAddr != "" {
+			client.Inspector = inspector.New(target)
+			client.Inspector.TargetTLS = client.TargetTLS
+			go func() {
+				err := client.Inspector.ListenAndServe(inspectAddr)
+				if err != nil {
+					log.Printf("Unable to start inspector: %s\n", err.Error())
+				}
+			}()
 		}
 
 		err = client.OpenTunnel(port)
@@ -42,8 +256,146 @@ func main() {
 
 		exposedTCPAddr := *serverTCPAddr
 		exposedTCPAddr.Port = client.ExposedPort
-		log.Printf("Tunnel opened! Go here: %s\n", exposedTCPAddr.String())
-		select {}
+		if client.Private != "" {
+			log.Printf("Private tunnel opened! Reach it with: rps_cli visit --server %s %s <local port>\n", serverTCPAddrStr, client.Private)
+		} else {
+			log.Printf("Tunnel opened! Go here: %s\n", goHere(&exposedTCPAddr, client.HTTPS))
+		}
+		for event := range events {
+			switch event.Type {
+			case ControlConnectionLost:
+				log.Printf("Lost connection to rps server, reconnecting...\n")
+			case Draining:
+				log.Printf("RPS server is draining, re-opening tunnel...\n")
+			case Reconnected:
+				if client.Private != "" {
+					log.Printf("Private tunnel re-opened!\n")
+					continue
+				}
+				exposedTCPAddr.Port = event.ExposedPort
+				log.Printf("Tunnel re-opened! Go here: %s\n", goHere(&exposedTCPAddr, client.HTTPS))
+			}
+		}
+		return nil
 	}
 	app.Run(os.Args)
 }
+
+func visit(c *cli.Context) error {
+	if c.NArg() < 2 {
+		return cli.NewExitError("Expected a tunnel name and a local port", 1)
+	}
+	if c.String("server") == "" {
+		return cli.NewExitError("Missing --server", 1)
+	}
+	serverTCPAddr, serverHost, serverURL, err := ResolveServer(c.String("server"))
+	if err != nil {
+		return cli.NewExitError("Invalid server address: "+err.Error(), 1)
+	}
+	client := &GoRpsClient{
+		ServerTCPAddr: serverTCPAddr,
+		ServerHost:    serverHost,
+		ServerURL:     serverURL,
+		Token:         c.GlobalString("token"),
+		Secret:        c.GlobalString("secret"),
+		Proxy:         c.GlobalString("proxy"),
+	}
+	if c.GlobalBool("tls") {
+		client.TLSConfig = &tls.Config{}
+	}
+
+	name := c.Args()[0]
+	listener, err := net.Listen("tcp", net.JoinHostPort(c.String("bind"), c.Args()[1]))
+	if err != nil {
+		return cli.NewExitError("Unable to listen: "+err.Error(), 1)
+	}
+	log.Printf("Visiting private tunnel %s @: %s\n", name, listener.Addr().String())
+	return client.ServeVisitors(listener, name)
+}
+
+func start(c *cli.Context) error {
+	cfg, err := LoadTunnelsConfig(c.String("config"))
+	if err != nil {
+		return cli.NewExitError("Invalid config file: "+err.Error(), 1)
+	}
+	tunnels, err := cfg.Select(c.Args(), c.Bool("all"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	log.Printf("Connecting to rps server @: %s\n", cfg.Server)
+	var wg sync.WaitGroup
+	for _, tunnel := range tunnels {
+		events := make(chan Event, 16)
+		client := cfg.Client(tunnel)
+		client.Events = events
+		client.AutoReconnect = true
+		err = tunnel.Open(client)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Unable to open tunnel %s: %s", tunnel.Name, err.Error()), 1)
+		}
+
+		exposedTCPAddr := *client.ServerTCPAddr
+		exposedTCPAddr.Port = client.ExposedPort
+		if tunnel.Private {
+			log.Printf("Private tunnel %s opened to %s! Reach it with: rps_cli visit --server %s %s <local port>\n", tunnel.Name, tunnel.TargetAddr(), cfg.Server, tunnel.Name)
+		} else {
+			log.Printf("Tunnel %s opened to %s! Go here: %s\n", tunnel.Name, tunnel.TargetAddr(), goHere(&exposedTCPAddr, tunnel.HTTPS))
+		}
+		wg.Add(1)
+		go func(name string, private bool, https bool) {
+			defer wg.Done()
+			for event := range events {
+				switch event.Type {
+				case ControlConnectionLost:
+					log.Printf("Tunnel %s lost connection to rps server, reconnecting...\n", name)
+				case Draining:
+					log.Printf("RPS server is draining, re-opening tunnel %s...\n", name)
+				case Reconnected:
+					if private {
+						log.Printf("Private tunnel %s re-opened!\n", name)
+						continue
+					}
+					exposedTCPAddr.Port = event.ExposedPort
+					log.Printf("Tunnel %s re-opened! Go here: %s\n", name, goHere(&exposedTCPAddr, https))
+				}
+			}
+		}(tunnel.Name, tunnel.Private, tunnel.HTTPS)
+	}
+	wg.Wait()
+	return nil
+}
+
+// Where users find an exposed tunnel
+func goHere(addr *net.TCPAddr, https bool) string {
+	if https {
+		return "https://" + addr.String()
+	}
+	return addr.String()
+}
+
+func replay(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return cli.NewExitError("Missing capture file", 1)
+	}
+	records, err := recorder.ReadFile(c.Args()[0])
+	if err != nil {
+		return cli.NewExitError("Invalid capture file: "+err.Error(), 1)
+	}
+
+	target := c.String("target")
+	if target == "" {
+		recorder.Print(os.Stdout, records)
+		return nil
+	}
+
+	log.Printf("Replaying %d streams to: %s\n", len(recorder.Streams(records)), target)
+	replies, err := recorder.Replay(records, target)
+	for _, key := range recorder.Streams(records) {
+		fmt.Printf("stream <%s> received %d bytes: %q\n", key, len(replies[key]), replies[key])
+	}
+	if err != nil {
+		return cli.NewExitError("Replay failed: "+err.Error(), 1)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+)
+
+// Balance is how the users of a group are spread across its members
+type Balance int
+
+const (
+	RoundRobin       Balance = iota // Each member in turn
+	LeastConnections                // The member with the fewest users
+)
+
+// ParseBalance parses round_robin or least_connections
+func ParseBalance(value string) (Balance, error) {
+	switch value {
+	case "", "round_robin":
+		return RoundRobin, nil
+	case "least_connections":
+		return LeastConnections, nil
+	}
+	return RoundRobin, fmt.Errorf("unknown balance %q, expected round_robin or least_connections", value)
+}
+
+// Choose the member to serve a new user, skipping unhealthy and full ones.
+// Members whose tunnel is still opening are only chosen when no other can
+// take the user, who then waits for it to open. Must be called with the
+// registry's lock held.
+func (grp *group) pick(maxStreams int, balance Balance) (*session, error) {
+	healthy := false
+	available := func(sess *session) bool {
+		if sess.unhealthy != "" {
+			return false
+		}
+		healthy = true
+		return maxStreams == 0 || len(sess.streams) < maxStreams
+	}
+
+	chosen := grp.choose(balance, func(sess *session) bool {
+		return sess.transport != nil && available(sess)
+	})
+	if chosen == nil {
+		chosen = grp.choose(balance, available)
+	}
+	if chosen != nil {
+		return chosen, nil
+	}
+	if !healthy {
+		return nil, errUnhealthy
+	}
+	return nil, errTooManyUsers
+}
+
+// The member balance picks among those available
+func (grp *group) choose(balance Balance, available func(*session) bool) *session {
+	var chosen *session
+	if balance == LeastConnections {
+		for _, sess := range grp.members {
+			if available(sess) && (chosen == nil || len(sess.streams) < len(chosen.streams)) {
+				chosen = sess
+			}
+		}
+		return chosen
+	}
+	for i := 0; i < len(grp.members); i++ {
+		sess := grp.members[(grp.next+i)%len(grp.members)]
+		if available(sess) {
+			grp.next = (grp.next + i + 1) % len(grp.members)
+			return sess
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"strings"
+	"sync"
+)
+
+var errNoCertificates = errors.New("Server has no certificates for https tunnels")
+
+// A UserCert is a certificate users of https tunnels are served, for the
+// names in Hosts or, if there are none, the names it was issued for. Names
+// may be wildcards like *.tunnels.example.com.
+type UserCert struct {
+	Certificate tls.Certificate
+	Hosts       []string
+}
+
+// A CertStore holds the certificates the server terminates users' TLS with,
+// picking one by the name the user asked for. They can be replaced with Set
+// while the server runs; users already connected keep theirs.
+type CertStore struct {
+	mu     sync.RWMutex
+	byName map[string]*tls.Certificate // Lowercase names, wildcards included as *.domain
+	first  *tls.Certificate            // For users who don't say which name they want
+}
+
+// NewCertStore returns a store serving certs
+func NewCertStore(certs []UserCert) (*CertStore, error) {
+	store := &CertStore{}
+	err := store.Set(certs)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Set replaces every certificate in the store
+func (cs *CertStore) Set(certs []UserCert) error {
+	byName := make(map[string]*tls.Certificate)
+	var first *tls.Certificate
+	for i := range certs {
+		cert := &certs[i].Certificate
+		hosts := certs[i].Hosts
+		if len(hosts) == 0 {
+			leaf := cert.Leaf
+			if leaf == nil {
+				if len(cert.Certificate) == 0 {
+					return errors.New("Empty certificate")
+				}
+				var err error
+				leaf, err = x509.ParseCertificate(cert.Certificate[0])
+				if err != nil {
+					return err
+				}
+			}
+			hosts = leaf.DNSNames
+			for _, ip := range leaf.IPAddresses {
+				hosts = append(hosts, ip.String())
+			}
+		}
+		for _, host := range hosts {
+			host = strings.ToLower(host)
+			// The first certificate listed for a name wins
+			if _, ok := byName[host]; !ok {
+				byName[host] = cert
+			}
+		}
+		if first == nil {
+			first = cert
+		}
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.byName = byName
+	cs.first = first
+	return nil
+}
+
+func (cs *CertStore) empty() bool {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.first == nil
+}
+
+// GetCertificate is for tls.Config, picking the certificate for the name in
+// hello: one for the name itself, then a wildcard covering it, then the
+// first certificate
+func (cs *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	if cs.first == nil {
+		return nil, errNoCertificates
+	}
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := cs.byName[name]; ok {
+		return cert, nil
+	}
+	// A wildcard only stands for the leftmost label
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := cs.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return cs.first, nil
+}
+
+// The TLS config users of https tunnels are served with
+func (cs *CertStore) tlsConfig() *tls.Config {
+	return &tls.Config{GetCertificate: cs.GetCertificate}
+}
@@ -0,0 +1,328 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/andysctu/go-tunnel/helper"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Config is the server's YAML configuration file, e.g.
+//
+//	listen: 10.0.0.1:34567
+//	websocket:
+//	  listen: 10.0.0.1:443
+//	  path: /tunnel
+//	ssh:
+//	  listen: 10.0.0.1:2222
+//	  host_key: /etc/rps/ssh_host_ed25519_key
+//	expose:
+//	  bind: 203.0.113.10
+//	  ports: 20000-20999
+//	  balance: least_connections
+//	auth:
+//	  tokens: [s3cret]
+//	  authorized_keys: /etc/rps/authorized_keys
+//	limits:
+//	  max_tunnels: 100
+//	  max_users_per_tunnel: 20
+//	allow:
+//	  clients: [10.0.0.0/8]
+//	  users: [0.0.0.0/0]
+//	tls:
+//	  cert_file: /etc/rps/cert.pem
+//	  key_file: /etc/rps/key.pem
+//	https:
+//	  certs:
+//	    - cert_file: /etc/rps/wildcard.pem
+//	      key_file: /etc/rps/wildcard-key.pem
+//	    - cert_file: /etc/rps/shop.pem
+//	      key_file: /etc/rps/shop-key.pem
+//	      hosts: [shop.example.com]
+//	log:
+//	  file: /var/log/rps.log
+//
+// Auth, limits, allow lists and https certificates can be changed with
+// Reload while the server runs. Listen, websocket, ssh, expose and TLS only
+// take effect on restart.
+type Config struct {
+	Listen    string          `yaml:"listen"` // Address to listen for clients on
+	WebSocket WebSocketConfig `yaml:"websocket"`
+	SSH       SSHConfig       `yaml:"ssh"`
+	Expose    ExposeConfig    `yaml:"expose"`
+	Auth      AuthConfig      `yaml:"auth"`
+	Limits    LimitsConfig    `yaml:"limits"`
+	Allow     AllowConfig     `yaml:"allow"`
+	TLS       TLSFiles        `yaml:"tls"`
+	HTTPS     HTTPSConfig     `yaml:"https"`
+	Log       LogConfig       `yaml:"log"`
+
+	policy     *Policy
+	portRange  PortRange
+	balance    Balance
+	tlsConfig  *tls.Config
+	sshHostKey ssh.Signer
+	userCerts  []UserCert
+}
+
+// Where clients that can only get out over HTTP connect
+type WebSocketConfig struct {
+	Listen string `yaml:"listen"` // Address to accept WebSocket upgrades on, none if empty
+	Path   string `yaml:"path"`   // Defaults to /tunnel
+}
+
+// Where teammates without rps_cli open tunnels with ssh -R
+type SSHConfig struct {
+	Listen  string `yaml:"listen"`   // Address to accept ssh clients on, none if empty
+	HostKey string `yaml:"host_key"` // Private key file the server proves itself with, a new key every start if empty
+}
+
+// Where users reach tunnels
+type ExposeConfig struct {
+	Bind    string `yaml:"bind"`    // IP to listen for users on, defaults to every interface
+	Ports   string `yaml:"ports"`   // Range tunnels are exposed in, e.g. 20000-20999, any if empty
+	Balance string `yaml:"balance"` // How users of a group are spread, round_robin or least_connections
+}
+
+type AuthConfig struct {
+	Tokens         []string `yaml:"tokens"`          // Clients must present one of these, if any are set
+	AuthorizedKeys string   `yaml:"authorized_keys"` // File of the keys ssh clients may log in with, in the format of ~/.ssh/authorized_keys
+}
+
+type LimitsConfig struct {
+	MaxTunnels        int `yaml:"max_tunnels"`
+	MaxUsersPerTunnel int `yaml:"max_users_per_tunnel"`
+}
+
+// Addresses or CIDR ranges that may connect, anyone if empty
+type AllowConfig struct {
+	Clients []string `yaml:"clients"`
+	Users   []string `yaml:"users"`
+}
+
+// Certificate and key clients are served over TLS with
+type TLSFiles struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// Certificates users of https tunnels are served, picked by the name they ask for
+type HTTPSConfig struct {
+	Certs []UserCertFiles `yaml:"certs"`
+}
+
+type UserCertFiles struct {
+	TLSFiles `yaml:",inline"`
+	Hosts    []string `yaml:"hosts"` // Optional, names to serve the certificate for instead of the ones it was issued for
+}
+
+type LogConfig struct {
+	File string `yaml:"file"` // Log to this file instead of stderr
+}
+
+// LoadConfig reads and validates the config file at path
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := ParseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return cfg, nil
+}
+
+// ParseConfig parses and validates a config file's contents. Errors give
+// the line of the offending setting.
+func ParseConfig(data []byte) (*Config, error) {
+	cfg := &Config{}
+	root, err := helper.DecodeYAML(data, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Listen != "" {
+		_, _, err = net.SplitHostPort(cfg.Listen)
+		if err != nil {
+			return nil, helper.YAMLError(root, err.Error(), "listen")
+		}
+	}
+	if cfg.WebSocket.Listen != "" {
+		_, _, err = net.SplitHostPort(cfg.WebSocket.Listen)
+		if err != nil {
+			return nil, helper.YAMLError(root, err.Error(), "websocket", "listen")
+		}
+	}
+	if cfg.WebSocket.Path != "" && !strings.HasPrefix(cfg.WebSocket.Path, "/") {
+		return nil, helper.YAMLError(root, "must start with /", "websocket", "path")
+	}
+	if cfg.SSH.Listen != "" {
+		_, _, err = net.SplitHostPort(cfg.SSH.Listen)
+		if err != nil {
+			return nil, helper.YAMLError(root, err.Error(), "ssh", "listen")
+		}
+	}
+	if cfg.SSH.HostKey != "" {
+		cfg.sshHostKey, err = LoadSSHHostKey(cfg.SSH.HostKey)
+		if err != nil {
+			return nil, helper.YAMLError(root, err.Error(), "ssh", "host_key")
+		}
+	}
+	if cfg.Expose.Bind != "" && net.ParseIP(cfg.Expose.Bind) == nil {
+		return nil, helper.YAMLError(root, fmt.Sprintf("invalid address %q", cfg.Expose.Bind), "expose", "bind")
+	}
+	if cfg.Expose.Ports != "" {
+		cfg.portRange, err = ParsePortRange(cfg.Expose.Ports)
+		if err != nil {
+			return nil, helper.YAMLError(root, err.Error(), "expose", "ports")
+		}
+	}
+	cfg.balance, err = ParseBalance(cfg.Expose.Balance)
+	if err != nil {
+		return nil, helper.YAMLError(root, err.Error(), "expose", "balance")
+	}
+	for i, token := range cfg.Auth.Tokens {
+		if token == "" {
+			return nil, helper.YAMLError(root, "empty token", "auth", "tokens", strconv.Itoa(i))
+		}
+	}
+	var authorizedKeys []ssh.PublicKey
+	if cfg.Auth.AuthorizedKeys != "" {
+		data, err := ioutil.ReadFile(cfg.Auth.AuthorizedKeys)
+		if err == nil {
+			authorizedKeys, err = ParseAuthorizedKeys(data)
+		}
+		if err != nil {
+			return nil, helper.YAMLError(root, err.Error(), "auth", "authorized_keys")
+		}
+	}
+	if cfg.Limits.MaxTunnels < 0 {
+		return nil, helper.YAMLError(root, "must not be negative", "limits", "max_tunnels")
+	}
+	if cfg.Limits.MaxUsersPerTunnel < 0 {
+		return nil, helper.YAMLError(root, "must not be negative", "limits", "max_users_per_tunnel")
+	}
+	allowClients, err := parseNetworks(root, "clients", cfg.Allow.Clients)
+	if err != nil {
+		return nil, err
+	}
+	allowUsers, err := parseNetworks(root, "users", cfg.Allow.Users)
+	if err != nil {
+		return nil, err
+	}
+	cfg.policy = &Policy{
+		Tokens:            cfg.Auth.Tokens,
+		MaxTunnels:        cfg.Limits.MaxTunnels,
+		MaxUsersPerTunnel: cfg.Limits.MaxUsersPerTunnel,
+		AllowClients:      allowClients,
+		AllowUsers:        allowUsers,
+		AuthorizedKeys:    authorizedKeys,
+	}
+
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		return nil, helper.YAMLError(root, "cert_file and key_file must be set together", "tls")
+	}
+	if cfg.TLS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			return nil, helper.YAMLError(root, err.Error(), "tls")
+		}
+		cfg.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	for i, files := range cfg.HTTPS.Certs {
+		if files.CertFile == "" || files.KeyFile == "" {
+			return nil, helper.YAMLError(root, "cert_file and key_file must both be set", "https", "certs", strconv.Itoa(i))
+		}
+		cert, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+		if err != nil {
+			return nil, helper.YAMLError(root, err.Error(), "https", "certs", strconv.Itoa(i))
+		}
+		cfg.userCerts = append(cfg.userCerts, UserCert{Certificate: cert, Hosts: files.Hosts})
+	}
+	return cfg, nil
+}
+
+// Policy returns the auth, limits and allow lists of the config
+func (cfg *Config) Policy() *Policy {
+	return cfg.policy
+}
+
+// Parses one of the allow lists. Accepts single addresses as well as CIDR
+// ranges.
+func parseNetworks(root *yaml.Node, field string, values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for i, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, helper.YAMLError(root, fmt.Sprintf("invalid address %q", value), "allow", field, strconv.Itoa(i))
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, helper.YAMLError(root, fmt.Sprintf("invalid range %q", value), "allow", field, strconv.Itoa(i))
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Configure sets up a server that hasn't started yet from cfg
+func (s *GoRpsServer) Configure(cfg *Config) {
+	s.Addr = cfg.Listen
+	s.WebSocketAddr = cfg.WebSocket.Listen
+	s.WebSocketPath = cfg.WebSocket.Path
+	s.SSHAddr = cfg.SSH.Listen
+	s.SSHHostKey = cfg.sshHostKey
+	s.UserAddr = cfg.Expose.Bind
+	s.PortRange = cfg.portRange
+	s.Balance = cfg.balance
+	s.TLSConfig = cfg.tlsConfig
+	// Always a store, so Reload can add certificates later. Loading them
+	// already parsed their leaves, so this can't fail.
+	s.UserCerts, _ = NewCertStore(cfg.userCerts)
+	s.SetPolicy(cfg.policy)
+	s.config = cfg
+}
+
+// Reload applies the parts of cfg that can change while the server runs.
+// Tunnels and users already connected are kept.
+func (s *GoRpsServer) Reload(cfg *Config) {
+	s.SetPolicy(cfg.policy)
+	if s.UserCerts != nil {
+		s.UserCerts.Set(cfg.userCerts)
+	}
+
+	if s.config != nil {
+		if cfg.Listen != s.config.Listen {
+			log.Printf("Config: listen changed, restart to apply\n")
+		}
+		if cfg.WebSocket != s.config.WebSocket {
+			log.Printf("Config: websocket changed, restart to apply\n")
+		}
+		if cfg.SSH != s.config.SSH {
+			log.Printf("Config: ssh changed, restart to apply\n")
+		}
+		if cfg.Expose != s.config.Expose {
+			log.Printf("Config: expose changed, restart to apply\n")
+		}
+		if cfg.TLS != s.config.TLS {
+			log.Printf("Config: tls changed, restart to apply\n")
+		}
+	}
+	log.Printf("Config reloaded\n")
+}
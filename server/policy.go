@@ -0,0 +1,83 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"net"
+)
+
+var (
+	errTooManyTunnels = errors.New("Too many tunnels")
+	errTooManyUsers   = errors.New("Too many users on this tunnel")
+	errSessionClosed  = errors.New("Tunnel closed")
+	errDraining       = errors.New("Server is draining")
+	errGroupToken     = errors.New("Group belongs to another token")
+	errNoPrivate      = errors.New("No private tunnel with that name and secret")
+	errUnhealthy      = errors.New("Protected server unavailable")
+)
+
+// A Policy decides who may open tunnels and use them. It can be replaced
+// with SetPolicy while the server runs; tunnels and users already connected
+// are left alone, the new policy applies to everyone who connects after.
+type Policy struct {
+	Tokens            []string        // Clients must present one of these, if any are set
+	MaxTunnels        int             // Open tunnels at once, 0 for no limit
+	MaxUsersPerTunnel int             // Users connected to one tunnel at once, 0 for no limit
+	AllowClients      []*net.IPNet    // Addresses clients may connect from, any if empty
+	AllowUsers        []*net.IPNet    // Addresses users may connect from, any if empty
+	AuthorizedKeys    []ssh.PublicKey // Keys ssh clients may log in with. If empty, anyone may unless Tokens are set.
+}
+
+// SetPolicy replaces the server's policy. A nil policy lets everyone in.
+func (s *GoRpsServer) SetPolicy(policy *Policy) {
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+	s.policy = policy
+}
+
+func (s *GoRpsServer) currentPolicy() *Policy {
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+	if s.policy == nil {
+		return &Policy{}
+	}
+	return s.policy
+}
+
+// Whether token is one of the policy's tokens
+func (p *Policy) authorized(token string) bool {
+	if len(p.Tokens) == 0 {
+		return true
+	}
+	for _, t := range p.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) clientAllowed(addr net.Addr) bool {
+	return allowed(p.AllowClients, addr)
+}
+
+func (p *Policy) userAllowed(addr net.Addr) bool {
+	return allowed(p.AllowUsers, addr)
+}
+
+func allowed(networks []*net.IPNet, addr net.Addr) bool {
+	if len(networks) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var errNoPortAvailable = errors.New("No port available")
+
+// PortRange is the inclusive range of ports tunnels may be exposed on. The
+// zero PortRange allows any port.
+type PortRange struct {
+	Min int
+	Max int
+}
+
+// ParsePortRange parses "20000-20999", or a single port
+func ParsePortRange(value string) (PortRange, error) {
+	minStr, maxStr := value, value
+	if i := strings.Index(value, "-"); i >= 0 {
+		minStr, maxStr = value[:i], value[i+1:]
+	}
+	min, err := strconv.Atoi(strings.TrimSpace(minStr))
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q", value)
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(maxStr))
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q", value)
+	}
+	r := PortRange{Min: min, Max: max}
+	if min < 1 || max > 65535 || min > max {
+		return PortRange{}, fmt.Errorf("invalid port range %q", value)
+	}
+	return r, nil
+}
+
+func (r PortRange) any() bool {
+	return r.Min == 0 && r.Max == 0
+}
+
+func (r PortRange) contains(port int) bool {
+	return r.any() || (port >= r.Min && port <= r.Max)
+}
+
+func (r PortRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// Listen for users on ip, on the requested port if it isn't 0, otherwise on
+// a free port in the range
+func listenForUsersOn(ip net.IP, requestedPort int, r PortRange) (*net.TCPListener, error) {
+	if requestedPort != 0 {
+		if !r.contains(requestedPort) {
+			return nil, fmt.Errorf("Port %d not allowed, expected %s", requestedPort, r)
+		}
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: requestedPort})
+		if err != nil {
+			return nil, fmt.Errorf("Port %d unavailable", requestedPort)
+		}
+		return listener, nil
+	}
+
+	if r.any() {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+		if err != nil {
+			return nil, errNoPortAvailable
+		}
+		return listener, nil
+	}
+
+	// Try every port in the range, starting somewhere random so tunnels
+	// don't all fight over the first few
+	size := r.Max - r.Min + 1
+	offset := rand.Intn(size)
+	for i := 0; i < size; i++ {
+		port := r.Min + (offset+i)%size
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: port})
+		if err == nil {
+			return listener, nil
+		}
+	}
+	return nil, errNoPortAvailable
+}
@@ -0,0 +1,341 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/andysctu/go-tunnel/transport"
+	"net"
+	"sync"
+)
+
+// A session is one client's tunnel: its control connection, the group whose
+// users it serves, and the users currently connected through it. Only
+// streams and transport change after the session is registered.
+type session struct {
+	clientConn net.Conn
+	transport  transport.Session // Nil until the tunnel is open, everything to and from the client goes through it
+	ready      chan struct{}     // Closed once transport is set or the session is removed
+	group      *group
+	streams    map[int32]net.Conn // UserID -> user connection
+	unhealthy  string             // Why the client's protected server is down, if it is
+}
+
+// A group is the listener users connect to and the sessions they are spread
+// across. Clients that don't name a group get one of their own. Only
+// members and next change after the group is created, and http, tls and
+// socks are set by its creator before users are accepted.
+//
+// A private group has no listener. Its users are visitors, clients that
+// present its secret.
+type group struct {
+	name         string // Empty for a client's own group
+	token        string // Clients joining must present the token of the one that created it
+	private      bool
+	secret       string           // Visitors of a private group must present it, and so must clients joining it
+	userListener *net.TCPListener // Nil for a private group
+	exposedPort  int
+	http         bool // Users speak HTTP
+	tls          bool // Users speak HTTP over TLS, which the server terminates
+	socks        bool // Users speak SOCKS5, naming the destination the client connects them to
+	members      []*session
+	next         int // Where round robin picks up
+}
+
+// The registry holds every session and user stream of a server. All access
+// goes through its methods, which may be called from any goroutine.
+//
+// Whoever removes a session or stream from the registry owns it and is
+// responsible for closing it, so each connection is closed exactly once.
+type registry struct {
+	mu          sync.Mutex
+	nextId      int32
+	sessions    map[net.Conn]*session
+	groups      map[string]*group // Named groups only
+	private     map[string]*group // Private groups by name
+	pending     map[net.Conn]bool // Clients that haven't finished saying hello
+	streamCount int
+	closed      bool
+	draining    bool
+	idle        chan struct{} // Closed once draining and no streams are left
+	idleClosed  bool
+}
+
+func newRegistry() *registry {
+	return &registry{
+		sessions: make(map[net.Conn]*session),
+		groups:   make(map[string]*group),
+		private:  make(map[string]*group),
+		pending:  make(map[net.Conn]bool),
+		idle:     make(chan struct{}),
+	}
+}
+
+// Register a client that is still saying hello. Returns false if the server
+// is shutting down.
+func (r *registry) addPending(clientConn net.Conn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return false
+	}
+	r.pending[clientConn] = true
+	return true
+}
+
+// Forget a client that has said hello. Returns false if it was already
+// removed.
+func (r *registry) removePending(clientConn net.Conn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.pending[clientConn] {
+		return false
+	}
+	delete(r.pending, clientConn)
+	return true
+}
+
+// Close stops the group's listener, if it has one
+func (grp *group) Close() error {
+	if grp.userListener == nil {
+		return nil
+	}
+	return grp.userListener.Close()
+}
+
+// Private and public groups have names of their own
+func (r *registry) groupsOf(private bool) map[string]*group {
+	if private {
+		return r.private
+	}
+	return r.groups
+}
+
+// Register a new tunnel, unless there are already maxSessions of them (0
+// for no limit) or the server is draining or shutting down. The tunnel joins
+// the group named by want if it exists, otherwise a new group like want is
+// created, listening for users with listen unless it is private. Returns
+// whether the group is new. The tunnel gets no users until setTransport is
+// called.
+func (r *registry) addSession(clientConn net.Conn, want group, requestedPort int, maxSessions int, listen func() (*net.TCPListener, error)) (*session, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || r.draining {
+		return nil, false, errDraining
+	}
+	if maxSessions > 0 && len(r.sessions) >= maxSessions {
+		return nil, false, errTooManyTunnels
+	}
+
+	groups := r.groupsOf(want.private)
+	grp := groups[want.name]
+	created := grp == nil || want.name == ""
+	if created {
+		grp = &want
+		if !grp.private {
+			// Listening with the lock held keeps two clients from creating
+			// the same group
+			userListener, err := listen()
+			if err != nil {
+				return nil, false, err
+			}
+			grp.userListener = userListener
+			grp.exposedPort = listenerPort(userListener)
+		}
+		if grp.name != "" {
+			groups[grp.name] = grp
+		}
+	} else {
+		if subtle.ConstantTimeCompare([]byte(grp.token), []byte(want.token)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(grp.secret), []byte(want.secret)) != 1 {
+			return nil, false, errGroupToken
+		}
+		if requestedPort != 0 && requestedPort != grp.exposedPort {
+			return nil, false, fmt.Errorf("Group %s is exposed on port %d", grp.name, grp.exposedPort)
+		}
+	}
+
+	sess := &session{
+		clientConn: clientConn,
+		group:      grp,
+		streams:    make(map[int32]net.Conn),
+		ready:      make(chan struct{}),
+	}
+	grp.members = append(grp.members, sess)
+	r.sessions[clientConn] = sess
+	return sess, created, nil
+}
+
+// Start sending users to sess over t. Returns false if sess was removed or
+// the server started draining while the tunnel was opening.
+func (r *registry) setTransport(sess *session, t transport.Session) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions[sess.clientConn] != sess || r.draining {
+		return false
+	}
+	sess.transport = t
+	close(sess.ready)
+	return true
+}
+
+// Wait for the tunnel of sess to open. Returns nil if sess was removed
+// first.
+func (r *registry) waitTransport(sess *session) transport.Session {
+	<-sess.ready
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return sess.transport
+}
+
+// Forget the tunnel of clientConn, returning it with all of its streams and
+// whether it was the last member of its group. Returns nil if it was already
+// removed.
+func (r *registry) removeSession(clientConn net.Conn) (*session, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sess, ok := r.sessions[clientConn]
+	if !ok {
+		return nil, false
+	}
+	delete(r.sessions, clientConn)
+	r.streamCount -= len(sess.streams)
+	r.checkIdle()
+	if sess.transport == nil {
+		close(sess.ready)
+	}
+
+	grp := sess.group
+	for i, member := range grp.members {
+		if member == sess {
+			grp.members = append(grp.members[:i], grp.members[i+1:]...)
+			break
+		}
+	}
+	if len(grp.members) > 0 {
+		return sess, false
+	}
+	if grp.name != "" {
+		delete(r.groupsOf(grp.private), grp.name)
+	}
+	return sess, true
+}
+
+// The private group a visitor asks for, if secret is its secret
+func (r *registry) privateGroup(name string, secret string) (*group, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	grp := r.private[name]
+	if grp == nil || subtle.ConstantTimeCompare([]byte(grp.secret), []byte(secret)) != 1 {
+		return nil, errNoPrivate
+	}
+	return grp, nil
+}
+
+// Register a user of grp on one of its members, chosen by balance, and
+// assign it an ID. Fails if every healthy member already has maxStreams
+// users (0 for no limit), no member is healthy, the group has no members
+// left, or the server is draining or shutting down.
+func (r *registry) addStream(grp *group, userConn net.Conn, maxStreams int, balance Balance) (*session, int32, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(grp.members) == 0 || r.closed {
+		return nil, 0, errSessionClosed
+	}
+	if r.draining {
+		return nil, 0, errDraining
+	}
+	sess, err := grp.pick(maxStreams, balance)
+	if err != nil {
+		return nil, 0, err
+	}
+	// IDs are never negative, -1 is reserved for the tunnel itself
+	r.nextId++
+	if r.nextId < 0 {
+		r.nextId = 1
+	}
+	id := r.nextId
+	sess.streams[id] = userConn
+	r.streamCount++
+	return sess, id, nil
+}
+
+// Record whether the protected server of clientConn's tunnel is up, with
+// the reason it isn't
+func (r *registry) setHealth(clientConn net.Conn, unhealthy string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sess, ok := r.sessions[clientConn]
+	if ok {
+		sess.unhealthy = unhealthy
+	}
+}
+
+// Forget user <id> on the tunnel of clientConn, returning its connection.
+// Returns nil if it was already removed.
+func (r *registry) removeStream(clientConn net.Conn, id int32) net.Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sess, ok := r.sessions[clientConn]
+	if !ok {
+		return nil
+	}
+	userConn, ok := sess.streams[id]
+	if !ok {
+		return nil
+	}
+	delete(sess.streams, id)
+	r.streamCount--
+	r.checkIdle()
+	return userConn
+}
+
+// Forget every session and pending client and refuse new ones, returning
+// what was removed
+func (r *registry) closeAll() ([]*session, []net.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	sessions := make([]*session, 0, len(r.sessions))
+	for clientConn, sess := range r.sessions {
+		sessions = append(sessions, sess)
+		delete(r.sessions, clientConn)
+		if sess.transport == nil {
+			close(sess.ready)
+		}
+	}
+	pending := make([]net.Conn, 0, len(r.pending))
+	for clientConn := range r.pending {
+		pending = append(pending, clientConn)
+		delete(r.pending, clientConn)
+	}
+	r.groups = make(map[string]*group)
+	r.private = make(map[string]*group)
+	r.streamCount = 0
+	r.checkIdle()
+	return sessions, pending
+}
+
+// Refuse new sessions and streams, returning the open sessions that have a
+// transport. The returned channel is closed once their streams have all been
+// removed.
+func (r *registry) drain() ([]*session, <-chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.draining = true
+	sessions := make([]*session, 0, len(r.sessions))
+	for _, sess := range r.sessions {
+		if sess.transport != nil {
+			sessions = append(sessions, sess)
+		}
+	}
+	r.checkIdle()
+	return sessions, r.idle
+}
+
+// Must be called with r.mu held
+func (r *registry) checkIdle() {
+	if (r.draining || r.closed) && r.streamCount == 0 && !r.idleClosed {
+		r.idleClosed = true
+		close(r.idle)
+	}
+}
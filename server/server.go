@@ -1,49 +1,134 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/andysctu/go-tunnel/helper"
 	pb "github.com/andysctu/go-tunnel/protobuf"
-	"github.com/golang/protobuf/proto"
+	"github.com/andysctu/go-tunnel/recorder"
+	"github.com/andysctu/go-tunnel/transport"
+	"github.com/andysctu/go-tunnel/webhook"
+	"golang.org/x/crypto/ssh"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"strconv"
+	"sync"
+	"time"
 )
 
-type GoRpsServer struct {
-	UserConn map[int32]*net.TCPConn
-	UserId   map[*net.TCPConn]int32
+// How long a client has to say hello before it is disconnected
+const helloTimeout = 10 * time.Second
+
+// Where clients upgrade to a WebSocket, unless WebSocketPath says otherwise
+const DefaultWebSocketPath = "/tunnel"
 
-	clientToUserConn     map[*net.TCPConn][]*net.TCPConn
-	clientToUserListener map[*net.TCPConn]*net.TCPListener
-	clientListener       *net.TCPListener
+type GoRpsServer struct {
+	Addr      string             // Optional, address to listen for clients on, defaults to port 34567 or $PORT on every interface
+	UserAddr  string             // Optional, IP to listen for users on, defaults to every interface
+	PortRange PortRange          // Optional, ports tunnels may be exposed on, any if zero
+	Balance   Balance            // Optional, how users of a group are spread across its clients, defaults to RoundRobin
+	TLSConfig *tls.Config        // Optional, clients must connect over TLS
+	Recorder  *recorder.Recorder // Optional, captures the bytes of every user stream
+	Webhook   *webhook.Notifier  // Optional, notified of connections and tunnels opening and closing
+
+	WriteTimeout time.Duration // Optional, how long a write to a client may take, defaults to helper.DefaultWriteTimeout
+
+	WebSocketAddr string // Optional, also accept clients as WebSocket upgrades on this address, wss if TLSConfig is set
+	WebSocketPath string // Optional, the HTTP path clients upgrade on, defaults to DefaultWebSocketPath
+
+	UserCerts *CertStore // Optional, certificates for https tunnels, whose users' TLS the server terminates
+
+	SSHAddr    string     // Optional, also accept tunnels from ssh -R on this address
+	SSHHostKey ssh.Signer // Optional, the key the ssh front end proves itself with, a new one every start if nil
+
+	reg            *registry
+	clientListener net.Listener
+	wsListener     net.Listener // Nil unless WebSocketAddr is set
+	sshListener    net.Listener // Nil unless SSHAddr is set
+	sshMu          sync.Mutex
+	sshClients     map[*sshClient]bool // Nil once the server shuts down
+	userIP         net.IP
+	config         *Config // Set by Configure, for Reload to compare against
+	policyMu       sync.Mutex
+	policy         *Policy
+	wg             sync.WaitGroup
 }
 
 func (s *GoRpsServer) Start() (*net.TCPAddr, error) {
-	s.UserConn = make(map[int32]*net.TCPConn)
-	s.UserId = make(map[*net.TCPConn]int32)
-	s.clientToUserConn = make(map[*net.TCPConn][]*net.TCPConn)
-	s.clientToUserListener = make(map[*net.TCPConn]*net.TCPListener)
+	s.reg = newRegistry()
+
+	addr := s.Addr
+	if addr == "" {
+		port := 34567
+		if os.Getenv("PORT") != "" {
+			port, _ = strconv.Atoi(os.Getenv("PORT"))
+		}
+		// IPv4 and IPv6 both, where the host has them
+		addr = ":" + strconv.Itoa(port)
+	}
+	address, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
 
-	port := 34567
-	if os.Getenv("PORT") != "" {
-		port, _ = strconv.Atoi(os.Getenv("PORT"))
+	if s.UserAddr != "" {
+		userAddress, err := net.ResolveIPAddr("ip", s.UserAddr)
+		if err != nil {
+			return nil, err
+		}
+		s.userIP = userAddress.IP
 	}
-	address := &net.TCPAddr{
-		IP:   net.IPv4(0, 0, 0, 0),
-		Port: port,
+	if !s.PortRange.any() && (s.PortRange.Min < 1 || s.PortRange.Max > 65535 || s.PortRange.Min > s.PortRange.Max) {
+		return nil, fmt.Errorf("Invalid port range %s", s.PortRange)
 	}
 
-	var err error
-	s.clientListener, err = net.ListenTCP("tcp", address)
+	listener, err := net.ListenTCP("tcp", address)
 	if err != nil {
 		return nil, err
 	}
+	s.clientListener = listener
+	if s.TLSConfig != nil {
+		s.clientListener = tls.NewListener(listener, s.TLSConfig)
+	}
+
+	// Clients that can only get out over HTTP come in through a WebSocket,
+	// then go through the same hello as everyone else
+	if s.WebSocketAddr != "" {
+		wsListener, err := s.listenForWebSockets()
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		s.wsListener = wsListener
+		s.spawn(func() {
+			s.listenForClients(s.wsListener)
+		})
+	}
+
+	// Teammates without rps_cli open tunnels with ssh -R
+	if s.SSHAddr != "" {
+		sshListener, err := s.listenForSSH()
+		if err != nil {
+			listener.Close()
+			if s.wsListener != nil {
+				s.wsListener.Close()
+			}
+			return nil, err
+		}
+		s.sshListener = sshListener
+		s.spawn(s.acceptSSH)
+	}
 
 	// Listen for clients
-	go s.listenForClients()
+	s.spawn(func() {
+		s.listenForClients(s.clientListener)
+	})
 
 	// Convert net.Addr to *net.TCPAddr and return
 	clientListenerAddr, err := net.ResolveTCPAddr("tcp", s.clientListener.Addr().String())
@@ -53,250 +138,655 @@ func (s *GoRpsServer) Start() (*net.TCPAddr, error) {
 	return clientListenerAddr, nil
 }
 
-func (s *GoRpsServer) listenForClients() {
-	log.Printf("RPS Server listening for clients on: %s\n", s.clientListener.Addr().String())
+// Listen for WebSocket upgrades on WebSocketAddr
+func (s *GoRpsServer) listenForWebSockets() (net.Listener, error) {
+	path := s.WebSocketPath
+	if path == "" {
+		path = DefaultWebSocketPath
+	}
+	listener, err := net.Listen("tcp", s.WebSocketAddr)
+	if err != nil {
+		return nil, err
+	}
+	if s.TLSConfig != nil {
+		listener = tls.NewListener(listener, s.TLSConfig)
+	}
+	return transport.NewWebSocketListener(listener, path), nil
+}
+
+// WebSocketTCPAddr is the address clients upgrade to a WebSocket on, nil
+// unless WebSocketAddr was set when the server started
+func (s *GoRpsServer) WebSocketTCPAddr() *net.TCPAddr {
+	if s.wsListener == nil {
+		return nil
+	}
+	return s.wsListener.Addr().(*net.TCPAddr)
+}
+
+func (s *GoRpsServer) listenForClients(clientListener net.Listener) {
+	log.Printf("RPS Server listening for clients on: %s\n", clientListener.Addr().String())
 	for {
 		// Blocks until a client connects
-		clientConn, err := s.clientListener.AcceptTCP()
+		clientConn, err := clientListener.Accept()
 		if err != nil {
 			return
 		}
-		go s.handleClientConn(clientConn)
+		s.notify(&webhook.Event{
+			Type:       webhook.ClientConnected,
+			ClientAddr: clientConn.RemoteAddr().String(),
+		})
+		s.spawn(func() {
+			s.openSession(clientConn)
+		})
+	}
+}
 
-		// Choose a random free port to expose to users
-		address := &net.TCPAddr{
-			IP:   net.IPv4(0, 0, 0, 0),
-			Port: 0,
-		}
+// Check that the client may open a tunnel, then open one for it
+func (s *GoRpsServer) openSession(clientConn net.Conn) {
+	clientAddr := clientConn.RemoteAddr().String()
+	policy := s.currentPolicy()
+	if !policy.clientAllowed(clientConn.RemoteAddr()) {
+		log.Printf("Refusing client from disallowed address: %s\n", clientAddr)
+		s.refuse(clientConn, "Address not allowed")
+		return
+	}
 
-		// Create a listener for that port, and extract the chosen port
-		userListener, err := net.ListenTCP("tcp", address)
-		addr, err := net.ResolveTCPAddr("tcp", userListener.Addr().String())
-		exposedPort := addr.Port
+	// The client says hello first, presenting its token
+	if !s.reg.addPending(clientConn) {
+		clientConn.Close()
+		return
+	}
+	clientConn.SetReadDeadline(time.Now().Add(helloTimeout))
+	hello, err := helper.ReceiveProtobuf(clientConn)
+	clientConn.SetReadDeadline(time.Time{})
+	if !s.reg.removePending(clientConn) {
+		// Closed by Shutdown
+		return
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		// Clients from before frames wait for the server to speak first
+		log.Printf("No hello from client %s, it may be too old for this server and need upgrading\n", clientAddr)
+		clientConn.Close()
+		return
+	}
+	if err != nil {
+		log.Printf("Error receiving hello from client: %s\n", err.Error())
+		clientConn.Close()
+		return
+	}
+	if !policy.authorized(hello.Token) {
+		log.Printf("Refusing client with invalid token: %s\n", clientAddr)
+		s.notify(&webhook.Event{
+			Type:       webhook.AuthFailed,
+			ClientAddr: clientAddr,
+			Reason:     "invalid token",
+		})
+		s.refuse(clientConn, "Invalid token")
+		return
+	}
+	if hello.Visit != "" {
+		s.visit(clientConn, hello, policy)
+		return
+	}
 
-		// Tell client the exposed port
-		portStr := strconv.Itoa(exposedPort)
-		msg := &pb.TestMessage{
-			Type: pb.TestMessage_ConnectionOpen,
-			Data: []byte(portStr),
-			Id:   -1,
+	// Expose the port the client asked for, or a random free one
+	requestedPort := 0
+	if len(hello.Data) > 0 {
+		requestedPort, err = strconv.Atoi(string(hello.Data))
+		if err != nil || requestedPort < 0 || requestedPort > 65535 {
+			s.refuse(clientConn, fmt.Sprintf("Invalid port %q", hello.Data))
+			return
 		}
-		bytes, err := proto.Marshal(msg)
-		if err != nil {
-			log.Println(err.Error())
+	}
+	if hello.Protocol == "https" && (s.UserCerts == nil || s.UserCerts.empty()) {
+		s.refuse(clientConn, errNoCertificates.Error())
+		return
+	}
+	// Clients naming the same group share its port, the first one creates it
+	want := group{name: hello.Group, token: hello.Token}
+	if hello.Private != "" {
+		if hello.Secret == "" || hello.Group != "" {
+			s.refuse(clientConn, "Private tunnels need a secret and no group")
 			return
 		}
+		want = group{name: hello.Private, token: hello.Token, private: true, secret: hello.Secret}
+	}
+	sess, created, err := s.reg.addSession(clientConn, want, requestedPort, policy.MaxTunnels, func() (*net.TCPListener, error) {
+		return listenForUsersOn(s.userIP, requestedPort, s.PortRange)
+	})
+	if err != nil {
+		log.Printf("Refusing client %s: %s\n", clientAddr, err.Error())
+		s.refuse(clientConn, err.Error())
+		return
+	}
+	exposedPort := sess.group.exposedPort
+	if created {
+		sess.group.http = hello.Protocol == "http" || hello.Protocol == "https"
+		sess.group.tls = hello.Protocol == "https"
+		sess.group.socks = hello.Protocol == "socks5"
+	}
 
-		// Tell the client what port is exposed to users for their connection
-		clientConn.Write(bytes)
+	// Tell the client what port is exposed to users for their connection,
+	// and how their streams will be carried
+	name := transport.Choose(hello.Transport)
+	msg := &pb.TestMessage{
+		Type:      pb.TestMessage_ConnectionOpen,
+		Data:      []byte(strconv.Itoa(exposedPort)),
+		Id:        -1,
+		Transport: name,
+	}
+	clientConn.SetWriteDeadline(time.Now().Add(helloTimeout))
+	err = helper.SendProtobuf(clientConn, msg)
+	clientConn.SetWriteDeadline(time.Time{})
+	var t transport.Session
+	if err == nil {
+		t, err = transport.New(name, clientConn, true, s.WriteTimeout)
+	}
+	if err != nil {
+		log.Printf("Error opening tunnel for client %s: %s\n", clientAddr, err.Error())
+		s.closeSession(clientConn, "client disconnected")
+		return
+	}
+	if !s.reg.setTransport(sess, t) {
+		// Shutting down or draining
+		t.Close()
+		s.closeSession(clientConn, "server draining")
+		return
+	}
 
-		// Each client is associated with one user listener, and possibly multiple users
-		s.clientToUserListener[clientConn] = userListener
+	// Start listening for users on that port, unless the group already is
+	switch {
+	case !created:
+		log.Printf("Client %s joined group %s on port %d\n", clientAddr, sess.group.name, exposedPort)
+	case sess.group.private:
+		log.Printf("Client %s published private tunnel %s\n", clientAddr, sess.group.name)
+	default:
+		s.spawn(func() {
+			s.listenForUsers(sess.group)
+		})
+	}
+	s.notify(&webhook.Event{
+		Type:        webhook.TunnelOpened,
+		ClientAddr:  clientAddr,
+		ExposedPort: exposedPort,
+		Group:       sess.group.name,
+	})
+	s.handleClientConn(sess)
+}
 
-		// Start listening for users on that port, for the new client
-		go s.listenForUsers(userListener, exposedPort, clientConn)
+// Tell a client why it can't have a tunnel, then hang up
+func (s *GoRpsServer) refuse(clientConn net.Conn, reason string) {
+	msg := &pb.TestMessage{
+		Type: pb.TestMessage_ConnectionClose,
+		Data: []byte(reason),
+		Id:   -1,
 	}
+	clientConn.SetWriteDeadline(time.Now().Add(helloTimeout))
+	helper.SendProtobuf(clientConn, msg)
+	clientConn.Close()
 }
 
-func (s *GoRpsServer) listenForUsers(userListener *net.TCPListener, exposedPort int, clientConn *net.TCPConn) {
-	log.Printf("Server listening for users on: %s\n", userListener.Addr().String())
+func (s *GoRpsServer) listenForUsers(grp *group) {
+	log.Printf("Server listening for users on: %s\n", grp.userListener.Addr().String())
 	for {
 		// Listen for a user connection
-		userConn, err := userListener.AcceptTCP()
+		tcpConn, err := grp.userListener.AcceptTCP()
 		if err != nil {
 			log.Println(err.Error())
 			return
 		}
+		// The tunnel carries what users of https tunnels send in plaintext
+		var userConn net.Conn = tcpConn
+		if grp.tls {
+			userConn = tls.Server(tcpConn, s.UserCerts.tlsConfig())
+		}
 
-		log.Println("User connection established")
-
-		// User memory address as ID
-		addrStr := fmt.Sprintf("%x", userConn)
-		id, err := strconv.ParseInt(addrStr[3:len(addrStr)-2], 16, 64)
-		if err != nil {
-			log.Printf("Error converting addr to id: %s\n", err.Error())
+		policy := s.currentPolicy()
+		if !policy.userAllowed(userConn.RemoteAddr()) {
+			log.Printf("Refusing user from disallowed address: %s\n", userConn.RemoteAddr().String())
+			s.refuseUser(grp, userConn, http.StatusForbidden, "Address not allowed")
 			continue
 		}
-		id32 := int32(id)
 
-		s.UserConn[id32] = userConn
-		s.UserId[userConn] = id32
-		s.clientToUserConn[clientConn] = append(s.clientToUserConn[clientConn], userConn)
-
-		// Tell client to open a connection for user <id>
-		msg := &pb.TestMessage{
-			Type: pb.TestMessage_ConnectionOpen,
-			Id:   id32,
-			Data: []byte(pb.TestMessage_ConnectionOpen.String()),
+		sess, id, err := s.reg.addStream(grp, userConn, policy.MaxUsersPerTunnel, s.Balance)
+		if err == errTooManyUsers || err == errUnhealthy {
+			log.Printf("Refusing user on port %d: %s\n", grp.exposedPort, err.Error())
+			s.refuseUser(grp, userConn, http.StatusServiceUnavailable, err.Error())
+			continue
+		}
+		if err != nil {
+			// The tunnel closed while this user was connecting
+			userConn.Close()
+			return
 		}
-		sendToClient(msg, clientConn)
+		s.userConnected(sess, id, userConn)
+		s.spawn(func() {
+			s.serveUser(sess, id, userConn)
+		})
+	}
+}
+
+// Relay a visitor of a private tunnel to one of its clients. Once the
+// visitor is told it may go ahead, its connection carries the user's bytes
+// like one from a public port.
+func (s *GoRpsServer) visit(visitorConn net.Conn, hello *pb.TestMessage, policy *Policy) {
+	grp, err := s.reg.privateGroup(hello.Visit, hello.Secret)
+	if err != nil {
+		log.Printf("Refusing visitor %s: %s\n", visitorConn.RemoteAddr().String(), err.Error())
+		s.refuse(visitorConn, err.Error())
+		return
+	}
+	sess, id, err := s.reg.addStream(grp, visitorConn, policy.MaxUsersPerTunnel, s.Balance)
+	if err != nil {
+		log.Printf("Refusing visitor of %s: %s\n", grp.name, err.Error())
+		s.refuse(visitorConn, err.Error())
+		return
+	}
+	msg := &pb.TestMessage{
+		Type: pb.TestMessage_ConnectionOpen,
+		Id:   -1,
+	}
+	visitorConn.SetWriteDeadline(time.Now().Add(helloTimeout))
+	err = helper.SendProtobuf(visitorConn, msg)
+	visitorConn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		log.Printf("Error answering visitor: %s\n", err.Error())
+		s.closeStream(sess, id, nil, "")
+		return
+	}
+	s.userConnected(sess, id, visitorConn)
+	s.serveUser(sess, id, visitorConn)
+}
 
-		go s.handleUserConn(userConn, clientConn)
+// Record that user <id> got a stream on sess
+func (s *GoRpsServer) userConnected(sess *session, id int32, userConn net.Conn) {
+	log.Println("User connection established")
+	if s.Recorder != nil {
+		s.Recorder.Opened(id)
 	}
+	s.notify(&webhook.Event{
+		Type:        webhook.UserConnected,
+		ClientAddr:  sess.clientConn.RemoteAddr().String(),
+		ExposedPort: sess.group.exposedPort,
+		Group:       sess.group.name,
+		UserId:      id,
+		UserAddr:    userConn.RemoteAddr().String(),
+	})
 }
 
 func (s *GoRpsServer) Stop() (err error) {
-	// Close all user listeners first
-	for _, userListener := range s.clientToUserListener {
-		err = userListener.Close()
-		if err != nil {
-			return err
+	return s.Shutdown(context.Background())
+}
+
+// Shutdown closes every listener and connection, then waits for all of the
+// server's goroutines to exit or for ctx to end. Every error encountered
+// along the way is returned together.
+func (s *GoRpsServer) Shutdown(ctx context.Context) error {
+	var errs []error
+	closeAll := func(closer io.Closer) {
+		err := closer.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
 		}
 	}
 
-	// Close the client listener
-	err = s.clientListener.Close()
+	// Stop accepting clients
+	closeAll(s.clientListener)
+	if s.wsListener != nil {
+		closeAll(s.wsListener)
+	}
+	if s.sshListener != nil {
+		closeAll(s.sshListener)
+	}
+
+	// Close every tunnel along with its users
+	sessions, pending := s.reg.closeAll()
+	for _, clientConn := range pending {
+		closeAll(clientConn)
+	}
+	for _, sess := range sessions {
+		// Members of a group share its listener, it's only closed once
+		closeAll(sess.group)
+		for id, userConn := range sess.streams {
+			closeAll(userConn)
+			s.streamClosed(id, sess.clientConn, "")
+		}
+		if sess.transport != nil {
+			closeAll(sess.transport)
+		} else {
+			closeAll(sess.clientConn)
+		}
+		s.tunnelClosed(sess, "server shutting down")
+	}
+	s.closeSSHClients()
+
+	err := helper.Wait(ctx, &s.wg)
 	if err != nil {
-		log.Printf("Error closing client listener: %s\n", err.Error())
+		errs = append(errs, err)
 	}
+	return errors.Join(errs...)
+}
 
-	// Close all existing client connections and their associated user connections
-	for clientConn, userConns := range s.clientToUserConn {
-		for _, userConn := range userConns {
-			err = userConn.Close()
-			if err != nil {
-				log.Printf("Error closing user conn: %s\n", err.Error())
-				return err
-			}
+// Drain stops accepting new clients and users, and tells connected clients
+// to re-open their tunnels elsewhere. Users already connected carry on until
+// they disconnect or ctx ends, then the server shuts down.
+func (s *GoRpsServer) Drain(ctx context.Context) error {
+	log.Printf("Draining server\n")
+	var errs []error
+	err := s.clientListener.Close()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		errs = append(errs, err)
+	}
+	for _, listener := range []net.Listener{s.wsListener, s.sshListener} {
+		if listener == nil {
+			continue
 		}
-		err = clientConn.Close()
+		err = listener.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+
+	sessions, idle := s.reg.drain()
+	for _, sess := range sessions {
+		err = sess.group.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+		msg := &pb.TestMessage{
+			Type: pb.TestMessage_Drain,
+			Data: []byte(pb.TestMessage_Drain.String()),
+			Id:   -1,
+		}
+		err = sess.transport.Send(msg)
 		if err != nil {
-			log.Printf("Error closing client conn: %s\n", err.Error())
-			return err
+			log.Printf("Error sending drain notice to client: %s\n", err.Error())
 		}
 	}
 
-	s.clientToUserConn = make(map[*net.TCPConn][]*net.TCPConn)
-	s.clientToUserListener = make(map[*net.TCPConn]*net.TCPListener)
-	return nil
+	// Wait for the remaining users
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		log.Printf("Drain timed out, disconnecting remaining users\n")
+		errs = append(errs, ctx.Err())
+		ctx = context.Background()
+	}
+
+	err = s.Shutdown(ctx)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Run f in a goroutine that Shutdown waits for
+func (s *GoRpsServer) spawn(f func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
 }
 
-func (s *GoRpsServer) handleClientConn(clientConn *net.TCPConn) {
+func (s *GoRpsServer) handleClientConn(sess *session) {
+	clientConn := sess.clientConn
 	for {
-		// Blocks until we receive some data from client
-		msg, err := helper.ReceiveProtobuf(clientConn)
+		// Blocks until the client sends a control message
+		msg, err := sess.transport.Receive()
 		if err != nil {
-			if err == io.EOF {
-				err = clientConn.Close()
-				if err != nil {
-					log.Printf("Error closing client connection: %s\n", clientConn)
-				}
-				s.clientDisconnected(clientConn)
-				return
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Error receiving from client: %s\n", err.Error())
 			}
-			log.Printf("Error receiving from client: %s\n", err.Error())
+			s.closeSession(clientConn, "client disconnected")
 			return
 		}
 
 		switch msg.Type {
-		// Client told us that protected server has disconnected
-		// We need to disconnect all users associated with this client
+		// Client has stopped, disconnect all of its users
 		case pb.TestMessage_ConnectionClose:
 			{
-				// Close user listener
-				err = s.clientToUserListener[clientConn].Close()
-				if err != nil {
-					log.Printf("Error closing user listener: %s\n", err.Error())
-				}
-				delete(s.clientToUserListener, clientConn)
-
-				// Close all user connections associated with client
-				for _, userConn := range s.clientToUserConn[clientConn] {
-					err = userConn.Close()
-					if err != nil {
-						log.Printf("Error closing connection for user <%d>: %s\n", s.UserId[userConn], err.Error())
-					}
-				}
-				delete(s.clientToUserConn, clientConn)
-
-				// Close client connection
-				err = clientConn.Close()
-				if err != nil {
-					log.Printf("Error closing connection for client: %s\n", err.Error())
-				}
+				s.closeSession(clientConn, "client stopped")
 				return
 			}
 
-		// Forward data from client to user
-		case pb.TestMessage_Data:
+		// Client's protected server went down or came back up
+		case pb.TestMessage_Health:
 			{
-				_, err = s.UserConn[msg.Id].Write([]byte(msg.Data))
-				if err != nil {
-					log.Printf("Error writing to user: %s\n", err.Error())
-					return
+				if len(msg.Data) > 0 {
+					log.Printf("Protected server of client %s is unhealthy: %s\n", clientConn.RemoteAddr().String(), msg.Data)
+				} else {
+					log.Printf("Protected server of client %s is healthy\n", clientConn.RemoteAddr().String())
 				}
+				s.reg.setHealth(clientConn, string(msg.Data))
 				break
 			}
 		}
-
 	}
 }
 
-func (s *GoRpsServer) handleUserConn(userConn *net.TCPConn, clientConn *net.TCPConn) {
-	userId := s.UserId[userConn]
-	for {
-		// Blocks until we receive data from user
-		// Generates a protobuf msg with the user's data as the msg.Data field
-		msg, err := helper.GenerateProtobuf(userConn, userId)
+// Carry user <id>'s bytes to and from the client over a stream of their own.
+// Users of a socks5 group first say where they want to go, and the client
+// answers them once it has connected.
+func (s *GoRpsServer) serveUser(sess *session, id int32, userConn net.Conn) {
+	if tlsConn, ok := userConn.(*tls.Conn); ok && sess.group.tls {
+		tlsConn.SetDeadline(time.Now().Add(helloTimeout))
+		err := tlsConn.Handshake()
+		tlsConn.SetDeadline(time.Time{})
 		if err != nil {
-			if err == io.EOF {
-				log.Printf("User <%d> has disconnected.\n", userId)
-				err = userConn.Close()
-				if err != nil {
-					log.Printf("Error closing connection for user <%d>: %s\n", userId, err.Error())
-					return
-				}
-				log.Printf("User <%d> connection successfully closed.\n", userId)
-				s.userDisconnected(userId, clientConn)
-				return
+			log.Printf("Error in TLS handshake with user <%d>: %s\n", id, err.Error())
+			s.closeStream(sess, id, nil, "")
+			return
+		}
+	}
+	var target string
+	if sess.group.socks {
+		var err error
+		userConn.SetDeadline(time.Now().Add(helloTimeout))
+		target, err = helper.ReadSOCKSRequest(userConn)
+		userConn.SetDeadline(time.Time{})
+		if err != nil {
+			log.Printf("Error reading SOCKS request from user <%d>: %s\n", id, err.Error())
+			s.closeStream(sess, id, nil, "")
+			return
+		}
+	}
+	t := s.reg.waitTransport(sess)
+	if t == nil {
+		s.closeStream(sess, id, nil, "")
+		return
+	}
+	stream, err := t.Open(id, userConn.RemoteAddr().String(), target)
+	if err != nil {
+		log.Printf("Error opening stream for user <%d>: %s\n", id, err.Error())
+		s.closeStream(sess, id, nil, "")
+		return
+	}
+
+	// Forward data from client to user
+	s.spawn(func() {
+		_, err := io.Copy(&helper.Tap{Writer: userConn, See: s.record(id, recorder.Outbound)}, stream)
+		var reset *helper.ResetError
+		if errors.As(err, &reset) {
+			// Client gave up on this user's stream, e.g. it couldn't reach
+			// the protected server
+			if s.closeStream(sess, id, stream, reset.Error()) {
+				log.Printf("Resetting connection for user <%d>: %s\n", id, reset.Error())
 			}
-			log.Printf("Error receving from user: %s\n", err.Error())
 			return
 		}
+		if s.closeStream(sess, id, stream, "") && err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Error writing to user: %s\n", err.Error())
+		}
+	})
 
-		// Forward data to associated client
-		err = sendToClient(msg, clientConn)
-		if err != nil {
-			log.Printf("Error forwarding data to client: %s\n", err.Error())
+	// Forward data from user to client
+	_, err = io.Copy(&helper.Tap{Writer: stream, See: s.record(id, recorder.Inbound)}, userConn)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("Error receving from user: %s\n", err.Error())
+	}
+	if s.closeStream(sess, id, stream, "") {
+		log.Printf("User <%d> has disconnected.\n", id)
+	}
+}
+
+// Record the bytes of user <id> going in the given direction
+func (s *GoRpsServer) record(id int32, dir recorder.Direction) func([]byte) {
+	return func(data []byte) {
+		if s.Recorder != nil {
+			s.Recorder.Data(id, dir, data)
 		}
 	}
 }
 
-func (s *GoRpsServer) userDisconnected(userId int32, clientConn *net.TCPConn) {
-	// Tell client a user disconnected
-	msg := &pb.TestMessage{
-		Type: pb.TestMessage_ConnectionClose,
-		Data: []byte(pb.TestMessage_ConnectionClose.String()),
-		Id:   userId,
+// Disconnect user <id> and close their stream, unless that was already
+// done. reason says why the stream was reset, if it was. Returns whether
+// it was done here.
+func (s *GoRpsServer) closeStream(sess *session, id int32, stream transport.Stream, reason string) bool {
+	userConn := s.reg.removeStream(sess.clientConn, id)
+	if userConn == nil {
+		return false
 	}
-	err := sendToClient(msg, clientConn)
+	err := userConn.Close()
 	if err != nil {
-		log.Printf("Error forwarding data to client: %s\n", err.Error())
+		log.Printf("Error closing connection for user <%d>: %s\n", id, err.Error())
+	}
+	if stream != nil {
+		stream.Close()
 	}
+	s.streamClosed(id, sess.clientConn, reason)
+	return true
 }
 
-func (s *GoRpsServer) clientDisconnected(clientConn *net.TCPConn) {
-	// Close user listener associated with client
-	err := s.clientToUserListener[clientConn].Close()
-	if err != nil {
-		log.Printf("Error closing user listener: %s\n", err.Error())
+// Clean up after the stream for user <userId> has ended, reason is why it was
+// reset if it was
+func (s *GoRpsServer) streamClosed(userId int32, clientConn net.Conn, reason string) {
+	if s.Recorder != nil {
+		s.Recorder.Closed(userId)
+	}
+	s.notify(&webhook.Event{
+		Type:       webhook.UserDisconnected,
+		ClientAddr: clientConn.RemoteAddr().String(),
+		UserId:     userId,
+		Reason:     reason,
+	})
+}
+
+// Close the tunnel of clientConn and disconnect all of its users
+func (s *GoRpsServer) closeSession(clientConn net.Conn, reason string) {
+	sess, last := s.reg.removeSession(clientConn)
+	if sess == nil {
+		// Already closed, e.g. by Shutdown
+		return
+	}
+
+	// The rest of the group keeps serving users. The listener is already
+	// closed if the server is draining.
+	if last {
+		err := sess.group.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Error closing user listener: %s\n", err.Error())
+		}
+	}
+	var err error
+	for id, userConn := range sess.streams {
+		err = userConn.Close()
+		if err != nil {
+			log.Printf("Error closing connection for user <%d>: %s\n", id, err.Error())
+		}
+		s.streamClosed(id, clientConn, "")
 	}
+	if sess.transport != nil {
+		err = sess.transport.Close()
+	} else {
+		err = clientConn.Close()
+	}
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("Error closing connection for client: %s\n", err.Error())
+	}
+	s.tunnelClosed(sess, reason)
+}
+
+// Report that the tunnel of sess has closed, reason says why
+func (s *GoRpsServer) tunnelClosed(sess *session, reason string) {
+	s.notify(&webhook.Event{
+		Type:        webhook.TunnelClosed,
+		ClientAddr:  sess.clientConn.RemoteAddr().String(),
+		ExposedPort: sess.group.exposedPort,
+		Group:       sess.group.name,
+		Reason:      reason,
+	})
+}
 
-	// Disconnect all users associated with client
-	for _, userConn := range s.clientToUserConn[clientConn] {
-		err := userConn.Close()
+// Turn away a user that won't get a stream. Users of HTTP groups get an
+// error page saying why, users of SOCKS5 groups a failed reply, and
+// everyone else is just disconnected.
+func (s *GoRpsServer) refuseUser(grp *group, userConn net.Conn, status int, reason string) {
+	switch {
+	case grp.http:
+		s.spawn(func() {
+			answerRefused(userConn, helper.ErrorResponse(status, reason))
+		})
+	case grp.socks:
+		reply := helper.SOCKSReply(helper.SOCKSGeneralFailure)
+		if status == http.StatusForbidden {
+			reply = helper.SOCKSReply(helper.SOCKSNotAllowed)
+		}
+		s.spawn(func() {
+			answerSOCKSRefused(userConn, reply)
+		})
+	default:
+		userConn.Close()
+	}
+}
+
+// Answer an HTTP user with response and hang up. HTTP clients discard a
+// response that comes before their request, so its headers are read first.
+// The rest is read after, as closing with it unread would reset the
+// connection and lose the reply.
+func answerRefused(userConn net.Conn, response []byte) {
+	defer userConn.Close()
+	userConn.SetDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(userConn)
+	for {
+		line, err := reader.ReadString('\n')
 		if err != nil {
-			log.Printf("Error closing connection for user <%d>\n", s.UserId[userConn])
+			return
+		}
+		if line == "\r\n" || line == "\n" {
+			break
 		}
 	}
+	_, err := userConn.Write(response)
+	if err != nil {
+		return
+	}
+	if closer, ok := userConn.(interface{ CloseWrite() error }); ok {
+		closer.CloseWrite()
+	}
+	io.Copy(io.Discard, reader)
 }
 
-func sendToClient(msg *pb.TestMessage, clientConn *net.TCPConn) error {
-	out, err := proto.Marshal(msg)
+// Answer a SOCKS5 user's connect request with reply and hang up
+func answerSOCKSRefused(userConn net.Conn, reply []byte) {
+	defer userConn.Close()
+	userConn.SetDeadline(time.Now().Add(time.Second))
+	_, err := helper.ReadSOCKSRequest(userConn)
 	if err != nil {
-		return err
+		return
+	}
+	userConn.Write(reply)
+}
+
+func listenerPort(listener *net.TCPListener) int {
+	if listener == nil {
+		return 0
+	}
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *GoRpsServer) notify(event *webhook.Event) {
+	if s.Webhook != nil {
+		s.Webhook.Notify(event)
 	}
-	// Forward data to the associated client
-	_, err = clientConn.Write(out)
-	return err
 }
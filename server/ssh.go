@@ -0,0 +1,500 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	pb "github.com/andysctu/go-tunnel/protobuf"
+	"github.com/andysctu/go-tunnel/transport"
+	"github.com/andysctu/go-tunnel/webhook"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errUnknownKey = errors.New("Key not authorized")
+
+// LoadSSHHostKey reads the private key the ssh front end proves itself
+// with, e.g. one made by ssh-keygen
+func LoadSSHHostKey(path string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+// ParseAuthorizedKeys parses keys in the format of ~/.ssh/authorized_keys
+func ParseAuthorizedKeys(data []byte) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+1, err.Error())
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Whether key may log in over ssh. Anyone may if the policy names neither
+// keys nor tokens, as with clients of rps_cli.
+func (p *Policy) keyAuthorized(key ssh.PublicKey) bool {
+	if len(p.AuthorizedKeys) == 0 {
+		return len(p.Tokens) == 0
+	}
+	for _, k := range p.AuthorizedKeys {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Listen for ssh clients on SSHAddr, making up a host key if there is none
+func (s *GoRpsServer) listenForSSH() (net.Listener, error) {
+	if s.SSHHostKey == nil {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		s.SSHHostKey, err = ssh.NewSignerFromKey(key)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Generated SSH host key %s, set one to keep it across restarts\n", ssh.FingerprintSHA256(s.SSHHostKey.PublicKey()))
+	}
+	s.sshClients = make(map[*sshClient]bool)
+	return net.Listen("tcp", s.SSHAddr)
+}
+
+// SSHTCPAddr is the address ssh clients connect to, nil unless SSHAddr was
+// set when the server started
+func (s *GoRpsServer) SSHTCPAddr() *net.TCPAddr {
+	if s.sshListener == nil {
+		return nil
+	}
+	return s.sshListener.Addr().(*net.TCPAddr)
+}
+
+func (s *GoRpsServer) acceptSSH() {
+	log.Printf("RPS Server listening for ssh clients on: %s\n", s.sshListener.Addr().String())
+	for {
+		netConn, err := s.sshListener.Accept()
+		if err != nil {
+			return
+		}
+		s.notify(&webhook.Event{
+			Type:       webhook.ClientConnected,
+			ClientAddr: netConn.RemoteAddr().String(),
+		})
+		s.spawn(func() {
+			s.serveSSH(netConn)
+		})
+	}
+}
+
+// An sshClient is one ssh connection, which may carry any number of
+// tunnels, one for each remote forward it asks for
+type sshClient struct {
+	conn    *ssh.ServerConn
+	netConn net.Conn
+
+	mu       sync.Mutex
+	forwards map[string]*sshForward // By bind address and exposed port
+	shells   []ssh.Channel
+	notices  []string // Everything told to the shells so far, for ones opened later
+}
+
+// Log in an ssh client, then open a tunnel for every remote forward it asks
+// for until it disconnects
+func (s *GoRpsServer) serveSSH(netConn net.Conn) {
+	clientAddr := netConn.RemoteAddr().String()
+	policy := s.currentPolicy()
+	if !policy.clientAllowed(netConn.RemoteAddr()) {
+		log.Printf("Refusing ssh client from disallowed address: %s\n", clientAddr)
+		netConn.Close()
+		return
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !policy.keyAuthorized(key) {
+				return nil, errUnknownKey
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"fingerprint": ssh.FingerprintSHA256(key)}}, nil
+		},
+	}
+	config.AddHostKey(s.SSHHostKey)
+
+	if !s.reg.addPending(netConn) {
+		netConn.Close()
+		return
+	}
+	netConn.SetDeadline(time.Now().Add(helloTimeout))
+	conn, chans, reqs, err := ssh.NewServerConn(netConn, config)
+	netConn.SetDeadline(time.Time{})
+	if !s.reg.removePending(netConn) {
+		// Closed by Shutdown
+		return
+	}
+	if err != nil {
+		log.Printf("Error logging in ssh client %s: %s\n", clientAddr, err.Error())
+		var authErr *ssh.ServerAuthError
+		if errors.As(err, &authErr) {
+			s.notify(&webhook.Event{
+				Type:       webhook.AuthFailed,
+				ClientAddr: clientAddr,
+				Reason:     "invalid key",
+			})
+		}
+		netConn.Close()
+		return
+	}
+
+	client := &sshClient{conn: conn, netConn: netConn, forwards: make(map[string]*sshForward)}
+	if !s.addSSHClient(client) {
+		conn.Close()
+		return
+	}
+	defer s.removeSSHClient(client)
+	log.Printf("SSH client %s logged in as %s with key %s\n", clientAddr, conn.User(), conn.Permissions.Extensions["fingerprint"])
+
+	s.spawn(func() {
+		s.serveSSHChannels(client, chans)
+	})
+	for req := range reqs {
+		s.handleSSHRequest(client, req)
+	}
+
+	// The connection is gone and its tunnels with it
+	client.mu.Lock()
+	forwards := client.forwards
+	client.forwards = nil
+	client.mu.Unlock()
+	for _, fwd := range forwards {
+		fwd.Close()
+	}
+	conn.Close()
+}
+
+// Track client so Shutdown can hang up on it. Returns false if the server
+// is shutting down.
+func (s *GoRpsServer) addSSHClient(client *sshClient) bool {
+	s.sshMu.Lock()
+	defer s.sshMu.Unlock()
+	if s.sshClients == nil {
+		return false
+	}
+	s.sshClients[client] = true
+	return true
+}
+
+func (s *GoRpsServer) removeSSHClient(client *sshClient) {
+	s.sshMu.Lock()
+	defer s.sshMu.Unlock()
+	delete(s.sshClients, client)
+}
+
+// Hang up on every ssh client and refuse new ones
+func (s *GoRpsServer) closeSSHClients() {
+	s.sshMu.Lock()
+	clients := s.sshClients
+	s.sshClients = nil
+	s.sshMu.Unlock()
+	for client := range clients {
+		client.conn.Close()
+	}
+}
+
+// The payloads of tcpip-forward and cancel-tcpip-forward, RFC 4254
+type forwardRequest struct {
+	Addr string
+	Port uint32
+}
+
+func (s *GoRpsServer) handleSSHRequest(client *sshClient, req *ssh.Request) {
+	switch req.Type {
+	case "tcpip-forward":
+		var want forwardRequest
+		err := ssh.Unmarshal(req.Payload, &want)
+		if err == nil && want.Port > 65535 {
+			err = fmt.Errorf("Invalid port %d", want.Port)
+		}
+		var sess *session
+		if err == nil {
+			sess, err = s.addForward(client, want.Addr, int(want.Port))
+		}
+		if err != nil {
+			log.Printf("Refusing ssh client %s: %s\n", client.netConn.RemoteAddr().String(), err.Error())
+			client.notice("Tunnel refused: " + err.Error())
+			req.Reply(false, nil)
+			return
+		}
+		// Clients asking for any port learn which one they got
+		var reply []byte
+		if want.Port == 0 {
+			reply = ssh.Marshal(&struct{ Port uint32 }{uint32(sess.group.exposedPort)})
+		}
+		req.Reply(true, reply)
+		s.startForward(client, sess)
+	case "cancel-tcpip-forward":
+		var want forwardRequest
+		if ssh.Unmarshal(req.Payload, &want) != nil {
+			req.Reply(false, nil)
+			return
+		}
+		key := net.JoinHostPort(want.Addr, strconv.Itoa(int(want.Port)))
+		client.mu.Lock()
+		fwd := client.forwards[key]
+		delete(client.forwards, key)
+		client.mu.Unlock()
+		if fwd != nil {
+			s.closeSession(fwd.key, "client stopped")
+		}
+		req.Reply(fwd != nil, nil)
+	default:
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// Register a tunnel for a remote forward of client, exposed on port or any
+// port if it is 0
+func (s *GoRpsServer) addForward(client *sshClient, bindAddr string, port int) (*session, error) {
+	fwd := &sshForward{
+		client:   client,
+		bindAddr: bindAddr,
+		key:      &forwardConn{Conn: client.netConn},
+		done:     make(chan struct{}),
+	}
+	policy := s.currentPolicy()
+	sess, _, err := s.reg.addSession(fwd.key, group{}, port, policy.MaxTunnels, func() (*net.TCPListener, error) {
+		return listenForUsersOn(s.userIP, port, s.PortRange)
+	})
+	if err != nil {
+		return nil, err
+	}
+	fwd.port = sess.group.exposedPort
+	if !s.reg.setTransport(sess, fwd) {
+		s.closeSession(fwd.key, "server draining")
+		return nil, errDraining
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.forwards == nil {
+		// The connection closed meanwhile
+		fwd.Close()
+	} else {
+		client.forwards[net.JoinHostPort(bindAddr, strconv.Itoa(fwd.port))] = fwd
+	}
+	return sess, nil
+}
+
+// Start sending users to a tunnel opened by addForward, once the client
+// knows its port
+func (s *GoRpsServer) startForward(client *sshClient, sess *session) {
+	clientAddr := client.netConn.RemoteAddr().String()
+	exposedPort := sess.group.exposedPort
+	log.Printf("SSH client %s opened a tunnel on port %d\n", clientAddr, exposedPort)
+	// Users reach the port on whichever address the client did
+	host, _, _ := net.SplitHostPort(client.netConn.LocalAddr().String())
+	client.notice("Tunnel opened! Go here: " + net.JoinHostPort(host, strconv.Itoa(exposedPort)))
+
+	s.spawn(func() {
+		s.listenForUsers(sess.group)
+	})
+	s.notify(&webhook.Event{
+		Type:        webhook.TunnelOpened,
+		ClientAddr:  clientAddr,
+		ExposedPort: exposedPort,
+	})
+	s.spawn(func() {
+		s.handleClientConn(sess)
+	})
+}
+
+// Ssh clients open a session unless run with -N. It shows them their
+// tunnels, and Ctrl-C in it disconnects.
+func (s *GoRpsServer) serveSSHChannels(client *sshClient, chans <-chan ssh.NewChannel) {
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "Only sessions and remote forwards are supported")
+			continue
+		}
+		shell, reqs, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		s.spawn(func() {
+			for req := range reqs {
+				// Enough for ssh to wait quietly, no command is ever run
+				ok := req.Type == "pty-req" || req.Type == "shell"
+				if req.WantReply {
+					req.Reply(ok, nil)
+				}
+			}
+		})
+		client.addShell(shell)
+		s.spawn(func() {
+			buf := make([]byte, 256)
+			for {
+				n, err := shell.Read(buf)
+				if err != nil || bytes.IndexAny(buf[:n], "\x03\x04") >= 0 {
+					client.conn.Close()
+					return
+				}
+			}
+		})
+	}
+}
+
+func (client *sshClient) addShell(shell ssh.Channel) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.shells = append(client.shells, shell)
+	for _, notice := range client.notices {
+		io.WriteString(shell, notice)
+	}
+}
+
+// Tell the person at the other end of client's shells something
+func (client *sshClient) notice(text string) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	text += "\r\n"
+	client.notices = append(client.notices, text)
+	for _, shell := range client.shells {
+		io.WriteString(shell, text)
+	}
+}
+
+// The registry knows a tunnel by its client's connection, but an ssh client
+// has a tunnel per forward. Each forward gets one of these to stand for the
+// connection, which its transport closes in its place.
+type forwardConn struct {
+	net.Conn
+}
+
+func (fc *forwardConn) Close() error {
+	return nil
+}
+
+// An sshForward carries one remote forward's users, each in a
+// forwarded-tcpip channel. There are no control messages to receive; the
+// forward ends when it is cancelled or the connection goes away.
+type sshForward struct {
+	client   *sshClient
+	key      *forwardConn
+	bindAddr string // As the client asked, it matches channels to forwards with it
+	port     int
+	done     chan struct{}
+	once     sync.Once
+}
+
+func (fwd *sshForward) Send(msg *pb.TestMessage) error {
+	if msg.Type == pb.TestMessage_Drain {
+		fwd.client.notice("RPS server is draining, reconnect to re-open your tunnel")
+	}
+	return nil
+}
+
+func (fwd *sshForward) Receive() (*pb.TestMessage, error) {
+	<-fwd.done
+	return nil, io.EOF
+}
+
+func (fwd *sshForward) Open(id int32, remoteAddr string, target string) (transport.Stream, error) {
+	select {
+	case <-fwd.done:
+		return nil, net.ErrClosed
+	default:
+	}
+	originHost, originPort, _ := net.SplitHostPort(remoteAddr)
+	port, _ := strconv.Atoi(originPort)
+	payload := ssh.Marshal(&struct {
+		Addr       string
+		Port       uint32
+		OriginAddr string
+		OriginPort uint32
+	}{fwd.bindAddr, uint32(fwd.port), originHost, uint32(port)})
+	channel, reqs, err := fwd.client.conn.OpenChannel("forwarded-tcpip", payload)
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	userAddr, err := net.ResolveTCPAddr("tcp", remoteAddr)
+	if err != nil {
+		userAddr = &net.TCPAddr{}
+	}
+	return &sshStream{Channel: channel, id: id, conn: fwd.key, remoteAddr: userAddr}, nil
+}
+
+func (fwd *sshForward) Accept() (transport.Stream, error) {
+	<-fwd.done
+	return nil, net.ErrClosed
+}
+
+// Close ends the forward, leaving the connection to the client's other
+// forwards
+func (fwd *sshForward) Close() error {
+	fwd.once.Do(func() {
+		close(fwd.done)
+	})
+	return nil
+}
+
+// An sshStream is one user's forwarded-tcpip channel
+type sshStream struct {
+	ssh.Channel
+	id         int32
+	conn       net.Conn
+	remoteAddr *net.TCPAddr
+}
+
+func (ss *sshStream) Id() int32 {
+	return ss.id
+}
+
+func (ss *sshStream) Target() string {
+	return ""
+}
+
+// Ssh has no way to say why a channel closed
+func (ss *sshStream) Reset(code pb.TestMessage_ResetCode, reason string) error {
+	return ss.Close()
+}
+
+func (ss *sshStream) LocalAddr() net.Addr {
+	return ss.conn.LocalAddr()
+}
+
+func (ss *sshStream) RemoteAddr() net.Addr {
+	return ss.remoteAddr
+}
+
+// Channels have no deadlines, users are only cut off by closing them
+func (ss *sshStream) SetDeadline(t time.Time) error {
+	return errors.New("Deadlines not supported on ssh channels")
+}
+
+func (ss *sshStream) SetReadDeadline(t time.Time) error {
+	return ss.SetDeadline(t)
+}
+
+func (ss *sshStream) SetWriteDeadline(t time.Time) error {
+	return ss.SetDeadline(t)
+}
@@ -0,0 +1,215 @@
+package go_rps_test
+
+import (
+	"context"
+	"fmt"
+	. "github.com/andysctu/go-tunnel/client"
+	. "github.com/andysctu/go-tunnel/server"
+	"github.com/andysctu/go-tunnel/test/mocks"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("Client config", func() {
+	protectedServer := &mocks.MockProtectedServer{
+		ServerMessage: "Named tunnel",
+		Port:          3004,
+	}
+	protectedServer.StartProtectedServer()
+
+	Describe("Parsing", func() {
+		It("should read the server and every tunnel in order", func() {
+			cfg, err := ParseTunnelsConfig([]byte(`
+server: 127.0.0.1:34567
+token: s3cret
+tunnels:
+  web:
+    target: 8080
+    protocol: http
+    port: 8000
+    auth: admin:hunter2
+    headers:
+      X-Forwarded-Proto: https
+    health_check:
+      interval: 5s
+      path: /healthz
+  db:
+    target: 10.0.0.5:5432
+    token: other
+`))
+			Expect(err).NotTo(HaveOccurred())
+			tunnels, err := cfg.Select(nil, true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tunnels).To(HaveLen(2))
+			Expect(tunnels[0].Name).To(Equal("web"))
+			Expect(tunnels[0].TargetAddr()).To(Equal("localhost:8080"))
+			Expect(tunnels[0].Headers).To(HaveKeyWithValue("X-Forwarded-Proto", "https"))
+			Expect(tunnels[1].Name).To(Equal("db"))
+			Expect(tunnels[1].Protocol).To(Equal("tcp"))
+			Expect(tunnels[1].TargetAddr()).To(Equal("10.0.0.5:5432"))
+
+			web := cfg.Client(tunnels[0])
+			Expect(web.Token).To(Equal("s3cret"))
+			Expect(web.RequestedPort).To(Equal(8000))
+			Expect(web.Protocol).To(Equal("http"))
+			Expect(*web.HealthCheck).To(Equal(HealthCheck{Interval: 5 * time.Second, Path: "/healthz", Addr: "localhost:8080"}))
+			Expect(cfg.Client(tunnels[1]).Token).To(Equal("other"))
+
+			tunnels, err = cfg.Select([]string{"db"}, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tunnels).To(HaveLen(1))
+			_, err = cfg.Select([]string{"nope"}, false)
+			Expect(err).To(MatchError(ContainSubstring(`"nope"`)))
+			_, err = cfg.Select(nil, false)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should point at the offending line", func() {
+			_, err := ParseTunnelsConfig([]byte("server: 127.0.0.1:34567\ntunnels:\n  web:\n    target: 8080\n    protocl: http\n"))
+			Expect(err).To(MatchError(ContainSubstring("line 5")))
+
+			_, err = ParseTunnelsConfig([]byte("server: 127.0.0.1:34567\ntunnels:\n  web:\n    target: 8080\n  db:\n    target: nope\n"))
+			Expect(err).To(MatchError(HavePrefix("line 6: tunnels.db.target")))
+
+			_, err = ParseTunnelsConfig([]byte("server: 127.0.0.1:34567\ntunnels:\n  web:\n    target: 8080\n    auth: admin:hunter2\n"))
+			Expect(err).To(MatchError(HavePrefix("line 5: tunnels.web.auth")))
+
+			_, err = ParseTunnelsConfig([]byte("tunnels:\n  web:\n    target: 8080\n"))
+			Expect(err).To(MatchError(ContainSubstring("server")))
+
+			_, err = ParseTunnelsConfig([]byte("server: 127.0.0.1:34567\nproxy: ftp://proxy:21\ntunnels:\n  web:\n    target: 8080\n"))
+			Expect(err).To(MatchError(HavePrefix("line 2: proxy")))
+
+			_, err = ParseTunnelsConfig([]byte("server: 127.0.0.1:34567\ntunnels:\n  db:\n    target: 5432\n    private: true\n"))
+			Expect(err).To(MatchError(HavePrefix("line 3: tunnels.db.secret")))
+
+			_, err = ParseTunnelsConfig([]byte("server: 127.0.0.1:34567\ntunnels:\n  db:\n    target: 5432\n    https: true\n"))
+			Expect(err).To(MatchError(HavePrefix("line 5: tunnels.db.https")))
+
+			_, err = ParseTunnelsConfig([]byte("server: 127.0.0.1:34567\ntunnels:\n  web:\n    target: 8443\n    target_tls:\n      ca_file: /nonexistent/ca.pem\n"))
+			Expect(err).To(MatchError(HavePrefix("line 5: tunnels.web.target_tls")))
+
+			_, err = ParseTunnelsConfig([]byte("server: 127.0.0.1:34567\ntunnels:\n  office:\n    protocol: socks5\n    target: 8080\n"))
+			Expect(err).To(MatchError(HavePrefix("line 5: tunnels.office.target")))
+
+			_, err = ParseTunnelsConfig([]byte("server: 127.0.0.1:34567\ntunnels:\n  office:\n    protocol: socks5\n    allow: [10.0.0.0/24, nope:port]\n"))
+			Expect(err).To(MatchError(HavePrefix("line 5: tunnels.office.allow")))
+		})
+
+		It("should name the file when loading", func() {
+			dir, err := ioutil.TempDir("", "rps_cli_config")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "rps.yaml")
+			Expect(ioutil.WriteFile(path, []byte("server: 127.0.0.1:34567\ntunnels:\n  web:\n    protocol: http\n"), 0600)).To(Succeed())
+
+			_, err = LoadTunnelsConfig(path)
+			Expect(err).To(MatchError(HavePrefix(path + ": line 3: tunnels.web.target")))
+		})
+	})
+
+	Describe("Opening tunnels", func() {
+		var server *GoRpsServer
+		var serverTCPAddr *net.TCPAddr
+		var clients []*GoRpsClient
+
+		BeforeEach(func() {
+			var err error
+			server = &GoRpsServer{Addr: "127.0.0.1:0"}
+			serverTCPAddr, err = server.Start()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			for _, client := range clients {
+				client.Shutdown(ctx)
+			}
+			clients = nil
+			server.Shutdown(ctx)
+		})
+
+		open := func(config string, name string) (*GoRpsClient, error) {
+			cfg, err := ParseTunnelsConfig([]byte(fmt.Sprintf("server: %s\n%s", serverTCPAddr.String(), config)))
+			Expect(err).NotTo(HaveOccurred())
+			tunnels, err := cfg.Select([]string{name}, false)
+			Expect(err).NotTo(HaveOccurred())
+			client := cfg.Client(tunnels[0])
+			clients = append(clients, client)
+			return client, tunnels[0].Open(client)
+		}
+
+		freePort := func() int {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			defer listener.Close()
+			return listener.Addr().(*net.TCPAddr).Port
+		}
+
+		It("should expose the requested port", func() {
+			port := freePort()
+			client, err := open(fmt.Sprintf("tunnels:\n  echo:\n    target: %d\n    port: %d\n", protectedServer.Port, port), "echo")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(client.ExposedPort).To(Equal(port))
+
+			userConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+			Expect(err).NotTo(HaveOccurred())
+			defer userConn.Close()
+			_, err = userConn.Write([]byte("Hello"))
+			Expect(err).NotTo(HaveOccurred())
+			expected := protectedServer.ServerMessage + ": Hello"
+			bytes := make([]byte, len(expected))
+			userConn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = io.ReadFull(userConn, bytes)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(bytes)).To(Equal(expected))
+
+			// A second tunnel can't have the same port
+			_, err = open(fmt.Sprintf("tunnels:\n  again:\n    target: %d\n    port: %d\n", protectedServer.Port, port), "again")
+			Expect(err).To(MatchError(ContainSubstring(fmt.Sprintf("Port %d unavailable", port))))
+		})
+
+		It("should check auth and set headers on http tunnels", func() {
+			httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				fmt.Fprintf(w, "%s %s", req.Header.Get("X-Tunnel"), req.Header.Get("Authorization"))
+			}))
+			defer httpServer.Close()
+
+			client, err := open(fmt.Sprintf(`tunnels:
+  web:
+    target: %s
+    protocol: http
+    auth: admin:hunter2
+    headers:
+      X-Tunnel: web
+`, httpServer.Listener.Addr().String()), "web")
+			Expect(err).NotTo(HaveOccurred())
+			url := fmt.Sprintf("http://127.0.0.1:%d/", client.ExposedPort)
+
+			res, err := http.Get(url)
+			Expect(err).NotTo(HaveOccurred())
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusUnauthorized))
+
+			req, err := http.NewRequest("GET", url, nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.SetBasicAuth("admin", "hunter2")
+			res, err = http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			body, err := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(string(body)).To(Equal("web "))
+		})
+	})
+})
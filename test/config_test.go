@@ -0,0 +1,335 @@
+package go_rps_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	. "github.com/andysctu/go-tunnel/client"
+	. "github.com/andysctu/go-tunnel/server"
+	"github.com/andysctu/go-tunnel/test/mocks"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var _ = Describe("Server config", func() {
+	protectedServer := &mocks.MockProtectedServer{
+		ServerMessage: "Configured server",
+		Port:          3003,
+	}
+	protectedServer.StartProtectedServer()
+
+	var server *GoRpsServer
+	var serverTCPAddr *net.TCPAddr
+	var clients []*GoRpsClient
+
+	start := func(config string) {
+		cfg, err := ParseConfig([]byte(config))
+		Expect(err).NotTo(HaveOccurred())
+		server = &GoRpsServer{}
+		server.Configure(cfg)
+		serverTCPAddr, err = server.Start()
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	reload := func(config string) {
+		cfg, err := ParseConfig([]byte(config))
+		Expect(err).NotTo(HaveOccurred())
+		server.Reload(cfg)
+	}
+
+	openTunnel := func(client *GoRpsClient) (int, error) {
+		client.ServerTCPAddr = serverTCPAddr
+		clients = append(clients, client)
+		err := client.OpenTunnel(protectedServer.Port)
+		return client.ExposedPort, err
+	}
+
+	dialUser := func(port int) *net.TCPConn {
+		userConn, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+		Expect(err).NotTo(HaveOccurred())
+		return userConn
+	}
+
+	// Returns the error if the user's message doesn't come back
+	echo := func(userConn net.Conn, message string) error {
+		_, err := userConn.Write([]byte(message))
+		if err != nil {
+			return err
+		}
+		expected := protectedServer.ServerMessage + ": " + message
+		bytes := make([]byte, len(expected))
+		userConn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = io.ReadFull(userConn, bytes)
+		if err != nil {
+			return err
+		}
+		Expect(string(bytes)).To(Equal(expected))
+		return nil
+	}
+
+	AfterEach(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		for _, client := range clients {
+			client.Shutdown(ctx)
+		}
+		clients = nil
+		if server != nil {
+			server.Shutdown(ctx)
+			server = nil
+		}
+	})
+
+	Describe("Parsing", func() {
+		It("should read every section", func() {
+			cfg, err := ParseConfig([]byte(`
+listen: 127.0.0.1:0
+auth:
+  tokens: [s3cret]
+limits:
+  max_tunnels: 10
+  max_users_per_tunnel: 2
+allow:
+  clients: [10.0.0.0/8, 127.0.0.1]
+log:
+  file: /tmp/rps.log
+`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Listen).To(Equal("127.0.0.1:0"))
+			Expect(cfg.Log.File).To(Equal("/tmp/rps.log"))
+			policy := cfg.Policy()
+			Expect(policy.Tokens).To(Equal([]string{"s3cret"}))
+			Expect(policy.MaxTunnels).To(Equal(10))
+			Expect(policy.MaxUsersPerTunnel).To(Equal(2))
+			Expect(policy.AllowClients).To(HaveLen(2))
+			Expect(policy.AllowClients[1].String()).To(Equal("127.0.0.1/32"))
+			Expect(policy.AllowUsers).To(BeEmpty())
+		})
+
+		It("should point at what is invalid", func() {
+			_, err := ParseConfig([]byte("limits:\n  max_tunels: 10\n"))
+			Expect(err).To(MatchError(ContainSubstring("line 2")))
+
+			_, err = ParseConfig([]byte("allow:\n  users: [10.0.0.0/8, nope]\n"))
+			Expect(err).To(MatchError(ContainSubstring("allow.users[1]")))
+
+			_, err = ParseConfig([]byte("tls:\n  cert_file: cert.pem\n"))
+			Expect(err).To(MatchError(ContainSubstring("tls")))
+
+			_, err = ParseConfig([]byte("expose:\n  bind: 127.0.0.1\n  ports: 3000-20\n"))
+			Expect(err).To(MatchError(HavePrefix("line 3: expose.ports")))
+
+			_, err = ParseConfig([]byte("websocket:\n  listen: 127.0.0.1:443\n  path: tunnel\n"))
+			Expect(err).To(MatchError(HavePrefix("line 3: websocket.path")))
+
+			_, err = ParseConfig([]byte("ssh:\n  listen: 127.0.0.1:2222\n  host_key: /nonexistent/ssh_host_key\n"))
+			Expect(err).To(MatchError(HavePrefix("line 3: ssh.host_key")))
+
+			_, err = ParseConfig([]byte("auth:\n  authorized_keys: /nonexistent/authorized_keys\n"))
+			Expect(err).To(MatchError(HavePrefix("line 2: auth.authorized_keys")))
+
+			_, err = ParseConfig([]byte("https:\n  certs:\n    - cert_file: cert.pem\n"))
+			Expect(err).To(MatchError(HavePrefix("line 3: https.certs[0]")))
+		})
+
+		It("should name the file when loading", func() {
+			dir, err := ioutil.TempDir("", "rps_config")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "rps.yaml")
+			Expect(ioutil.WriteFile(path, []byte("limits:\n  max_tunnels: -1\n"), 0600)).To(Succeed())
+
+			_, err = LoadConfig(path)
+			Expect(err).To(MatchError(HavePrefix(path + ": line 2: limits.max_tunnels")))
+		})
+	})
+
+	Describe("Exposing", func() {
+		It("should keep exposed ports within the range", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			port := listener.Addr().(*net.TCPAddr).Port
+			listener.Close()
+			start(fmt.Sprintf("listen: 127.0.0.1:0\nexpose:\n  bind: 127.0.0.1\n  ports: %d-%d\n", port, port))
+
+			exposedPort, err := openTunnel(&GoRpsClient{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exposedPort).To(Equal(port))
+			userConn := dialUser(exposedPort)
+			defer userConn.Close()
+			Expect(echo(userConn, "In range")).To(Succeed())
+
+			// The range is used up, and ports outside it are off limits
+			_, err = openTunnel(&GoRpsClient{})
+			Expect(err).To(MatchError(ContainSubstring("No port available")))
+			_, err = openTunnel(&GoRpsClient{RequestedPort: port + 1})
+			Expect(err).To(MatchError(ContainSubstring("not allowed")))
+		})
+
+		It("should tunnel over IPv6", func() {
+			listener, err := net.Listen("tcp6", "[::1]:0")
+			if err != nil {
+				Skip("IPv6 unavailable: " + err.Error())
+			}
+			listener.Close()
+			ipv6Server := &mocks.MockProtectedServer{
+				ServerMessage: protectedServer.ServerMessage,
+				Port:          3005,
+				IP:            net.IPv6loopback,
+			}
+			ipv6Server.StartProtectedServer()
+			start("listen: '[::1]:0'\nexpose:\n  bind: '::1'\n")
+			Expect(serverTCPAddr.IP.Equal(net.IPv6loopback)).To(BeTrue())
+
+			client := &GoRpsClient{ServerTCPAddr: serverTCPAddr, TargetHost: "::1"}
+			clients = append(clients, client)
+			Expect(client.OpenTunnel(ipv6Server.Port)).To(Succeed())
+			exposedAddr := net.JoinHostPort("::1", strconv.Itoa(client.ExposedPort))
+			userConn, err := net.Dial("tcp", exposedAddr)
+			Expect(err).NotTo(HaveOccurred())
+			defer userConn.Close()
+			Expect(echo(userConn, "Over IPv6")).To(Succeed())
+
+			// Users are only exposed on the IPv6 loopback
+			_, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(client.ExposedPort)))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Auth tokens", func() {
+		It("should only open tunnels for clients with a valid token", func() {
+			start("listen: 127.0.0.1:0\nauth:\n  tokens: [s3cret]\n")
+
+			_, err := openTunnel(&GoRpsClient{})
+			Expect(err).To(MatchError(ContainSubstring("Invalid token")))
+			_, err = openTunnel(&GoRpsClient{Token: "guess"})
+			Expect(err).To(MatchError(ContainSubstring("Invalid token")))
+
+			port, err := openTunnel(&GoRpsClient{Token: "s3cret"})
+			Expect(err).NotTo(HaveOccurred())
+			userConn := dialUser(port)
+			defer userConn.Close()
+			Expect(echo(userConn, "Authorized")).To(Succeed())
+		})
+	})
+
+	Describe("Reloading", func() {
+		It("should apply new limits without dropping connected users", func() {
+			start("listen: 127.0.0.1:0\n")
+			port, err := openTunnel(&GoRpsClient{})
+			Expect(err).NotTo(HaveOccurred())
+			first := dialUser(port)
+			defer first.Close()
+			Expect(echo(first, "Before reload")).To(Succeed())
+
+			reload("listen: 127.0.0.1:0\nlimits:\n  max_users_per_tunnel: 1\n  max_tunnels: 1\n")
+
+			// The tunnel and its user survive
+			Expect(echo(first, "After reload")).To(Succeed())
+
+			// But the tunnel is full now
+			second := dialUser(port)
+			defer second.Close()
+			Expect(echo(second, "Over the limit")).NotTo(Succeed())
+			_, err = openTunnel(&GoRpsClient{})
+			Expect(err).To(MatchError(ContainSubstring("Too many tunnels")))
+
+			// Until the limit is lifted again
+			reload("listen: 127.0.0.1:0\n")
+			third := dialUser(port)
+			defer third.Close()
+			Expect(echo(third, "Limit lifted")).To(Succeed())
+		})
+
+		It("should apply new allow lists", func() {
+			start("listen: 127.0.0.1:0\n")
+			port, err := openTunnel(&GoRpsClient{})
+			Expect(err).NotTo(HaveOccurred())
+
+			reload("allow:\n  users: [10.0.0.0/8]\n")
+			userConn := dialUser(port)
+			defer userConn.Close()
+			Expect(echo(userConn, "Not allowed")).NotTo(Succeed())
+
+			reload("allow:\n  users: [10.0.0.0/8, 127.0.0.0/8]\n")
+			userConn = dialUser(port)
+			defer userConn.Close()
+			Expect(echo(userConn, "Allowed")).To(Succeed())
+		})
+
+		It("should apply new https certificates", func() {
+			start("listen: 127.0.0.1:0\n")
+			_, err := openTunnel(&GoRpsClient{Protocol: "http", HTTPS: true})
+			Expect(err).To(MatchError(ContainSubstring("no certificates")))
+
+			dir, err := ioutil.TempDir("", "rps_https")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+			certFile, keyFile, err := mocks.WriteSelfSignedCert(dir, "app.example.com")
+			Expect(err).NotTo(HaveOccurred())
+			reload(fmt.Sprintf("https:\n  certs:\n    - cert_file: %s\n      key_file: %s\n", certFile, keyFile))
+			_, err = openTunnel(&GoRpsClient{Protocol: "http", HTTPS: true})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("TLS", func() {
+		It("should serve clients over TLS", func() {
+			dir, err := ioutil.TempDir("", "rps_tls")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+			certFile, keyFile, err := mocks.WriteSelfSignedCert(dir, "127.0.0.1")
+			Expect(err).NotTo(HaveOccurred())
+			start(fmt.Sprintf("listen: 127.0.0.1:0\ntls:\n  cert_file: %s\n  key_file: %s\n", certFile, keyFile))
+
+			// A client that doesn't trust the certificate is turned away
+			_, err = openTunnel(&GoRpsClient{TLSConfig: &tls.Config{}})
+			Expect(err).To(HaveOccurred())
+
+			_, pool, err := mocks.SelfSignedCert("127.0.0.1")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = openTunnel(&GoRpsClient{TLSConfig: &tls.Config{RootCAs: pool}})
+			Expect(err).To(HaveOccurred())
+
+			certPEM, err := ioutil.ReadFile(certFile)
+			Expect(err).NotTo(HaveOccurred())
+			pool.AppendCertsFromPEM(certPEM)
+			port, err := openTunnel(&GoRpsClient{TLSConfig: &tls.Config{RootCAs: pool}})
+			Expect(err).NotTo(HaveOccurred())
+			userConn := dialUser(port)
+			defer userConn.Close()
+			Expect(echo(userConn, "Over TLS")).To(Succeed())
+		})
+
+		It("should verify the server for the name it was given", func() {
+			dir, err := ioutil.TempDir("", "rps_tls")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+			// A DNS name only, no IP address
+			certFile, keyFile, err := mocks.WriteSelfSignedCert(dir, "rps.example.com")
+			Expect(err).NotTo(HaveOccurred())
+			start(fmt.Sprintf("listen: 127.0.0.1:0\ntls:\n  cert_file: %s\n  key_file: %s\n", certFile, keyFile))
+			certPEM, err := ioutil.ReadFile(certFile)
+			Expect(err).NotTo(HaveOccurred())
+			pool := x509.NewCertPool()
+			pool.AppendCertsFromPEM(certPEM)
+
+			_, err = openTunnel(&GoRpsClient{TLSConfig: &tls.Config{RootCAs: pool}})
+			Expect(err).To(HaveOccurred())
+
+			port, err := openTunnel(&GoRpsClient{ServerHost: "rps.example.com", TLSConfig: &tls.Config{RootCAs: pool}})
+			Expect(err).NotTo(HaveOccurred())
+			userConn := dialUser(port)
+			defer userConn.Close()
+			Expect(echo(userConn, "Over TLS")).To(Succeed())
+		})
+	})
+})
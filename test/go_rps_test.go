@@ -1,6 +1,7 @@
 package go_rps_test
 
 import (
+	"context"
 	"fmt"
 	. "github.com/andysctu/go-tunnel/client"
 	. "github.com/andysctu/go-tunnel/server"
@@ -8,7 +9,9 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"time"
 )
 
@@ -17,6 +20,7 @@ var _ = Describe("GoRps", func() {
 	var client *GoRpsClient
 	var waitTime = 1 * time.Second
 	var _ = io.EOF
+	var events chan Event
 	var serverTCPAddr *net.TCPAddr
 	server1Message := "First server"
 	protectedServer := &mocks.MockProtectedServer{
@@ -32,8 +36,10 @@ var _ = Describe("GoRps", func() {
 		serverTCPAddr, err = server.Start()
 		Expect(err).NotTo(HaveOccurred())
 
+		events = make(chan Event, 16)
 		client = &GoRpsClient{
 			ServerTCPAddr: serverTCPAddr,
+			Events:        events,
 		}
 
 		err = client.OpenTunnel(protectedServer.Port)
@@ -43,6 +49,10 @@ var _ = Describe("GoRps", func() {
 	})
 
 	AfterEach(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), waitTime)
+		defer cancel()
+		client.Shutdown(ctx)
+		server.Shutdown(ctx)
 		server = nil
 		client = nil
 		fmt.Println("----------------")
@@ -69,13 +79,12 @@ var _ = Describe("GoRps", func() {
 				Port: exposedPort,
 			}
 
-			// Stop server
-			err := server.Stop()
+			// Stop server, waiting for it to finish
+			ctx, cancel := context.WithTimeout(context.Background(), waitTime)
+			defer cancel()
+			err := server.Shutdown(ctx)
 			Expect(err).To(Succeed())
 
-			// Wait for server to stop
-			time.Sleep(waitTime)
-
 			// Try to connect to Rps server
 			conn, err := net.DialTCP("tcp", nil, address)
 			Expect(err).To(HaveOccurred())
@@ -91,16 +100,16 @@ var _ = Describe("GoRps", func() {
 					Port: exposedPort,
 				}
 				err := client.Stop()
-
-				// Wait for client to stop
-				time.Sleep(waitTime)
-
 				Expect(err).To(Succeed())
 
-				// Try to connect to Rps server
-				conn, err := net.DialTCP("tcp", nil, address)
-				Expect(err).To(HaveOccurred())
-				Expect(conn).To(BeNil())
+				// Try to connect to Rps server until it has noticed the client is gone
+				Eventually(func() error {
+					conn, err := net.DialTCP("tcp", nil, address)
+					if err == nil {
+						conn.Close()
+					}
+					return err
+				}, waitTime).Should(HaveOccurred())
 			})
 		})
 	})
@@ -117,14 +126,11 @@ var _ = Describe("GoRps", func() {
 			Expect(err).NotTo(HaveOccurred())
 
 			// Wait for user to connect
-			time.Sleep(waitTime)
+			waitForEvent(events, UserConnected)
 
 			err = client.Stop()
 			Expect(err).NotTo(HaveOccurred())
 
-			// Wait for client to stop
-			time.Sleep(waitTime)
-
 			// Try to read the response
 			bytes := make([]byte, 4096)
 			i, err := conn.Read(bytes)
@@ -145,7 +151,7 @@ var _ = Describe("GoRps", func() {
 			Expect(err).NotTo(HaveOccurred())
 
 			// Let the connection establish
-			time.Sleep(waitTime)
+			waitForEvent(events, UserConnected)
 
 			err = server.Stop()
 			Expect(err).NotTo(HaveOccurred())
@@ -366,4 +372,222 @@ var _ = Describe("GoRps", func() {
 			}, 5)
 		})
 	})
+
+	Describe("Many users hitting the rps server at once", func() {
+		It("should keep every user's data separate", func(done Done) {
+			address := &net.TCPAddr{
+				IP:   net.IPv4(127, 0, 0, 1),
+				Port: exposedPort,
+			}
+
+			users := 20
+			results := make(chan error, users)
+			for u := 0; u < users; u++ {
+				go func(u int) {
+					userConn, err := net.DialTCP("tcp", nil, address)
+					if err != nil {
+						results <- err
+						return
+					}
+					defer userConn.Close()
+					for m := 0; m < 5; m++ {
+						message := fmt.Sprintf("Hello %d from user%d", m, u)
+						_, err = userConn.Write([]byte(message))
+						if err != nil {
+							results <- err
+							return
+						}
+						expected := server1Message + ": " + message
+						bytes := make([]byte, len(expected))
+						_, err = io.ReadFull(userConn, bytes)
+						if err != nil {
+							results <- err
+							return
+						}
+						if string(bytes) != expected {
+							results <- fmt.Errorf("user%d got %q", u, bytes)
+							return
+						}
+					}
+					results <- nil
+				}(u)
+			}
+			for u := 0; u < users; u++ {
+				Expect(<-results).NotTo(HaveOccurred())
+			}
+			close(done)
+		}, 10)
+	})
+
+	Describe("Opening a tunnel to an unresponsive rps server", func() {
+		It("should give up when the context expires", func(done Done) {
+			// Accepts connections but never answers
+			listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			Expect(err).NotTo(HaveOccurred())
+			defer listener.Close()
+
+			client2 := &GoRpsClient{
+				ServerTCPAddr: listener.Addr().(*net.TCPAddr),
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			err = client2.OpenTunnelContext(ctx, protectedServer.Port)
+			Expect(err).To(Equal(context.DeadlineExceeded))
+			close(done)
+		}, 5)
+	})
+
+	Describe("A client serving users in-process", func() {
+		It("should hand each user to its listener", func(done Done) {
+			client2 := &GoRpsClient{
+				ServerTCPAddr: serverTCPAddr,
+			}
+			listener, err := client2.Listen()
+			Expect(err).NotTo(HaveOccurred())
+			defer listener.Close()
+			Expect(listener.Addr().(*net.TCPAddr).Port).To(Equal(client2.ExposedPort))
+
+			remoteAddrs := make(chan string, 1)
+			go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				remoteAddrs <- r.RemoteAddr
+				w.Write([]byte("In-process: " + r.URL.Path))
+			}))
+
+			resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/hello", client2.ExposedPort))
+			Expect(err).NotTo(HaveOccurred())
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(Equal("In-process: /hello"))
+			Expect(<-remoteAddrs).To(HavePrefix("127.0.0.1:"))
+			close(done)
+		}, 5)
+	})
+
+	Describe("A client with an events channel", func() {
+		It("should report the tunnel's lifecycle", func(done Done) {
+			events := make(chan Event, 16)
+			client2 := &GoRpsClient{
+				ServerTCPAddr: serverTCPAddr,
+				Events:        events,
+				AutoReconnect: true,
+			}
+			err = client2.OpenTunnel(protectedServer.Port)
+			Expect(err).NotTo(HaveOccurred())
+
+			event := <-events
+			Expect(event.Type).To(Equal(TunnelReady))
+			Expect(event.ExposedPort).To(Equal(client2.ExposedPort))
+
+			address := &net.TCPAddr{
+				IP:   net.IPv4(127, 0, 0, 1),
+				Port: client2.ExposedPort,
+			}
+			userConn, err := net.DialTCP("tcp", nil, address)
+			Expect(err).NotTo(HaveOccurred())
+
+			event = <-events
+			Expect(event.Type).To(Equal(UserConnected))
+			Expect(event.RemoteAddr).To(Equal(userConn.LocalAddr().String()))
+
+			userConn.Write([]byte("Hello world"))
+			bytes := make([]byte, 4096)
+			i, err := userConn.Read(bytes)
+			Expect(err).NotTo(HaveOccurred())
+			userConn.Close()
+
+			event = <-events
+			Expect(event.Type).To(Equal(UserDisconnected))
+			Expect(event.BytesIn).To(Equal(int64(len("Hello world"))))
+			Expect(event.BytesOut).To(Equal(int64(i)))
+
+			// Restart the rps server underneath the client
+			err = server.Stop()
+			Expect(err).NotTo(HaveOccurred())
+			event = <-events
+			Expect(event.Type).To(Equal(ControlConnectionLost))
+
+			server = &GoRpsServer{}
+			_, err = server.Start()
+			Expect(err).NotTo(HaveOccurred())
+			event = <-events
+			Expect(event.Type).To(Equal(Reconnected))
+			Expect(event.ExposedPort).To(Equal(client2.ExposedPort))
+
+			client2.Stop()
+			close(done)
+		}, 10)
+	})
+
+	Describe("Draining the rps server", func() {
+		It("should move the tunnel to a new server while existing users finish", func(done Done) {
+			events := make(chan Event, 16)
+			client2 := &GoRpsClient{
+				ServerTCPAddr: serverTCPAddr,
+				Events:        events,
+				AutoReconnect: true,
+			}
+			err = client2.OpenTunnel(protectedServer.Port)
+			Expect(err).NotTo(HaveOccurred())
+			defer client2.Stop()
+
+			echo := func(userConn net.Conn, message string) {
+				_, err := userConn.Write([]byte(message))
+				Expect(err).NotTo(HaveOccurred())
+				expected := server1Message + ": " + message
+				bytes := make([]byte, len(expected))
+				_, err = io.ReadFull(userConn, bytes)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(bytes)).To(Equal(expected))
+			}
+
+			oldUser, err := net.DialTCP("tcp", nil, &net.TCPAddr{
+				IP:   net.IPv4(127, 0, 0, 1),
+				Port: client2.ExposedPort,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			echo(oldUser, "Before drain")
+
+			draining := server
+			drained := make(chan error, 1)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				drained <- draining.Drain(ctx)
+			}()
+			event := waitForEvent(events, Draining)
+			Expect(event.ExposedPort).To(Equal(oldUser.RemoteAddr().(*net.TCPAddr).Port))
+
+			// The replacement server takes over the client port
+			server = &GoRpsServer{}
+			_, err = server.Start()
+			Expect(err).NotTo(HaveOccurred())
+			event = waitForEvent(events, Reconnected)
+
+			newUser, err := net.DialTCP("tcp", nil, &net.TCPAddr{
+				IP:   net.IPv4(127, 0, 0, 1),
+				Port: event.ExposedPort,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			echo(newUser, "Through the new server")
+			newUser.Close()
+
+			// The old user is still served by the draining server
+			echo(oldUser, "During drain")
+			Consistently(drained, 200*time.Millisecond).ShouldNot(Receive())
+
+			oldUser.Close()
+			Eventually(drained, 2*time.Second).Should(Receive(BeNil()))
+			close(done)
+		}, 10)
+	})
 })
+
+func waitForEvent(events chan Event, eventType EventType) Event {
+	for event := range events {
+		if event.Type == eventType {
+			return event
+		}
+	}
+	return Event{}
+}
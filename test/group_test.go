@@ -0,0 +1,203 @@
+package go_rps_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	. "github.com/andysctu/go-tunnel/client"
+	"github.com/andysctu/go-tunnel/helper"
+	pb "github.com/andysctu/go-tunnel/protobuf"
+	. "github.com/andysctu/go-tunnel/server"
+	"github.com/andysctu/go-tunnel/webhook"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("Tunnel groups", func() {
+	var server *GoRpsServer
+	var serverTCPAddr *net.TCPAddr
+	var clients []*GoRpsClient
+	var receiver *httptest.Server
+	var opened chan bool
+
+	// The server tells the webhook once each client's tunnel is open, and
+	// only then sends it users ahead of the other members
+	startServer := func(s *GoRpsServer) {
+		var err error
+		opened = make(chan bool, 16)
+		receiver = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			event := &webhook.Event{}
+			body, _ := ioutil.ReadAll(r.Body)
+			json.Unmarshal(body, event)
+			if event.Type == webhook.TunnelOpened {
+				opened <- true
+			}
+		}))
+		server = s
+		server.Addr = "127.0.0.1:0"
+		server.Webhook = webhook.New(receiver.URL, "")
+		serverTCPAddr, err = server.Start()
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	// Join the group with a client that answers every user with its name
+	join := func(name string, client *GoRpsClient) error {
+		client.ServerTCPAddr = serverTCPAddr
+		clients = append(clients, client)
+		listener, err := client.Listen()
+		if err != nil {
+			return err
+		}
+		Eventually(opened).Should(Receive())
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn.Write([]byte(name))
+			}
+		}()
+		return nil
+	}
+
+	// Connect a user and return it with the name of the client serving it
+	dialUser := func(port int) (net.Conn, string) {
+		userConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		Expect(err).NotTo(HaveOccurred())
+		name := make([]byte, 1)
+		userConn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = io.ReadFull(userConn, name)
+		if err != nil {
+			userConn.Close()
+			return nil, ""
+		}
+		return userConn, string(name)
+	}
+
+	AfterEach(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		for _, client := range clients {
+			client.Shutdown(ctx)
+		}
+		clients = nil
+		server.Shutdown(ctx)
+		server.Webhook.Close()
+		receiver.Close()
+	})
+
+	It("should spread users across the group in turn", func() {
+		startServer(&GoRpsServer{})
+		for _, name := range []string{"A", "B", "C"} {
+			Expect(join(name, &GoRpsClient{Group: "web"})).To(Succeed())
+		}
+		port := clients[0].ExposedPort
+		Expect(clients[1].ExposedPort).To(Equal(port))
+		Expect(clients[2].ExposedPort).To(Equal(port))
+
+		served := map[string]int{}
+		for i := 0; i < 6; i++ {
+			userConn, name := dialUser(port)
+			Expect(userConn).NotTo(BeNil())
+			defer userConn.Close()
+			served[name]++
+		}
+		Expect(served).To(Equal(map[string]int{"A": 2, "B": 2, "C": 2}))
+
+		// Clients outside the group get their own port
+		Expect(join("D", &GoRpsClient{})).To(Succeed())
+		Expect(clients[3].ExposedPort).NotTo(Equal(port))
+	})
+
+	It("should send users to the least busy client", func() {
+		startServer(&GoRpsServer{Balance: LeastConnections})
+		Expect(join("A", &GoRpsClient{Group: "web"})).To(Succeed())
+		port := clients[0].ExposedPort
+		for i := 0; i < 2; i++ {
+			userConn, name := dialUser(port)
+			Expect(name).To(Equal("A"))
+			defer userConn.Close()
+		}
+
+		// A newcomer takes users until it is as busy as the others
+		Expect(join("B", &GoRpsClient{Group: "web"})).To(Succeed())
+		for _, expected := range []string{"B", "B", "A"} {
+			userConn, name := dialUser(port)
+			Expect(name).To(Equal(expected))
+			defer userConn.Close()
+		}
+	})
+
+	It("should drop a client whose connection dies", func() {
+		startServer(&GoRpsServer{})
+		Expect(join("A", &GoRpsClient{Group: "web"})).To(Succeed())
+		Expect(join("B", &GoRpsClient{Group: "web"})).To(Succeed())
+		port := clients[0].ExposedPort
+
+		Expect(clients[0].Stop()).To(Succeed())
+		Eventually(func() string {
+			userConn, name := dialUser(port)
+			if userConn != nil {
+				userConn.Close()
+			}
+			return name
+		}).Should(Equal("B"))
+		for i := 0; i < 3; i++ {
+			userConn, name := dialUser(port)
+			Expect(name).To(Equal("B"))
+			userConn.Close()
+		}
+
+		// The port closes with the last client
+		Expect(clients[1].Stop()).To(Succeed())
+		Eventually(func() error {
+			userConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+			if err == nil {
+				userConn.Close()
+			}
+			return err
+		}).Should(HaveOccurred())
+	})
+
+	It("should only let clients with the same token join", func() {
+		startServer(&GoRpsServer{})
+		server.SetPolicy(&Policy{Tokens: []string{"first", "second"}})
+		Expect(join("A", &GoRpsClient{Group: "web", Token: "first"})).To(Succeed())
+		err := join("B", &GoRpsClient{Group: "web", Token: "second"})
+		Expect(err).To(MatchError(ContainSubstring("Group belongs to another token")))
+		Expect(join("C", &GoRpsClient{Group: "web", Token: "first"})).To(Succeed())
+	})
+
+	It("should not send users to a client still opening its tunnel", func() {
+		startServer(&GoRpsServer{})
+		Expect(join("A", &GoRpsClient{Group: "web"})).To(Succeed())
+		port := clients[0].ExposedPort
+
+		// A client that joins but never opens the mux control stream
+		clientConn, err := net.Dial("tcp", serverTCPAddr.String())
+		Expect(err).NotTo(HaveOccurred())
+		defer clientConn.Close()
+		hello := &pb.TestMessage{Type: pb.TestMessage_ConnectionOpen, Id: -1, Group: "web", Transport: "mux"}
+		Expect(helper.SendProtobuf(clientConn, hello)).To(Succeed())
+		_, err = helper.ReceiveProtobuf(clientConn)
+		Expect(err).NotTo(HaveOccurred())
+
+		for i := 0; i < 3; i++ {
+			userConn, name := dialUser(port)
+			Expect(name).To(Equal("A"))
+			defer userConn.Close()
+		}
+
+		// Nor hang shutting down while it is
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		Expect(server.Shutdown(ctx)).To(Succeed())
+	})
+})
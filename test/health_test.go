@@ -0,0 +1,194 @@
+package go_rps_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	. "github.com/andysctu/go-tunnel/client"
+	. "github.com/andysctu/go-tunnel/server"
+	"github.com/andysctu/go-tunnel/test/mocks"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+var _ = Describe("Protected server health", func() {
+	var server *GoRpsServer
+	var serverTCPAddr *net.TCPAddr
+	var clients []*GoRpsClient
+
+	BeforeEach(func() {
+		var err error
+		server = &GoRpsServer{Addr: "127.0.0.1:0"}
+		serverTCPAddr, err = server.Start()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		for _, client := range clients {
+			client.Shutdown(ctx)
+		}
+		clients = nil
+		server.Shutdown(ctx)
+	})
+
+	openTunnel := func(client *GoRpsClient, port int) {
+		client.ServerTCPAddr = serverTCPAddr
+		clients = append(clients, client)
+		Expect(client.OpenTunnel(port)).To(Succeed())
+	}
+
+	// A port nothing listens on
+	closedPort := func() int {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer listener.Close()
+		return listener.Addr().(*net.TCPAddr).Port
+	}
+
+	// Returns what the user gets before being disconnected. Being reset
+	// with the message unread counts as disconnected.
+	userGets := func(port int) string {
+		userConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		Expect(err).NotTo(HaveOccurred())
+		defer userConn.Close()
+		userConn.SetDeadline(time.Now().Add(time.Second))
+		userConn.Write([]byte("Hello"))
+		reply, err := ioutil.ReadAll(userConn)
+		if errors.Is(err, syscall.ECONNRESET) {
+			return string(reply)
+		}
+		Expect(err).NotTo(HaveOccurred(), "user left hanging")
+		return string(reply)
+	}
+
+	waitFor := func(events chan Event, eventType EventType) {
+		Eventually(events).Should(Receive(WithTransform(func(e Event) EventType {
+			return e.Type
+		}, Equal(eventType))))
+	}
+
+	Describe("When the protected server can't be dialed", func() {
+		It("should disconnect the user right away", func() {
+			client := &GoRpsClient{}
+			openTunnel(client, closedPort())
+			Expect(userGets(client.ExposedPort)).To(BeEmpty())
+		})
+
+		It("should answer HTTP users with a 503", func() {
+			client := &GoRpsClient{Protocol: "http"}
+			openTunnel(client, closedPort())
+			res, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/", client.ExposedPort))
+			Expect(err).NotTo(HaveOccurred())
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusServiceUnavailable))
+		})
+	})
+
+	Describe("Health checks", func() {
+		It("should stop sending users until the protected server is back", func() {
+			events := make(chan Event, 16)
+			client := &GoRpsClient{
+				Events:      events,
+				HealthCheck: &HealthCheck{Interval: 20 * time.Millisecond},
+			}
+			openTunnel(client, 3006)
+			waitFor(events, Unhealthy)
+			Eventually(func() string {
+				return userGets(client.ExposedPort)
+			}).Should(BeEmpty())
+
+			protectedServer := &mocks.MockProtectedServer{
+				ServerMessage: "Healthy again",
+				Port:          3006,
+			}
+			protectedServer.StartProtectedServer()
+			waitFor(events, Healthy)
+			expected := protectedServer.ServerMessage + ": Hello"
+			Eventually(func() error {
+				userConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", client.ExposedPort))
+				Expect(err).NotTo(HaveOccurred())
+				defer userConn.Close()
+				userConn.SetDeadline(time.Now().Add(time.Second))
+				userConn.Write([]byte("Hello"))
+				reply := make([]byte, len(expected))
+				_, err = io.ReadFull(userConn, reply)
+				if err == nil && string(reply) != expected {
+					err = fmt.Errorf("unexpected reply %q", reply)
+				}
+				return err
+			}).Should(Succeed())
+		})
+
+		It("should answer HTTP users with a 503 while unhealthy", func() {
+			events := make(chan Event, 16)
+			client := &GoRpsClient{
+				Events:      events,
+				Protocol:    "http",
+				HealthCheck: &HealthCheck{Interval: 20 * time.Millisecond, Path: "/healthz"},
+			}
+			openTunnel(client, closedPort())
+			waitFor(events, Unhealthy)
+			Eventually(func() int {
+				res, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/", client.ExposedPort))
+				Expect(err).NotTo(HaveOccurred())
+				body, _ := ioutil.ReadAll(res.Body)
+				res.Body.Close()
+				Expect(string(body)).To(ContainSubstring("Protected server unavailable"))
+				return res.StatusCode
+			}).Should(Equal(http.StatusServiceUnavailable))
+		})
+
+		It("should skip unhealthy members of a group", func() {
+			healthy, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			defer healthy.Close()
+
+			join := func(name string, checkAddr string) chan Event {
+				events := make(chan Event, 16)
+				client := &GoRpsClient{
+					ServerTCPAddr: serverTCPAddr,
+					Group:         "health",
+					Events:        events,
+					HealthCheck:   &HealthCheck{Interval: 20 * time.Millisecond, Addr: checkAddr},
+				}
+				clients = append(clients, client)
+				listener, err := client.Listen()
+				Expect(err).NotTo(HaveOccurred())
+				go func() {
+					for {
+						conn, err := listener.Accept()
+						if err != nil {
+							return
+						}
+						conn.Write([]byte(name))
+						conn.Close()
+					}
+				}()
+				return events
+			}
+			events := join("A", fmt.Sprintf("127.0.0.1:%d", closedPort()))
+			join("B", healthy.Addr().String())
+			waitFor(events, Unhealthy)
+
+			port := clients[0].ExposedPort
+			for i := 0; i < 4; i++ {
+				userConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+				Expect(err).NotTo(HaveOccurred())
+				userConn.SetReadDeadline(time.Now().Add(time.Second))
+				name := make([]byte, 1)
+				_, err = io.ReadFull(userConn, name)
+				userConn.Close()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(name)).To(Equal("B"))
+			}
+		})
+	})
+})
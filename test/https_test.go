@@ -0,0 +1,124 @@
+package go_rps_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	. "github.com/andysctu/go-tunnel/client"
+	. "github.com/andysctu/go-tunnel/server"
+	"github.com/andysctu/go-tunnel/test/mocks"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+var _ = Describe("HTTPS tunnels", func() {
+	var server *GoRpsServer
+	var serverTCPAddr *net.TCPAddr
+	var client *GoRpsClient
+	var psServer *http.Server
+	var psPort int
+	var certs *CertStore
+	var pool *x509.CertPool
+	var wildcardPool *x509.CertPool
+
+	BeforeEach(func() {
+		cert, p, err := mocks.SelfSignedCert("app.example.com", "127.0.0.1")
+		Expect(err).NotTo(HaveOccurred())
+		wildcard, wp, err := mocks.SelfSignedCert("*.tunnels.example.com")
+		Expect(err).NotTo(HaveOccurred())
+		pool, wildcardPool = p, wp
+		certs, err = NewCertStore([]UserCert{{Certificate: cert}, {Certificate: wildcard}})
+		Expect(err).NotTo(HaveOccurred())
+
+		server = &GoRpsServer{Addr: "127.0.0.1:0", UserCerts: certs}
+		serverTCPAddr, err = server.Start()
+		Expect(err).NotTo(HaveOccurred())
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		psPort = listener.Addr().(*net.TCPAddr).Port
+		psServer = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "Hello from %s", r.Host)
+		})}
+		go psServer.Serve(listener)
+	})
+
+	AfterEach(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if client != nil {
+			client.Shutdown(ctx)
+			client = nil
+		}
+		server.Shutdown(ctx)
+		psServer.Close()
+	})
+
+	openTunnel := func() error {
+		client = &GoRpsClient{ServerTCPAddr: serverTCPAddr, Protocol: "http", HTTPS: true}
+		return client.OpenTunnel(psPort)
+	}
+
+	// GET the tunnel over https, asking for name and trusting roots
+	get := func(name string, roots *x509.CertPool) (string, error) {
+		dialer := &net.Dialer{Timeout: 2 * time.Second}
+		httpClient := &http.Client{
+			Timeout: 2 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{ServerName: name, RootCAs: roots},
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "tcp", fmt.Sprintf("127.0.0.1:%d", client.ExposedPort))
+				},
+			},
+		}
+		resp, err := httpClient.Get(fmt.Sprintf("https://%s/", name))
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	It("should terminate users' TLS and pass plain HTTP through the tunnel", func() {
+		Expect(openTunnel()).To(Succeed())
+		body, err := get("app.example.com", pool)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(body).To(Equal("Hello from app.example.com"))
+	})
+
+	It("should pick the certificate by the name users ask for", func() {
+		Expect(openTunnel()).To(Succeed())
+		body, err := get("demo.tunnels.example.com", wildcardPool)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(body).To(Equal("Hello from demo.tunnels.example.com"))
+
+		// A wildcard only covers one label
+		_, err = get("a.demo.tunnels.example.com", wildcardPool)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should serve replaced certificates to new users", func() {
+		Expect(openTunnel()).To(Succeed())
+		renewed, renewedPool, err := mocks.SelfSignedCert("app.example.com")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(certs.Set([]UserCert{{Certificate: renewed}})).To(Succeed())
+
+		_, err = get("app.example.com", pool)
+		Expect(err).To(HaveOccurred())
+		body, err := get("app.example.com", renewedPool)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(body).To(Equal("Hello from app.example.com"))
+	})
+
+	It("should refuse https tunnels without certificates", func() {
+		Expect(certs.Set(nil)).To(Succeed())
+		Expect(openTunnel()).To(MatchError(ContainSubstring("no certificates")))
+		client = nil
+	})
+})
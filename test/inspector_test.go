@@ -0,0 +1,211 @@
+package go_rps_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	. "github.com/andysctu/go-tunnel/client"
+	"github.com/andysctu/go-tunnel/inspector"
+	. "github.com/andysctu/go-tunnel/server"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var _ = Describe("Inspector", func() {
+	var protectedServer *httptest.Server
+	var insp *inspector.Inspector
+
+	BeforeEach(func() {
+		protectedServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Path", r.URL.Path)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("created"))
+		}))
+		insp = inspector.New(strings.TrimPrefix(protectedServer.URL, "http://"))
+	})
+
+	AfterEach(func() {
+		protectedServer.Close()
+	})
+
+	Describe("HTTP traffic on a stream", func() {
+		It("should capture the request and its response", func() {
+			insp.Request(1, []byte("POST /hook HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhel"))
+			insp.Request(1, []byte("lo"))
+			insp.Response(1, []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+
+			Eventually(func() bool {
+				exchanges := insp.Exchanges()
+				return len(exchanges) == 1 && exchanges[0].Complete
+			}, time.Second).Should(BeTrue())
+
+			ex := insp.Exchanges()[0]
+			Expect(ex.Method).To(Equal("POST"))
+			Expect(ex.URL).To(Equal("/hook"))
+			Expect(ex.Host).To(Equal("example.com"))
+			Expect(ex.RequestBody).To(Equal([]byte("hello")))
+			Expect(ex.Status).To(Equal(200))
+			Expect(ex.ResponseBody).To(Equal([]byte("ok")))
+		})
+	})
+
+	Describe("Streams of different sessions", func() {
+		It("should be parsed apart even with the same id", func() {
+			// An old tunnel and its replacement both have a user 1
+			old, replacement := insp.Session(), insp.Session()
+			old.Request(1, []byte("GET /old HTTP/1.1\r\nHo"))
+			replacement.Request(1, []byte("GET /new HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+			old.Request(1, []byte("st: example.com\r\n\r\n"))
+			replacement.Response(1, []byte("HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\nnew"))
+			old.Response(1, []byte("HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\nold"))
+
+			Eventually(func() int {
+				complete := 0
+				for _, ex := range insp.Exchanges() {
+					if ex.Complete {
+						complete++
+					}
+				}
+				return complete
+			}, time.Second).Should(Equal(2))
+			for _, ex := range insp.Exchanges() {
+				Expect(ex.StreamID).To(Equal(int32(1)))
+				Expect(ex.URL).To(Equal("/" + string(ex.ResponseBody)))
+			}
+		})
+	})
+
+	Describe("Non-HTTP traffic on a stream", func() {
+		It("should be ignored", func() {
+			insp.Request(2, []byte("Hello world\x00\x01\r\n\r\n"))
+			Consistently(func() int {
+				return len(insp.Exchanges())
+			}, 200*time.Millisecond).Should(Equal(0))
+		})
+	})
+
+	Describe("Replaying a captured request", func() {
+		It("should send it to the protected server and record the result", func() {
+			insp.Request(3, []byte("GET /again HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+			Eventually(func() int {
+				return len(insp.Exchanges())
+			}, time.Second).Should(Equal(1))
+
+			ex, err := insp.Replay(insp.Exchanges()[0].ID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ex.Replayed).To(BeTrue())
+			Expect(ex.Status).To(Equal(http.StatusCreated))
+			Expect(ex.ResponseHeader.Get("X-Path")).To(Equal("/again"))
+			Expect(ex.ResponseBody).To(Equal([]byte("created")))
+			Expect(insp.Exchanges()).To(HaveLen(2))
+		})
+
+		It("should send it over TLS to a protected server that only speaks HTTPS", func() {
+			httpsServer := httptest.NewTLSServer(protectedServer.Config.Handler)
+			defer httpsServer.Close()
+			pool := x509.NewCertPool()
+			pool.AddCert(httpsServer.Certificate())
+			insp = inspector.New(strings.TrimPrefix(httpsServer.URL, "https://"))
+			insp.TargetTLS = &tls.Config{RootCAs: pool}
+
+			insp.Request(3, []byte("GET /secure HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+			Eventually(func() int {
+				return len(insp.Exchanges())
+			}, time.Second).Should(Equal(1))
+
+			ex, err := insp.Replay(insp.Exchanges()[0].ID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ex.Status).To(Equal(http.StatusCreated))
+			Expect(ex.ResponseHeader.Get("X-Path")).To(Equal("/secure"))
+		})
+	})
+
+	Describe("The web UI", func() {
+		var ui *httptest.Server
+
+		BeforeEach(func() {
+			ui = httptest.NewServer(insp)
+			insp.Request(4, []byte("GET /secret HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+			Eventually(func() int {
+				return len(insp.Exchanges())
+			}, time.Second).Should(Equal(1))
+		})
+
+		AfterEach(func() {
+			ui.Close()
+		})
+
+		do := func(method string, path string, host string, origin string) int {
+			req, err := http.NewRequest(method, ui.URL+path, nil)
+			Expect(err).NotTo(HaveOccurred())
+			if host != "" {
+				req.Host = host
+			}
+			if origin != "" {
+				req.Header.Set("Origin", origin)
+			}
+			req.Header.Set("Accept", "application/json")
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		It("should only answer requests for its own address", func() {
+			Expect(do("GET", "/api/requests", "", "")).To(Equal(http.StatusOK))
+			port := ui.Listener.Addr().(*net.TCPAddr).Port
+			Expect(do("GET", "/api/requests", "localhost:"+strconv.Itoa(port), "")).To(Equal(http.StatusOK))
+			// A name rebound to 127.0.0.1 by another site
+			Expect(do("GET", "/api/requests", "rebound.example.com:"+strconv.Itoa(port), "")).To(Equal(http.StatusForbidden))
+		})
+
+		It("should only replay for pages of the same origin", func() {
+			replay := fmt.Sprintf("/api/requests/%d/replay", insp.Exchanges()[0].ID)
+			Expect(do("POST", replay, "", "")).To(Equal(http.StatusForbidden))
+			Expect(do("POST", replay, "", "http://attacker.example.com")).To(Equal(http.StatusForbidden))
+			Expect(do("POST", replay, "", ui.URL)).To(Equal(http.StatusOK))
+		})
+	})
+
+	Describe("On a tunnel", func() {
+		It("should capture the HTTP going through it", func() {
+			server := &GoRpsServer{Addr: "127.0.0.1:0"}
+			serverTCPAddr, err := server.Start()
+			Expect(err).NotTo(HaveOccurred())
+			psPort := protectedServer.Listener.Addr().(*net.TCPAddr).Port
+			client := &GoRpsClient{ServerTCPAddr: serverTCPAddr, TargetHost: "127.0.0.1", Inspector: insp}
+			Expect(client.OpenTunnel(psPort)).To(Succeed())
+			defer func() {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				client.Shutdown(ctx)
+				server.Shutdown(ctx)
+			}()
+
+			resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/through", client.ExposedPort))
+			Expect(err).NotTo(HaveOccurred())
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(Equal("created"))
+
+			Eventually(func() bool {
+				exchanges := insp.Exchanges()
+				return len(exchanges) == 1 && exchanges[0].Complete
+			}, time.Second).Should(BeTrue())
+			ex := insp.Exchanges()[0]
+			Expect(ex.Method).To(Equal("GET"))
+			Expect(ex.URL).To(Equal("/through"))
+			Expect(ex.Status).To(Equal(http.StatusCreated))
+			Expect(ex.ResponseBody).To(Equal([]byte("created")))
+		})
+	})
+})
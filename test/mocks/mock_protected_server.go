@@ -8,14 +8,18 @@ import (
 type MockProtectedServer struct {
 	ServerMessage string
 	Port          int
+	IP            net.IP // Optional, defaults to 127.0.0.1
 }
 
 // Listen for new clients
 func (mps *MockProtectedServer) StartProtectedServer() {
 	protectedServerAddr := &net.TCPAddr{
-		IP:   net.IPv4(127, 0, 0, 1),
+		IP:   mps.IP,
 		Port: mps.Port,
 	}
+	if protectedServerAddr.IP == nil {
+		protectedServerAddr.IP = net.IPv4(127, 0, 0, 1)
+	}
 
 	psListener, _ := net.ListenTCP("tcp", protectedServerAddr)
 	go mps.listenForConn(psListener)
@@ -0,0 +1,169 @@
+package mocks
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// MockProxy is an HTTP CONNECT or SOCKS5 proxy that requires User and
+// Password when User is set, and remembers where it was asked to connect
+type MockProxy struct {
+	SOCKS5   bool
+	User     string
+	Password string
+
+	listener net.Listener
+	mu       sync.Mutex
+	targets  []string
+}
+
+// Start listening on 127.0.0.1, returning the proxy's address
+func (p *MockProxy) Start() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	p.listener = listener
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.handleConn(conn)
+		}
+	}()
+	return listener.Addr().String(), nil
+}
+
+func (p *MockProxy) Stop() {
+	p.listener.Close()
+}
+
+// Targets is every address the proxy connected to
+func (p *MockProxy) Targets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+func (p *MockProxy) handleConn(conn net.Conn) {
+	var target string
+	var reader io.Reader
+	if p.SOCKS5 {
+		target, reader = p.handshakeSOCKS5(conn)
+	} else {
+		target, reader = p.handshakeHTTP(conn)
+	}
+	if target == "" {
+		conn.Close()
+		return
+	}
+	p.mu.Lock()
+	p.targets = append(p.targets, target)
+	p.mu.Unlock()
+
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go func() {
+		io.Copy(upstream, reader)
+		upstream.Close()
+	}()
+	io.Copy(conn, upstream)
+	conn.Close()
+}
+
+func (p *MockProxy) handshakeHTTP(conn net.Conn) (string, io.Reader) {
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil || req.Method != http.MethodConnect {
+		return "", nil
+	}
+	if p.User != "" {
+		proxyAuth := &http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}
+		user, password, ok := proxyAuth.BasicAuth()
+		if !ok || user != p.User || password != p.Password {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+			return "", nil
+		}
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return req.Host, reader
+}
+
+func (p *MockProxy) handshakeSOCKS5(conn net.Conn) (string, io.Reader) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != 5 {
+		return "", nil
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", nil
+	}
+	want := byte(0)
+	if p.User != "" {
+		want = 2
+	}
+	offered := false
+	for _, method := range methods {
+		offered = offered || method == want
+	}
+	if !offered {
+		conn.Write([]byte{5, 0xff})
+		return "", nil
+	}
+	conn.Write([]byte{5, want})
+	if want == 2 {
+		user, password := readField(conn, 1), readField(conn, 0)
+		if user != p.User || password != p.Password {
+			conn.Write([]byte{1, 1})
+			return "", nil
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil || request[1] != 1 {
+		return "", nil
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, net.IPv4len)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 4:
+		ip := make([]byte, net.IPv6len)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 3:
+		host = readField(conn, 0)
+	default:
+		return "", nil
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", nil
+	}
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), conn
+}
+
+// Read a length-prefixed field, after skipping skip bytes
+func readField(conn net.Conn, skip int) string {
+	prefix := make([]byte, skip+1)
+	if _, err := io.ReadFull(conn, prefix); err != nil {
+		return ""
+	}
+	field := make([]byte, prefix[skip])
+	io.ReadFull(conn, field)
+	return string(field)
+}
@@ -0,0 +1,117 @@
+package go_rps_test
+
+import (
+	"context"
+	. "github.com/andysctu/go-tunnel/client"
+	. "github.com/andysctu/go-tunnel/server"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"net"
+	"time"
+)
+
+var _ = Describe("Private tunnels", func() {
+	var server *GoRpsServer
+	var serverTCPAddr *net.TCPAddr
+	var publisher *GoRpsClient
+	var psListener net.Listener
+
+	BeforeEach(func() {
+		server = &GoRpsServer{Addr: "127.0.0.1:0"}
+		var err error
+		serverTCPAddr, err = server.Start()
+		Expect(err).NotTo(HaveOccurred())
+
+		psListener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		go func() {
+			for {
+				conn, err := psListener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					io.Copy(conn, conn)
+					conn.Close()
+				}()
+			}
+		}()
+
+		publisher = &GoRpsClient{
+			ServerTCPAddr: serverTCPAddr,
+			TargetHost:    "127.0.0.1",
+			Private:       "db",
+			Secret:        "only-the-team",
+		}
+		Expect(publisher.OpenTunnel(psListener.Addr().(*net.TCPAddr).Port)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		publisher.Shutdown(ctx)
+		server.Shutdown(ctx)
+		psListener.Close()
+	})
+
+	echo := func(conn net.Conn, message string) {
+		_, err := conn.Write([]byte(message))
+		Expect(err).NotTo(HaveOccurred())
+		reply := make([]byte, len(message))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = io.ReadFull(conn, reply)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(reply)).To(Equal(message))
+	}
+
+	visit := func(name, secret string) (net.Conn, error) {
+		visitor := &GoRpsClient{ServerTCPAddr: serverTCPAddr, Secret: secret}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		return visitor.Visit(ctx, name)
+	}
+
+	It("should not expose a public port", func() {
+		Expect(publisher.ExposedPort).To(Equal(0))
+	})
+
+	It("should let visitors with the secret reach the protected server", func() {
+		conn, err := visit("db", "only-the-team")
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		echo(conn, "Hello, private tunnel")
+
+		other, err := visit("db", "only-the-team")
+		Expect(err).NotTo(HaveOccurred())
+		defer other.Close()
+		echo(other, "Another visitor")
+	})
+
+	It("should serve visitors on a local listener", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer listener.Close()
+		visitor := &GoRpsClient{ServerTCPAddr: serverTCPAddr, Secret: "only-the-team"}
+		go visitor.ServeVisitors(listener, "db")
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		echo(conn, "Through a local port")
+	})
+
+	It("should refuse visitors with the wrong secret or name", func() {
+		_, err := visit("db", "guess")
+		Expect(err).To(MatchError(ContainSubstring("No private tunnel")))
+
+		_, err = visit("cache", "only-the-team")
+		Expect(err).To(MatchError(ContainSubstring("No private tunnel")))
+	})
+
+	It("should refuse private tunnels without a secret", func() {
+		client := &GoRpsClient{ServerTCPAddr: serverTCPAddr, TargetHost: "127.0.0.1", Private: "open"}
+		err := client.OpenTunnel(psListener.Addr().(*net.TCPAddr).Port)
+		Expect(err).To(MatchError(ContainSubstring("need a secret")))
+	})
+})
@@ -0,0 +1,145 @@
+package go_rps_test
+
+import (
+	"context"
+	"fmt"
+	. "github.com/andysctu/go-tunnel/client"
+	. "github.com/andysctu/go-tunnel/server"
+	"github.com/andysctu/go-tunnel/test/mocks"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+var _ = Describe("Proxies", func() {
+	var server *GoRpsServer
+	var serverTCPAddr *net.TCPAddr
+	var client *GoRpsClient
+	var proxy *mocks.MockProxy
+	var psListener net.Listener
+
+	BeforeEach(func() {
+		server = &GoRpsServer{Addr: "127.0.0.1:0", WebSocketAddr: "127.0.0.1:0"}
+		var err error
+		serverTCPAddr, err = server.Start()
+		Expect(err).NotTo(HaveOccurred())
+
+		psListener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		go func() {
+			for {
+				conn, err := psListener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					io.Copy(conn, conn)
+					conn.Close()
+				}()
+			}
+		}()
+	})
+
+	AfterEach(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if client != nil {
+			client.Shutdown(ctx)
+			client = nil
+		}
+		server.Shutdown(ctx)
+		psListener.Close()
+		proxy.Stop()
+	})
+
+	startProxy := func(p *mocks.MockProxy) string {
+		proxy = p
+		addr, err := proxy.Start()
+		Expect(err).NotTo(HaveOccurred())
+		return addr
+	}
+
+	openTunnel := func(c *GoRpsClient) error {
+		client = c
+		client.ServerTCPAddr = serverTCPAddr
+		client.TargetHost = "127.0.0.1"
+		return client.OpenTunnel(psListener.Addr().(*net.TCPAddr).Port)
+	}
+
+	echo := func(message string) {
+		userConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", client.ExposedPort))
+		Expect(err).NotTo(HaveOccurred())
+		defer userConn.Close()
+		_, err = userConn.Write([]byte(message))
+		Expect(err).NotTo(HaveOccurred())
+		reply := make([]byte, len(message))
+		userConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = io.ReadFull(userConn, reply)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(reply)).To(Equal(message))
+	}
+
+	Describe("HTTP CONNECT", func() {
+		It("should reach the rps server through the proxy, logging in", func() {
+			addr := startProxy(&mocks.MockProxy{User: "me", Password: "s3cret"})
+
+			err := openTunnel(&GoRpsClient{Proxy: "http://me:wrong@" + addr})
+			Expect(err).To(MatchError(ContainSubstring("407")))
+
+			Expect(openTunnel(&GoRpsClient{Proxy: "http://me:s3cret@" + addr})).To(Succeed())
+			echo("Through a CONNECT proxy")
+			Expect(proxy.Targets()).To(ContainElement(serverTCPAddr.String()))
+		})
+
+		It("should carry WebSocket clients too", func() {
+			addr := startProxy(&mocks.MockProxy{})
+			Expect(openTunnel(&GoRpsClient{
+				Proxy:     addr,
+				ServerURL: fmt.Sprintf("ws://%s/tunnel", server.WebSocketTCPAddr()),
+			})).To(Succeed())
+			echo("WebSocket through a proxy")
+			Expect(proxy.Targets()).To(Equal([]string{server.WebSocketTCPAddr().String()}))
+		})
+
+		It("should be taken from the environment", func() {
+			addr := startProxy(&mocks.MockProxy{})
+			os.Setenv("HTTPS_PROXY", "http://"+addr)
+			defer os.Unsetenv("HTTPS_PROXY")
+
+			os.Setenv("NO_PROXY", "127.0.0.1")
+			Expect(ProxyFromEnvironment(serverTCPAddr.String())).To(BeEmpty())
+			os.Unsetenv("NO_PROXY")
+			Expect(ProxyFromEnvironment(serverTCPAddr.String())).To(Equal("http://" + addr))
+
+			Expect(openTunnel(&GoRpsClient{})).To(Succeed())
+			echo("Through the environment's proxy")
+			Expect(proxy.Targets()).To(Equal([]string{serverTCPAddr.String()}))
+		})
+	})
+
+	Describe("SOCKS5", func() {
+		It("should reach the rps server through the proxy, logging in", func() {
+			addr := startProxy(&mocks.MockProxy{SOCKS5: true, User: "me", Password: "s3cret"})
+
+			err := openTunnel(&GoRpsClient{Proxy: "socks5://me:wrong@" + addr})
+			Expect(err).To(MatchError(ContainSubstring("rejected")))
+
+			Expect(openTunnel(&GoRpsClient{Proxy: "socks5://me:s3cret@" + addr})).To(Succeed())
+			echo("Through a SOCKS5 proxy")
+			Expect(proxy.Targets()).To(ContainElement(serverTCPAddr.String()))
+		})
+
+		It("should let the proxy resolve names", func() {
+			addr := startProxy(&mocks.MockProxy{SOCKS5: true})
+			Expect(openTunnel(&GoRpsClient{
+				Proxy:     "socks5://" + addr,
+				ServerURL: fmt.Sprintf("ws://localhost:%d/tunnel", server.WebSocketTCPAddr().Port),
+			})).To(Succeed())
+			echo("By name")
+			Expect(proxy.Targets()).To(Equal([]string{fmt.Sprintf("localhost:%d", server.WebSocketTCPAddr().Port)}))
+		})
+	})
+})
@@ -0,0 +1,156 @@
+package go_rps_test
+
+import (
+	"context"
+	"fmt"
+	. "github.com/andysctu/go-tunnel/client"
+	"github.com/andysctu/go-tunnel/recorder"
+	. "github.com/andysctu/go-tunnel/server"
+	"github.com/andysctu/go-tunnel/test/mocks"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("Recorder", func() {
+	var dir string
+	var capturePath string
+	var rec *recorder.Recorder
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "rps_capture")
+		Expect(err).NotTo(HaveOccurred())
+		capturePath = filepath.Join(dir, "capture.jsonl")
+		rec, err = recorder.New(capturePath)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		rec.Close()
+		os.RemoveAll(dir)
+	})
+
+	Describe("Recording a stream", func() {
+		It("should write every event with its direction", func() {
+			rec.Opened(7)
+			rec.Data(7, recorder.Inbound, []byte("Hello world"))
+			rec.Data(7, recorder.Outbound, []byte("Recorded server: Hello world"))
+			rec.Closed(7)
+			Expect(rec.Close()).To(Succeed())
+
+			records, err := recorder.ReadFile(capturePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(records).To(HaveLen(4))
+			Expect(records[0].Event).To(Equal(recorder.StreamOpen))
+			Expect(records[1].Direction).To(Equal(recorder.Inbound))
+			Expect(records[1].Data).To(Equal([]byte("Hello world")))
+			Expect(records[2].Direction).To(Equal(recorder.Outbound))
+			Expect(records[3].Event).To(Equal(recorder.StreamClose))
+		})
+	})
+
+	Describe("A capture file growing past its max size", func() {
+		It("should be rotated", func() {
+			rec.MaxSize = 512
+			for i := 0; i < 20; i++ {
+				rec.Data(1, recorder.Inbound, []byte(fmt.Sprintf("chunk %d of some recorded data", i)))
+			}
+			Expect(rec.Close()).To(Succeed())
+
+			_, err := os.Stat(capturePath + ".1")
+			Expect(err).NotTo(HaveOccurred())
+			info, err := os.Stat(capturePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Size()).To(BeNumerically("<=", 512))
+		})
+	})
+
+	Describe("Replaying a recorded session", func() {
+		It("should re-send the user's bytes and collect the protected server's answers", func() {
+			protectedServer := &mocks.MockProtectedServer{
+				ServerMessage: "Replay server",
+				Port:          3002,
+			}
+			protectedServer.StartProtectedServer()
+
+			rec.Opened(1)
+			rec.Data(1, recorder.Inbound, []byte("Message 1"))
+			rec.Data(1, recorder.Outbound, []byte("Replay server: Message 1"))
+			rec.Data(1, recorder.Inbound, []byte("Message 2"))
+			rec.Data(1, recorder.Outbound, []byte("Replay server: Message 2"))
+			rec.Closed(1)
+			Expect(rec.Close()).To(Succeed())
+
+			records, err := recorder.ReadFile(capturePath)
+			Expect(err).NotTo(HaveOccurred())
+
+			replies, err := recorder.Replay(records, fmt.Sprintf("127.0.0.1:%d", protectedServer.Port))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(replies[records[0].Key()])).To(Equal("Replay server: Message 1Replay server: Message 2"))
+		})
+	})
+
+	Describe("Recording tunnels", func() {
+		It("should keep the streams of every tunnel apart", func() {
+			psListener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			defer psListener.Close()
+			go func() {
+				for {
+					conn, err := psListener.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						io.Copy(conn, conn)
+						conn.Close()
+					}()
+				}
+			}()
+			psPort := psListener.Addr().(*net.TCPAddr).Port
+
+			// A fresh server numbers its users from the start again, like
+			// one the client reconnects to after a restart
+			for _, message := range []string{"First tunnel", "Second tunnel"} {
+				server := &GoRpsServer{Addr: "127.0.0.1:0"}
+				serverTCPAddr, err := server.Start()
+				Expect(err).NotTo(HaveOccurred())
+				client := &GoRpsClient{ServerTCPAddr: serverTCPAddr, TargetHost: "127.0.0.1", Recorder: rec}
+				Expect(client.OpenTunnel(psPort)).To(Succeed())
+
+				userConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", client.ExposedPort))
+				Expect(err).NotTo(HaveOccurred())
+				_, err = userConn.Write([]byte(message))
+				Expect(err).NotTo(HaveOccurred())
+				reply := make([]byte, len(message))
+				userConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+				_, err = io.ReadFull(userConn, reply)
+				Expect(err).NotTo(HaveOccurred())
+				userConn.Close()
+
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				client.Shutdown(ctx)
+				server.Shutdown(ctx)
+				cancel()
+			}
+			Expect(rec.Close()).To(Succeed())
+
+			records, err := recorder.ReadFile(capturePath)
+			Expect(err).NotTo(HaveOccurred())
+			streams := recorder.Streams(records)
+			Expect(streams).To(HaveLen(2))
+			Expect(streams[0].Stream).To(Equal(streams[1].Stream))
+
+			replies, err := recorder.Replay(records, psListener.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(replies[streams[0]])).To(Equal("First tunnel"))
+			Expect(string(replies[streams[1]])).To(Equal("Second tunnel"))
+		})
+	})
+})
@@ -0,0 +1,238 @@
+package go_rps_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/andysctu/go-tunnel/client"
+	"github.com/andysctu/go-tunnel/helper"
+	pb "github.com/andysctu/go-tunnel/protobuf"
+	. "github.com/andysctu/go-tunnel/server"
+	"github.com/andysctu/go-tunnel/webhook"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ = Describe("Stream resets", func() {
+	// A port nothing listens on
+	closedPort := func() int {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer listener.Close()
+		return listener.Addr().(*net.TCPAddr).Port
+	}
+
+	shutdown := func(client *GoRpsClient, server *GoRpsServer) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		client.Shutdown(ctx)
+		if server != nil {
+			server.Shutdown(ctx)
+		}
+	}
+
+	Describe("When the client resets a stream", func() {
+		It("should tell the webhook why", func() {
+			var mu sync.Mutex
+			var events []*webhook.Event
+			receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				event := &webhook.Event{}
+				body, _ := ioutil.ReadAll(r.Body)
+				json.Unmarshal(body, event)
+				mu.Lock()
+				events = append(events, event)
+				mu.Unlock()
+			}))
+			defer receiver.Close()
+
+			server := &GoRpsServer{Addr: "127.0.0.1:0", Webhook: webhook.New(receiver.URL, "")}
+			serverTCPAddr, err := server.Start()
+			Expect(err).NotTo(HaveOccurred())
+			client := &GoRpsClient{ServerTCPAddr: serverTCPAddr}
+			defer shutdown(client, server)
+			Expect(client.OpenTunnel(closedPort())).To(Succeed())
+
+			userConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", client.ExposedPort))
+			Expect(err).NotTo(HaveOccurred())
+			defer userConn.Close()
+			Eventually(func() string {
+				mu.Lock()
+				defer mu.Unlock()
+				for _, event := range events {
+					if event.Type == webhook.UserDisconnected {
+						return event.Reason
+					}
+				}
+				return ""
+			}).Should(Equal("DialRefused: Protected server unavailable"))
+		})
+	})
+
+	Describe("When the rps server resets a stream", func() {
+		var rpsListener, psListener net.Listener
+		var client *GoRpsClient
+		var events chan Event
+		var psConns chan net.Conn
+
+		BeforeEach(func() {
+			var err error
+			rpsListener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			psListener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			psConns = make(chan net.Conn, 4)
+			go func() {
+				for {
+					conn, err := psListener.Accept()
+					if err != nil {
+						return
+					}
+					psConns <- conn
+				}
+			}()
+			events = make(chan Event, 16)
+			client = &GoRpsClient{
+				ServerTCPAddr: rpsListener.Addr().(*net.TCPAddr),
+				TargetHost:    "127.0.0.1",
+				Events:        events,
+			}
+		})
+
+		AfterEach(func() {
+			shutdown(client, nil)
+			rpsListener.Close()
+			psListener.Close()
+		})
+
+		// Play the rps server: accept the client's hello and open streams 1 and
+		// 2, returning the protected server's end of each
+		openStreams := func() (net.Conn, []net.Conn) {
+			opened := make(chan error, 1)
+			go func() {
+				opened <- client.OpenTunnel(psListener.Addr().(*net.TCPAddr).Port)
+			}()
+			clientConn, err := rpsListener.Accept()
+			Expect(err).NotTo(HaveOccurred())
+			_, err = helper.ReceiveProtobuf(clientConn)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(helper.SendProtobuf(clientConn, &pb.TestMessage{Type: pb.TestMessage_ConnectionOpen, Id: -1, Data: []byte("4321")})).To(Succeed())
+			Eventually(opened).Should(Receive(BeNil()))
+			var streams []net.Conn
+			for id := int32(1); id <= 2; id++ {
+				Expect(helper.SendProtobuf(clientConn, &pb.TestMessage{Type: pb.TestMessage_ConnectionOpen, Id: id, Data: []byte("10.0.0.1:1234")})).To(Succeed())
+				var psConn net.Conn
+				Eventually(psConns).Should(Receive(&psConn))
+				streams = append(streams, psConn)
+			}
+			return clientConn, streams
+		}
+
+		It("should close only that stream and say why", func() {
+			clientConn, streams := openStreams()
+			defer clientConn.Close()
+			Expect(helper.SendProtobuf(clientConn, helper.ResetMessage(1, pb.TestMessage_Timeout, "User too slow"))).To(Succeed())
+
+			var event Event
+			Eventually(func() EventType {
+				select {
+				case event = <-events:
+				default:
+				}
+				return event.Type
+			}).Should(Equal(UserDisconnected))
+			Expect(event.UserId).To(Equal(int32(1)))
+			var reset *helper.ResetError
+			Expect(errors.As(event.Err, &reset)).To(BeTrue())
+			Expect(reset.Code).To(Equal(pb.TestMessage_Timeout))
+			Expect(reset.Error()).To(Equal("Timeout: User too slow"))
+
+			streams[0].SetReadDeadline(time.Now().Add(time.Second))
+			_, err := streams[0].Read(make([]byte, 1))
+			Expect(err).To(Equal(io.EOF))
+
+			// Stream 2 carries on, and nothing is sent back for stream 1
+			Expect(helper.SendProtobuf(clientConn, &pb.TestMessage{Type: pb.TestMessage_Data, Id: 2, Data: []byte("ping")})).To(Succeed())
+			ping := make([]byte, 4)
+			streams[1].SetReadDeadline(time.Now().Add(time.Second))
+			_, err = io.ReadFull(streams[1], ping)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(ping)).To(Equal("ping"))
+			clientConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			_, err = helper.ReceiveProtobuf(clientConn)
+			Expect(err).To(HaveOccurred())
+			Consistently(events, 100*time.Millisecond).ShouldNot(Receive())
+		})
+
+		It("should reset a stream the rps server opens twice", func() {
+			clientConn, _ := openStreams()
+			defer clientConn.Close()
+			Expect(helper.SendProtobuf(clientConn, &pb.TestMessage{Type: pb.TestMessage_ConnectionOpen, Id: 2, Data: []byte("10.0.0.1:1234")})).To(Succeed())
+
+			clientConn.SetReadDeadline(time.Now().Add(time.Second))
+			msg, err := helper.ReceiveProtobuf(clientConn)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msg.Type).To(Equal(pb.TestMessage_Reset))
+			Expect(msg.Id).To(Equal(int32(2)))
+			Expect(msg.Code).To(Equal(pb.TestMessage_ProtocolError))
+		})
+	})
+
+	Describe("Refusing HTTP users", func() {
+		It("should answer users from disallowed addresses with a 403", func() {
+			server := &GoRpsServer{Addr: "127.0.0.1:0"}
+			serverTCPAddr, err := server.Start()
+			Expect(err).NotTo(HaveOccurred())
+			_, network, _ := net.ParseCIDR("10.0.0.0/8")
+			server.SetPolicy(&Policy{AllowUsers: []*net.IPNet{network}})
+			client := &GoRpsClient{ServerTCPAddr: serverTCPAddr, Protocol: "http"}
+			defer shutdown(client, server)
+			Expect(client.OpenTunnel(closedPort())).To(Succeed())
+
+			res, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/", client.ExposedPort))
+			Expect(err).NotTo(HaveOccurred())
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusForbidden))
+			Expect(string(body)).To(ContainSubstring("Address not allowed"))
+		})
+
+		It("should answer users of an unreachable server once their headers arrive", func() {
+			server := &GoRpsServer{Addr: "127.0.0.1:0"}
+			serverTCPAddr, err := server.Start()
+			Expect(err).NotTo(HaveOccurred())
+			client := &GoRpsClient{ServerTCPAddr: serverTCPAddr, Protocol: "http"}
+			defer shutdown(client, server)
+			Expect(client.OpenTunnel(closedPort())).To(Succeed())
+
+			userConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", client.ExposedPort))
+			Expect(err).NotTo(HaveOccurred())
+			defer userConn.Close()
+			// Headers far bigger than a single read, the last of them late
+			fmt.Fprintf(userConn, "GET / HTTP/1.1\r\nHost: example.com\r\n")
+			for i := 0; i < 64; i++ {
+				fmt.Fprintf(userConn, "X-Filler-%d: %s\r\n", i, strings.Repeat("a", 256))
+			}
+			userConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			_, err = userConn.Read(make([]byte, 1))
+			Expect(err).To(MatchError(ContainSubstring("timeout")))
+
+			fmt.Fprintf(userConn, "Connection: close\r\n\r\n")
+			userConn.SetReadDeadline(time.Now().Add(time.Second))
+			res, err := http.ReadResponse(bufio.NewReader(userConn), nil)
+			Expect(err).NotTo(HaveOccurred())
+			body, _ := io.ReadAll(res.Body)
+			Expect(res.StatusCode).To(Equal(http.StatusServiceUnavailable))
+			Expect(string(body)).To(ContainSubstring("Protected server unavailable"))
+		})
+	})
+})
@@ -0,0 +1,161 @@
+package go_rps_test
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	. "github.com/andysctu/go-tunnel/client"
+	. "github.com/andysctu/go-tunnel/server"
+	"github.com/andysctu/go-tunnel/transport"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+var _ = Describe("SOCKS5 tunnels", func() {
+	var server *GoRpsServer
+	var serverTCPAddr *net.TCPAddr
+	var client *GoRpsClient
+	var psListener net.Listener
+	var psPort int
+
+	BeforeEach(func() {
+		server = &GoRpsServer{Addr: "127.0.0.1:0"}
+		var err error
+		serverTCPAddr, err = server.Start()
+		Expect(err).NotTo(HaveOccurred())
+
+		psListener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		psPort = psListener.Addr().(*net.TCPAddr).Port
+		go func() {
+			for {
+				conn, err := psListener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					io.Copy(conn, conn)
+					conn.Close()
+				}()
+			}
+		}()
+	})
+
+	AfterEach(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if client != nil {
+			client.Shutdown(ctx)
+			client = nil
+		}
+		server.Shutdown(ctx)
+		psListener.Close()
+	})
+
+	openTunnel := func(c *GoRpsClient) error {
+		client = c
+		client.ServerTCPAddr = serverTCPAddr
+		client.Protocol = "socks5"
+		return client.OpenTunnel(0)
+	}
+
+	// Ask the tunnel to connect to host:port, returning the reply code
+	connect := func(host string, port int) (net.Conn, byte) {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", client.ExposedPort))
+		Expect(err).NotTo(HaveOccurred())
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+		_, err = conn.Write([]byte{5, 1, 0})
+		Expect(err).NotTo(HaveOccurred())
+		method := make([]byte, 2)
+		_, err = io.ReadFull(conn, method)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(method).To(Equal([]byte{5, 0}))
+
+		request := []byte{5, 1, 0}
+		if ip := net.ParseIP(host).To4(); ip != nil {
+			request = append(append(request, 1), ip...)
+		} else {
+			request = append(append(request, 3, byte(len(host))), host...)
+		}
+		request = binary.BigEndian.AppendUint16(request, uint16(port))
+		_, err = conn.Write(request)
+		Expect(err).NotTo(HaveOccurred())
+		reply := make([]byte, 10)
+		_, err = io.ReadFull(conn, reply)
+		Expect(err).NotTo(HaveOccurred())
+		return conn, reply[1]
+	}
+
+	echo := func(conn net.Conn, message string) {
+		_, err := conn.Write([]byte(message))
+		Expect(err).NotTo(HaveOccurred())
+		reply := make([]byte, len(message))
+		_, err = io.ReadFull(conn, reply)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(reply)).To(Equal(message))
+	}
+
+	It("should connect users to the destination they ask for", func() {
+		for _, name := range []string{transport.Mux, transport.Frames} {
+			Expect(openTunnel(&GoRpsClient{Transport: name, AllowTargets: []string{"127.0.0.0/8"}})).To(Succeed())
+			conn, code := connect("127.0.0.1", psPort)
+			Expect(code).To(BeEquivalentTo(0))
+			echo(conn, "Through SOCKS5 with "+name)
+			conn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			client.Shutdown(ctx)
+			cancel()
+		}
+	})
+
+	It("should let the client resolve host names", func() {
+		Expect(openTunnel(&GoRpsClient{AllowTargets: []string{"localhost:" + strconv.Itoa(psPort)}})).To(Succeed())
+		conn, code := connect("localhost", psPort)
+		Expect(code).To(BeEquivalentTo(0))
+		defer conn.Close()
+		echo(conn, "By name")
+	})
+
+	It("should check the addresses of host names against IP rules", func() {
+		Expect(openTunnel(&GoRpsClient{AllowTargets: []string{"127.0.0.1"}})).To(Succeed())
+		conn, code := connect("localhost", psPort)
+		Expect(code).To(BeEquivalentTo(0))
+		defer conn.Close()
+		echo(conn, "Resolved and allowed")
+	})
+
+	It("should refuse destinations that aren't allowed", func() {
+		Expect(openTunnel(&GoRpsClient{AllowTargets: []string{"127.0.0.1:1", "*.internal"}})).To(Succeed())
+		conn, code := connect("127.0.0.1", psPort)
+		conn.Close()
+		Expect(code).To(BeEquivalentTo(2))
+
+		conn, code = connect("localhost", psPort)
+		conn.Close()
+		Expect(code).To(BeEquivalentTo(2))
+	})
+
+	It("should tell users when the destination refuses them", func() {
+		closed, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		closedPort := closed.Addr().(*net.TCPAddr).Port
+		closed.Close()
+
+		Expect(openTunnel(&GoRpsClient{AllowTargets: []string{"*"}})).To(Succeed())
+		conn, code := connect("127.0.0.1", closedPort)
+		conn.Close()
+		Expect(code).To(BeEquivalentTo(5))
+	})
+
+	It("should need destinations to allow", func() {
+		Expect(openTunnel(&GoRpsClient{})).To(MatchError(ContainSubstring("allow")))
+		Expect(openTunnel(&GoRpsClient{AllowTargets: []string{"10.0.0.0/33"}})).To(MatchError(ContainSubstring("10.0.0.0/33")))
+		client = nil
+	})
+})
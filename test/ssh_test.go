@@ -0,0 +1,161 @@
+package go_rps_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	. "github.com/andysctu/go-tunnel/server"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+var _ = Describe("SSH clients", func() {
+	var server *GoRpsServer
+	var hostKey ssh.Signer
+	var sshClient *ssh.Client
+
+	newKey := func() ssh.Signer {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		signer, err := ssh.NewSignerFromKey(key)
+		Expect(err).NotTo(HaveOccurred())
+		return signer
+	}
+
+	BeforeEach(func() {
+		hostKey = newKey()
+		server = &GoRpsServer{Addr: "127.0.0.1:0", UserAddr: "127.0.0.1", SSHAddr: "127.0.0.1:0", SSHHostKey: hostKey}
+		_, err := server.Start()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		if sshClient != nil {
+			sshClient.Close()
+			sshClient = nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+
+	dial := func(key ssh.Signer) error {
+		var err error
+		sshClient, err = ssh.Dial("tcp", server.SSHTCPAddr().String(), &ssh.ClientConfig{
+			User:            "teammate",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(key)},
+			HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+			Timeout:         2 * time.Second,
+		})
+		return err
+	}
+
+	// Like ssh -R 0:..., echoing whatever users send
+	forward := func() net.Listener {
+		listener, err := sshClient.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					io.Copy(conn, conn)
+					conn.Close()
+				}()
+			}
+		}()
+		return listener
+	}
+
+	echo := func(port int, message string) {
+		userConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		Expect(err).NotTo(HaveOccurred())
+		defer userConn.Close()
+		_, err = userConn.Write([]byte(message))
+		Expect(err).NotTo(HaveOccurred())
+		reply := make([]byte, len(message))
+		userConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = io.ReadFull(userConn, reply)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(reply)).To(Equal(message))
+	}
+
+	It("should open a tunnel for every remote forward", func() {
+		Expect(dial(newKey())).To(Succeed())
+		first := forward()
+		second := forward()
+		firstPort := first.Addr().(*net.TCPAddr).Port
+		secondPort := second.Addr().(*net.TCPAddr).Port
+		Expect(firstPort).NotTo(Equal(secondPort))
+
+		echo(firstPort, "Over ssh")
+		echo(secondPort, "Over ssh again")
+
+		// Cancelling one forward leaves the other open
+		Expect(first.Close()).To(Succeed())
+		Eventually(func() error {
+			conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", firstPort))
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}).Should(HaveOccurred())
+		echo(secondPort, "Still open")
+	})
+
+	It("should tell the session where its tunnels are", func() {
+		Expect(dial(newKey())).To(Succeed())
+		listener := forward()
+		session, err := sshClient.NewSession()
+		Expect(err).NotTo(HaveOccurred())
+		stdout, err := session.StdoutPipe()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(session.Shell()).To(Succeed())
+
+		line, err := bufio.NewReader(stdout).ReadString('\n')
+		Expect(err).NotTo(HaveOccurred())
+		Expect(strings.TrimSpace(line)).To(Equal(fmt.Sprintf("Tunnel opened! Go here: %s", listener.Addr())))
+	})
+
+	It("should only let authorized keys in", func() {
+		key := newKey()
+		server.SetPolicy(&Policy{AuthorizedKeys: []ssh.PublicKey{key.PublicKey()}})
+		Expect(dial(newKey())).NotTo(Succeed())
+		Expect(dial(key)).To(Succeed())
+		echo(forward().Addr().(*net.TCPAddr).Port, "Authorized")
+	})
+
+	It("should need an authorized key when clients need a token", func() {
+		server.SetPolicy(&Policy{Tokens: []string{"s3cret"}})
+		Expect(dial(newKey())).NotTo(Succeed())
+	})
+
+	It("should count ssh tunnels against the tunnel limit", func() {
+		server.SetPolicy(&Policy{MaxTunnels: 1})
+		Expect(dial(newKey())).To(Succeed())
+		forward()
+		_, err := sshClient.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should parse authorized keys files", func() {
+		key := newKey()
+		data := "# teammates\n\n" + string(ssh.MarshalAuthorizedKey(key.PublicKey()))
+		keys, err := ParseAuthorizedKeys([]byte(data))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keys).To(HaveLen(1))
+		Expect(keys[0].Marshal()).To(Equal(key.PublicKey().Marshal()))
+
+		_, err = ParseAuthorizedKeys([]byte(data + "ssh-ed25519 nope\n"))
+		Expect(err).To(MatchError(HavePrefix("line 4")))
+	})
+})
@@ -0,0 +1,143 @@
+package go_rps_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	. "github.com/andysctu/go-tunnel/client"
+	. "github.com/andysctu/go-tunnel/server"
+	"github.com/andysctu/go-tunnel/test/mocks"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+)
+
+var _ = Describe("TLS to the protected server", func() {
+	var server *GoRpsServer
+	var serverTCPAddr *net.TCPAddr
+	var client *GoRpsClient
+	var psServer *httptest.Server
+	var psPort int
+
+	BeforeEach(func() {
+		server = &GoRpsServer{Addr: "127.0.0.1:0"}
+		var err error
+		serverTCPAddr, err = server.Start()
+		Expect(err).NotTo(HaveOccurred())
+
+		psServer = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "Hello over %s", r.Proto)
+		}))
+	})
+
+	AfterEach(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if client != nil {
+			client.Shutdown(ctx)
+			client = nil
+		}
+		server.Shutdown(ctx)
+		psServer.Close()
+	})
+
+	startTLS := func() {
+		psServer.StartTLS()
+		psPort = psServer.Listener.Addr().(*net.TCPAddr).Port
+	}
+
+	openTunnel := func(c *GoRpsClient) error {
+		client = c
+		client.ServerTCPAddr = serverTCPAddr
+		client.TargetHost = "127.0.0.1"
+		return client.OpenTunnel(psPort)
+	}
+
+	// GET the tunnel in plain HTTP
+	get := func() (*http.Response, string, error) {
+		httpClient := &http.Client{Timeout: 2 * time.Second}
+		resp, err := httpClient.Get(fmt.Sprintf("http://127.0.0.1:%d/", client.ExposedPort))
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return resp, string(body), err
+	}
+
+	trustPS := func() *x509.CertPool {
+		pool := x509.NewCertPool()
+		pool.AddCert(psServer.Certificate())
+		return pool
+	}
+
+	It("should let users reach an https-only server over plain HTTP", func() {
+		startTLS()
+		Expect(openTunnel(&GoRpsClient{TargetTLS: &tls.Config{RootCAs: trustPS()}})).To(Succeed())
+		resp, body, err := get()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("Hello over HTTP/1.1"))
+	})
+
+	It("should not connect users to a server it doesn't trust", func() {
+		startTLS()
+		Expect(openTunnel(&GoRpsClient{Protocol: "http", TargetTLS: &tls.Config{}})).To(Succeed())
+		resp, _, err := get()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	It("should verify the server name it is told to", func() {
+		startTLS()
+		// The test server's certificate is also for example.com
+		Expect(openTunnel(&GoRpsClient{TargetTLS: &tls.Config{RootCAs: trustPS(), ServerName: "example.com"}})).To(Succeed())
+		_, body, err := get()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(body).To(Equal("Hello over HTTP/1.1"))
+	})
+
+	It("should present a client certificate from files", func() {
+		dir, err := ioutil.TempDir("", "rps_target_tls")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		certFile, keyFile, err := mocks.WriteSelfSignedCert(dir, "rps-client")
+		Expect(err).NotTo(HaveOccurred())
+		certPEM, err := ioutil.ReadFile(certFile)
+		Expect(err).NotTo(HaveOccurred())
+		clientCAs := x509.NewCertPool()
+		clientCAs.AppendCertsFromPEM(certPEM)
+		psServer.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+		startTLS()
+
+		targetTLS, err := (&TargetTLS{InsecureSkipVerify: true, CertFile: certFile, KeyFile: keyFile}).Config()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(openTunnel(&GoRpsClient{TargetTLS: targetTLS})).To(Succeed())
+		_, body, err := get()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(body).To(Equal("Hello over HTTP/1.1"))
+
+		_, err = (&TargetTLS{CertFile: certFile}).Config()
+		Expect(err).To(MatchError(ContainSubstring("key_file")))
+	})
+
+	It("should check the server over TLS", func() {
+		startTLS()
+		events := make(chan Event, 10)
+		c := &GoRpsClient{
+			TargetTLS:   &tls.Config{RootCAs: trustPS()},
+			HealthCheck: &HealthCheck{Interval: 50 * time.Millisecond, Path: "/"},
+			Events:      events,
+		}
+		Expect(openTunnel(c)).To(Succeed())
+		Consistently(events, 300*time.Millisecond).ShouldNot(Receive(WithTransform(func(e Event) EventType {
+			return e.Type
+		}, Equal(Unhealthy))))
+	})
+})
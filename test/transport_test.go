@@ -0,0 +1,165 @@
+package go_rps_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	. "github.com/andysctu/go-tunnel/client"
+	"github.com/andysctu/go-tunnel/helper"
+	pb "github.com/andysctu/go-tunnel/protobuf"
+	. "github.com/andysctu/go-tunnel/server"
+	"github.com/andysctu/go-tunnel/transport"
+	"github.com/golang/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"net"
+	"time"
+)
+
+var _ = Describe("Transports", func() {
+	var server *GoRpsServer
+	var client *GoRpsClient
+	var psListener net.Listener
+	var stalled chan net.Conn
+
+	// A protected server that echoes, except to users whose first byte is
+	// 's', whom it stops reading from
+	startProtectedServer := func() {
+		var err error
+		psListener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		stalled = make(chan net.Conn, 4)
+		go func() {
+			for {
+				conn, err := psListener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					first := make([]byte, 1)
+					if _, err := io.ReadFull(conn, first); err != nil {
+						conn.Close()
+						return
+					}
+					if first[0] == 's' {
+						stalled <- conn
+						return
+					}
+					conn.Write(first)
+					io.Copy(conn, conn)
+					conn.Close()
+				}()
+			}
+		}()
+	}
+
+	open := func(name string) {
+		startProtectedServer()
+		server = &GoRpsServer{Addr: "127.0.0.1:0"}
+		serverTCPAddr, err := server.Start()
+		Expect(err).NotTo(HaveOccurred())
+		client = &GoRpsClient{ServerTCPAddr: serverTCPAddr, TargetHost: "127.0.0.1", Transport: name}
+		Expect(client.OpenTunnel(psListener.Addr().(*net.TCPAddr).Port)).To(Succeed())
+	}
+
+	dialUser := func() net.Conn {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", client.ExposedPort))
+		Expect(err).NotTo(HaveOccurred())
+		return conn
+	}
+
+	echo := func(conn net.Conn, data []byte) {
+		go conn.Write(data)
+		got := make([]byte, len(data))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := io.ReadFull(conn, got)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bytes.Equal(got, data)).To(BeTrue())
+	}
+
+	AfterEach(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		client.Shutdown(ctx)
+		server.Shutdown(ctx)
+		psListener.Close()
+		for {
+			select {
+			case conn := <-stalled:
+				conn.Close()
+				continue
+			default:
+			}
+			break
+		}
+	})
+
+	for _, name := range []string{transport.Frames, transport.Mux, ""} {
+		name := name
+		Describe(fmt.Sprintf("With transport %q", name), func() {
+			It("should carry several users at once", func() {
+				open(name)
+				data := make([]byte, 256*1024)
+				rand.Read(data)
+				done := make(chan bool, 3)
+				for i := 0; i < 3; i++ {
+					go func() {
+						defer GinkgoRecover()
+						conn := dialUser()
+						defer conn.Close()
+						echo(conn, data)
+						done <- true
+					}()
+				}
+				for i := 0; i < 3; i++ {
+					Eventually(done, 10*time.Second).Should(Receive())
+				}
+			})
+		})
+	}
+
+	Describe("With the mux transport", func() {
+		It("should not let a user the protected server stops reading hold up the others", func() {
+			open(transport.Mux)
+			slow := dialUser()
+			defer slow.Close()
+			// Far more than the protected server, the kernel and yamux buffer
+			go func() {
+				slow.Write([]byte("s"))
+				slow.Write(make([]byte, 16*1024*1024))
+			}()
+			Eventually(stalled, 5*time.Second).Should(Receive(Not(BeNil())))
+			time.Sleep(200 * time.Millisecond)
+
+			conn := dialUser()
+			defer conn.Close()
+			echo(conn, []byte("hello"))
+		})
+	})
+})
+
+var _ = Describe("Rps servers from before frames", func() {
+	It("should be told apart from broken ones", func() {
+		// They speak first, with a bare protobuf
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer listener.Close()
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			out, _ := proto.Marshal(&pb.TestMessage{Type: pb.TestMessage_ConnectionOpen, Id: -1, Data: []byte("4321")})
+			conn.Write(out)
+			io.Copy(io.Discard, conn)
+		}()
+
+		client := &GoRpsClient{ServerTCPAddr: listener.Addr().(*net.TCPAddr)}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		Expect(client.OpenTunnelContext(ctx, 0)).To(MatchError(helper.ErrUnframed))
+	})
+})
@@ -0,0 +1,164 @@
+package go_rps_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	. "github.com/andysctu/go-tunnel/client"
+	. "github.com/andysctu/go-tunnel/server"
+	"github.com/andysctu/go-tunnel/webhook"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+var _ = Describe("Webhook", func() {
+	var receiver *httptest.Server
+	var mu sync.Mutex
+	var received []*http.Request
+	var bodies [][]byte
+	var failures int
+
+	BeforeEach(func() {
+		received = nil
+		bodies = nil
+		failures = 0
+		receiver = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			if failures > 0 {
+				failures--
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			received = append(received, r)
+			bodies = append(bodies, body)
+		}))
+	})
+
+	AfterEach(func() {
+		receiver.Close()
+	})
+
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received)
+	}
+
+	Describe("Notifying an event", func() {
+		It("should POST a signed JSON event", func() {
+			notifier := webhook.New(receiver.URL, "shh")
+			notifier.PublicHost = "rps.example.com"
+			notifier.Notify(&webhook.Event{
+				Type:        webhook.TunnelOpened,
+				ExposedPort: 4242,
+			})
+			notifier.Close()
+
+			Expect(count()).To(Equal(1))
+			Expect(received[0].Header.Get(webhook.EventHeader)).To(Equal(string(webhook.TunnelOpened)))
+			Expect(received[0].Header.Get(webhook.SignatureHeader)).To(Equal(webhook.Sign("shh", bodies[0])))
+
+			event := &webhook.Event{}
+			Expect(json.Unmarshal(bodies[0], event)).To(Succeed())
+			Expect(event.Type).To(Equal(webhook.TunnelOpened))
+			Expect(event.Address).To(Equal("rps.example.com:4242"))
+		})
+	})
+
+	Describe("A receiver that fails", func() {
+		It("should be retried until it accepts the event", func() {
+			mu.Lock()
+			failures = 2
+			mu.Unlock()
+
+			notifier := webhook.New(receiver.URL, "")
+			notifier.RetryDelay = 10 * time.Millisecond
+			notifier.Notify(&webhook.Event{Type: webhook.UserConnected})
+			notifier.Close()
+
+			Expect(count()).To(Equal(1))
+			Expect(received[0].Header.Get(webhook.SignatureHeader)).To(BeEmpty())
+		})
+	})
+
+	Describe("A closed notifier", func() {
+		It("should drop new events", func() {
+			notifier := webhook.New(receiver.URL, "")
+			notifier.Close()
+			notifier.Notify(&webhook.Event{Type: webhook.UserConnected})
+			notifier.Close()
+			Expect(count()).To(Equal(0))
+		})
+	})
+
+	Describe("A server's notifier", func() {
+		It("should deliver signed events for its tunnels and users", func() {
+			psListener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			defer psListener.Close()
+			go func() {
+				for {
+					conn, err := psListener.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						io.Copy(conn, conn)
+						conn.Close()
+					}()
+				}
+			}()
+
+			server := &GoRpsServer{Addr: "127.0.0.1:0", Webhook: webhook.New(receiver.URL, "shh")}
+			server.SetPolicy(&Policy{Tokens: []string{"s3cret"}})
+			serverTCPAddr, err := server.Start()
+			Expect(err).NotTo(HaveOccurred())
+
+			intruder := &GoRpsClient{ServerTCPAddr: serverTCPAddr, Token: "guess"}
+			Expect(intruder.OpenTunnel(psListener.Addr().(*net.TCPAddr).Port)).NotTo(Succeed())
+
+			client := &GoRpsClient{ServerTCPAddr: serverTCPAddr, TargetHost: "127.0.0.1", Token: "s3cret"}
+			Expect(client.OpenTunnel(psListener.Addr().(*net.TCPAddr).Port)).To(Succeed())
+			userConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", client.ExposedPort))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = userConn.Write([]byte("Hello"))
+			Expect(err).NotTo(HaveOccurred())
+			userConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			_, err = io.ReadFull(userConn, make([]byte, 5))
+			Expect(err).NotTo(HaveOccurred())
+			userConn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			client.Shutdown(ctx)
+			Expect(server.Shutdown(ctx)).To(Succeed())
+			server.Webhook.Close()
+
+			mu.Lock()
+			defer mu.Unlock()
+			var types []webhook.EventType
+			for i, r := range received {
+				Expect(r.Header.Get(webhook.SignatureHeader)).To(Equal(webhook.Sign("shh", bodies[i])))
+				event := &webhook.Event{}
+				Expect(json.Unmarshal(bodies[i], event)).To(Succeed())
+				Expect(r.Header.Get(webhook.EventHeader)).To(Equal(string(event.Type)))
+				types = append(types, event.Type)
+			}
+			Expect(types).To(ContainElement(webhook.AuthFailed))
+			Expect(types).To(ContainElement(webhook.ClientConnected))
+			Expect(types).To(ContainElement(webhook.TunnelOpened))
+			Expect(types).To(ContainElement(webhook.UserConnected))
+			Expect(types).To(ContainElement(webhook.UserDisconnected))
+			Expect(types).To(ContainElement(webhook.TunnelClosed))
+		})
+	})
+})
@@ -0,0 +1,151 @@
+package go_rps_test
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	. "github.com/andysctu/go-tunnel/client"
+	. "github.com/andysctu/go-tunnel/server"
+	"github.com/andysctu/go-tunnel/test/mocks"
+	"github.com/andysctu/go-tunnel/transport"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+var _ = Describe("WebSocket clients", func() {
+	var server *GoRpsServer
+	var serverTCPAddr *net.TCPAddr
+	var clients []*GoRpsClient
+	var psListener net.Listener
+
+	BeforeEach(func() {
+		var err error
+		psListener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		go func() {
+			for {
+				conn, err := psListener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					io.Copy(conn, conn)
+					conn.Close()
+				}()
+			}
+		}()
+	})
+
+	AfterEach(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		for _, client := range clients {
+			client.Shutdown(ctx)
+		}
+		clients = nil
+		server.Shutdown(ctx)
+		psListener.Close()
+	})
+
+	start := func(s *GoRpsServer) {
+		server = s
+		var err error
+		serverTCPAddr, err = server.Start()
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	openTunnel := func(client *GoRpsClient) error {
+		client.TargetHost = "127.0.0.1"
+		clients = append(clients, client)
+		return client.OpenTunnel(psListener.Addr().(*net.TCPAddr).Port)
+	}
+
+	echo := func(port int, message string) {
+		userConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		Expect(err).NotTo(HaveOccurred())
+		defer userConn.Close()
+		_, err = userConn.Write([]byte(message))
+		Expect(err).NotTo(HaveOccurred())
+		reply := make([]byte, len(message))
+		userConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = io.ReadFull(userConn, reply)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(reply)).To(Equal(message))
+	}
+
+	It("should carry tunnels alongside raw TCP clients", func() {
+		start(&GoRpsServer{Addr: "127.0.0.1:0", WebSocketAddr: "127.0.0.1:0"})
+		wsURL := fmt.Sprintf("ws://%s/tunnel", server.WebSocketTCPAddr())
+
+		for _, name := range []string{transport.Mux, transport.Frames} {
+			client := &GoRpsClient{ServerTCPAddr: serverTCPAddr, ServerURL: wsURL, Transport: name}
+			Expect(openTunnel(client)).To(Succeed())
+			echo(client.ExposedPort, "Over a WebSocket with "+name)
+		}
+
+		client := &GoRpsClient{ServerTCPAddr: serverTCPAddr}
+		Expect(openTunnel(client)).To(Succeed())
+		echo(client.ExposedPort, "Over TCP")
+	})
+
+	It("should only upgrade requests for its path", func() {
+		start(&GoRpsServer{Addr: "127.0.0.1:0", WebSocketAddr: "127.0.0.1:0", WebSocketPath: "/rps"})
+		wsAddr := server.WebSocketTCPAddr()
+
+		err := openTunnel(&GoRpsClient{ServerTCPAddr: serverTCPAddr, ServerURL: fmt.Sprintf("ws://%s/tunnel", wsAddr)})
+		Expect(err).To(MatchError(ContainSubstring("404")))
+
+		res, err := http.Get(fmt.Sprintf("http://%s/rps", wsAddr))
+		Expect(err).NotTo(HaveOccurred())
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+
+		client := &GoRpsClient{ServerTCPAddr: serverTCPAddr, ServerURL: fmt.Sprintf("ws://%s/rps", wsAddr)}
+		Expect(openTunnel(client)).To(Succeed())
+		echo(client.ExposedPort, "Right path")
+	})
+
+	It("should serve wss when the server has TLS", func() {
+		cert, pool, err := mocks.SelfSignedCert("127.0.0.1")
+		Expect(err).NotTo(HaveOccurred())
+		start(&GoRpsServer{
+			Addr:          "127.0.0.1:0",
+			WebSocketAddr: "127.0.0.1:0",
+			TLSConfig:     &tls.Config{Certificates: []tls.Certificate{cert}},
+		})
+
+		client := &GoRpsClient{
+			ServerTCPAddr: serverTCPAddr,
+			ServerURL:     fmt.Sprintf("wss://%s/tunnel", server.WebSocketTCPAddr()),
+			TLSConfig:     &tls.Config{RootCAs: pool},
+		}
+		Expect(openTunnel(client)).To(Succeed())
+		echo(client.ExposedPort, "Over wss")
+	})
+
+	It("should resolve ws and wss URLs to the server's address", func() {
+		tcpAddr, host, url, err := ResolveServer("wss://127.0.0.1/tunnel")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(host).To(Equal("127.0.0.1"))
+		Expect(url).To(Equal("wss://127.0.0.1/tunnel"))
+		Expect(tcpAddr.String()).To(Equal("127.0.0.1:443"))
+
+		tcpAddr, _, _, err = ResolveServer("ws://127.0.0.1:8080/tunnel")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tcpAddr.String()).To(Equal("127.0.0.1:8080"))
+
+		tcpAddr, _, url, err = ResolveServer("127.0.0.1:34567")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(url).To(BeEmpty())
+		Expect(tcpAddr.Port).To(Equal(34567))
+
+		// The name is kept to verify the server's certificate for
+		_, host, _, err = ResolveServer("localhost:34567")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(host).To(Equal("localhost"))
+	})
+})
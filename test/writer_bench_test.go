@@ -0,0 +1,80 @@
+package go_rps_test
+
+import (
+	"github.com/andysctu/go-tunnel/helper"
+	pb "github.com/andysctu/go-tunnel/protobuf"
+	"net"
+	"testing"
+)
+
+// Throughput of data frames sent to a control connection from many
+// goroutines at once, the way users' streams share a tunnel.
+//
+//	go test ./test -run NONE -bench Send
+
+// Every goroutine writes its frames straight to the connection
+func BenchmarkSendDirect(b *testing.B) {
+	benchmarkSend(b, func(conn net.Conn) (func(*pb.TestMessage) error, func()) {
+		return func(msg *pb.TestMessage) error {
+			return helper.SendProtobuf(conn, msg)
+		}, func() {}
+	})
+}
+
+// Every goroutine queues its frames for one FrameWriter
+func BenchmarkSendFrameWriter(b *testing.B) {
+	benchmarkSend(b, func(conn net.Conn) (func(*pb.TestMessage) error, func()) {
+		writer := helper.NewFrameWriter(conn, 0, 0)
+		return writer.Send, func() { writer.Close() }
+	})
+}
+
+func benchmarkSend(b *testing.B, newSender func(net.Conn) (func(*pb.TestMessage) error, func())) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	peer, err := listener.AcceptTCP()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer peer.Close()
+
+	// Read frames as fast as the rps server would
+	received := make(chan int)
+	go func() {
+		count := 0
+		for count < b.N {
+			_, err := helper.ReceiveProtobuf(peer)
+			if err != nil {
+				break
+			}
+			count++
+		}
+		received <- count
+	}()
+
+	send, stop := newSender(conn)
+	defer stop()
+	msg := &pb.TestMessage{Type: pb.TestMessage_Data, Id: 1, Data: make([]byte, 1024)}
+	b.SetBytes(int64(len(msg.Data)))
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(p *testing.PB) {
+		for p.Next() {
+			if err := send(msg); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	if count := <-received; count != b.N {
+		b.Fatalf("received %d of %d frames", count, b.N)
+	}
+}
@@ -0,0 +1,148 @@
+package go_rps_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/andysctu/go-tunnel/helper"
+	pb "github.com/andysctu/go-tunnel/protobuf"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+var _ = Describe("FrameWriter", func() {
+	var local, remote net.Conn
+	var writer *helper.FrameWriter
+
+	BeforeEach(func() {
+		local, remote = net.Pipe()
+	})
+
+	AfterEach(func() {
+		if writer != nil {
+			writer.Close()
+		}
+		local.Close()
+		remote.Close()
+	})
+
+	dataMsg := func(id int32, data string) *pb.TestMessage {
+		return &pb.TestMessage{Type: pb.TestMessage_Data, Id: id, Data: []byte(data)}
+	}
+
+	Describe("Sending from many goroutines", func() {
+		It("should write every frame whole", func(done Done) {
+			writer = helper.NewFrameWriter(local, 4, time.Second)
+			senders, perSender := 10, 50
+			for s := 0; s < senders; s++ {
+				go func(s int) {
+					for m := 0; m < perSender; m++ {
+						writer.Send(dataMsg(int32(s), fmt.Sprintf("message %d from %d", m, s)))
+					}
+				}(s)
+			}
+
+			// Each sender's frames arrive whole and in order
+			next := make(map[int32]int)
+			for i := 0; i < senders*perSender; i++ {
+				msg, err := helper.ReceiveProtobuf(remote)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(msg.Data)).To(Equal(fmt.Sprintf("message %d from %d", next[msg.Id], msg.Id)))
+				next[msg.Id]++
+			}
+			close(done)
+		}, 5)
+	})
+
+	Describe("Sending a control message behind queued data", func() {
+		It("should write the control message first", func(done Done) {
+			writer = helper.NewFrameWriter(local, 16, time.Second)
+			Expect(writer.Send(dataMsg(1, "first"))).To(Succeed())
+
+			// Once the first frame is being read the writer is busy with it alone
+			header := make([]byte, 4)
+			_, err := io.ReadFull(remote, header)
+			Expect(err).NotTo(HaveOccurred())
+
+			for i := 0; i < 3; i++ {
+				Expect(writer.Send(dataMsg(1, "queued"))).To(Succeed())
+			}
+			Expect(writer.Send(&pb.TestMessage{Type: pb.TestMessage_ConnectionOpen, Id: 2})).To(Succeed())
+
+			body, err := helper.MarshalFrame(dataMsg(1, "first"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = io.ReadFull(remote, make([]byte, len(body)-4))
+			Expect(err).NotTo(HaveOccurred())
+
+			msg, err := helper.ReceiveProtobuf(remote)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msg.Type).To(Equal(pb.TestMessage_ConnectionOpen))
+			for i := 0; i < 3; i++ {
+				msg, err = helper.ReceiveProtobuf(remote)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(msg.Data)).To(Equal("queued"))
+			}
+			close(done)
+		}, 5)
+
+		It("should keep a stream's close behind the stream's data", func(done Done) {
+			writer = helper.NewFrameWriter(local, 16, time.Second)
+			Expect(writer.Send(dataMsg(1, "first"))).To(Succeed())
+			header := make([]byte, 4)
+			_, err := io.ReadFull(remote, header)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(writer.Send(dataMsg(1, "last"))).To(Succeed())
+			Expect(writer.Send(&pb.TestMessage{Type: pb.TestMessage_ConnectionClose, Id: 1})).To(Succeed())
+
+			body, err := helper.MarshalFrame(dataMsg(1, "first"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = io.ReadFull(remote, make([]byte, len(body)-4))
+			Expect(err).NotTo(HaveOccurred())
+
+			msg, err := helper.ReceiveProtobuf(remote)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(msg.Data)).To(Equal("last"))
+			msg, err = helper.ReceiveProtobuf(remote)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msg.Type).To(Equal(pb.TestMessage_ConnectionClose))
+			close(done)
+		}, 5)
+	})
+
+	Describe("Writing to a peer that stopped reading", func() {
+		It("should give up once the write timeout passes", func(done Done) {
+			writer = helper.NewFrameWriter(local, 1, 50*time.Millisecond)
+			Eventually(func() error {
+				return writer.Send(dataMsg(1, "nobody is reading"))
+			}).Should(HaveOccurred())
+			Expect(errors.Is(writer.Err(), os.ErrDeadlineExceeded)).To(BeTrue())
+
+			// The connection is closed along with the writer
+			_, err := local.Write([]byte("more"))
+			Expect(err).To(HaveOccurred())
+			close(done)
+		}, 5)
+	})
+
+	Describe("Closing", func() {
+		It("should flush queued control messages", func(done Done) {
+			writer = helper.NewFrameWriter(local, 16, time.Second)
+			received := make(chan *pb.TestMessage, 1)
+			go func() {
+				defer GinkgoRecover()
+				msg, err := helper.ReceiveProtobuf(remote)
+				Expect(err).NotTo(HaveOccurred())
+				received <- msg
+			}()
+			Expect(writer.Send(&pb.TestMessage{Type: pb.TestMessage_ConnectionClose, Id: -1})).To(Succeed())
+			Expect(writer.Close()).To(Succeed())
+			Expect((<-received).Id).To(Equal(int32(-1)))
+			Expect(writer.Send(dataMsg(1, "too late"))).To(Equal(helper.ErrWriterClosed))
+			close(done)
+		}, 5)
+	})
+})
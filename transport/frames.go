@@ -0,0 +1,395 @@
+package transport
+
+import (
+	"fmt"
+	"github.com/andysctu/go-tunnel/helper"
+	pb "github.com/andysctu/go-tunnel/protobuf"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Data frames a stream holds for its reader before the session stops
+// reading the connection
+const framesBacklog = 16
+
+// framesSession is the original protocol: stream bytes travel in Data
+// frames on the control connection, alongside the control messages. A
+// single goroutine reads the connection and hands each frame to whoever it
+// is for.
+type framesSession struct {
+	conn     net.Conn
+	server   bool                // Only the rps server opens streams
+	writer   *helper.FrameWriter // Everything sent goes through it
+	control  chan *pb.TestMessage
+	accepted chan *frameStream
+	closing  chan struct{} // Closed by Close
+	done     chan struct{} // Closed once the connection stops being read
+	once     sync.Once
+	err      error // Why the connection stopped being read, set before done is closed
+
+	mu      sync.Mutex
+	streams map[int32]*frameStream
+}
+
+func newFramesSession(conn net.Conn, server bool, writeTimeout time.Duration) *framesSession {
+	s := &framesSession{
+		conn:     conn,
+		server:   server,
+		writer:   helper.NewFrameWriter(conn, 0, writeTimeout),
+		control:  make(chan *pb.TestMessage),
+		accepted: make(chan *frameStream),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+		streams:  make(map[int32]*frameStream),
+	}
+	go s.read()
+	return s
+}
+
+func (s *framesSession) Send(msg *pb.TestMessage) error {
+	return s.writer.Send(msg)
+}
+
+func (s *framesSession) Receive() (*pb.TestMessage, error) {
+	select {
+	case msg := <-s.control:
+		return msg, nil
+	case <-s.done:
+		return nil, s.err
+	}
+}
+
+func (s *framesSession) Open(id int32, remoteAddr string, target string) (Stream, error) {
+	stream := s.newStream(id, remoteAddr, target)
+	if !s.add(stream) {
+		return nil, fmt.Errorf("Stream %d already open", id)
+	}
+	err := s.writer.Send(&pb.TestMessage{
+		Type:   pb.TestMessage_ConnectionOpen,
+		Id:     id,
+		Data:   []byte(remoteAddr),
+		Target: target,
+	})
+	if err != nil {
+		s.remove(stream)
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *framesSession) Accept() (Stream, error) {
+	select {
+	case stream := <-s.accepted:
+		return stream, nil
+	case <-s.done:
+		return nil, s.err
+	}
+}
+
+func (s *framesSession) Close() error {
+	s.once.Do(func() {
+		close(s.closing)
+	})
+	// Closing the writer flushes the control messages
+	err := s.writer.Close()
+	if err != nil && !isClosed(err) {
+		s.conn.Close()
+		return err
+	}
+	err = s.conn.Close()
+	if err != nil && !isClosed(err) {
+		return err
+	}
+	return nil
+}
+
+// Hand every frame to its stream, or to Receive, until the connection fails
+func (s *framesSession) read() {
+	var err error
+loop:
+	for {
+		var msg *pb.TestMessage
+		msg, err = helper.ReceiveProtobuf(s.conn)
+		if err != nil {
+			break
+		}
+		if msg.Id == -1 {
+			if !s.deliver(msg) {
+				err = net.ErrClosed
+				break
+			}
+			continue
+		}
+
+		switch msg.Type {
+		case pb.TestMessage_Data:
+			stream := s.stream(msg.Id)
+			if stream == nil {
+				log.Printf("Dropping data for unknown user <%d>\n", msg.Id)
+				continue
+			}
+			stream.push(msg.Data)
+		case pb.TestMessage_ConnectionClose:
+			stream := s.stream(msg.Id)
+			if stream != nil && s.remove(stream) {
+				stream.end(io.EOF)
+			}
+		// Nothing is sent back, the stream is gone on the other side already
+		case pb.TestMessage_Reset:
+			stream := s.stream(msg.Id)
+			if stream != nil && s.remove(stream) {
+				stream.end(helper.ResetFrom(msg))
+			}
+		case pb.TestMessage_ConnectionOpen:
+			if s.server {
+				s.protocolError(msg.Id, "Unexpected ConnectionOpen message")
+				continue
+			}
+			stream := s.newStream(msg.Id, string(msg.Data), msg.Target)
+			if !s.add(stream) {
+				// The two ends disagree about this stream, neither can trust it
+				s.protocolError(msg.Id, "Stream already open")
+				continue
+			}
+			select {
+			case s.accepted <- stream:
+			case <-s.closing:
+				err = net.ErrClosed
+				break loop
+			}
+		// Anything else about a stream means the other end is confused
+		// about it
+		default:
+			s.protocolError(msg.Id, fmt.Sprintf("Unexpected %s message", msg.Type))
+		}
+	}
+
+	s.mu.Lock()
+	streams := s.streams
+	s.streams = make(map[int32]*frameStream)
+	s.mu.Unlock()
+	for _, stream := range streams {
+		stream.end(err)
+	}
+	s.err = err
+	close(s.done)
+}
+
+// Queue msg for Receive. Returns false if the session is closing.
+func (s *framesSession) deliver(msg *pb.TestMessage) bool {
+	select {
+	case s.control <- msg:
+		return true
+	case <-s.closing:
+		return false
+	}
+}
+
+// Reset stream <id> on both ends
+func (s *framesSession) protocolError(id int32, reason string) {
+	log.Printf("Resetting stream <%d>: %s\n", id, reason)
+	reset := &helper.ResetError{Code: pb.TestMessage_ProtocolError, Reason: reason}
+	stream := s.stream(id)
+	if stream != nil && s.remove(stream) {
+		stream.end(reset)
+	}
+	err := s.writer.Send(helper.ResetMessage(id, reset.Code, reset.Reason))
+	if err != nil {
+		log.Printf("Error sending reset: %s\n", err.Error())
+	}
+}
+
+func (s *framesSession) newStream(id int32, remoteAddr string, target string) *frameStream {
+	return &frameStream{
+		id:         id,
+		session:    s,
+		remoteAddr: userAddr(remoteAddr),
+		target:     target,
+		in:         make(chan []byte, framesBacklog),
+		ended:      make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+}
+
+// Register stream. Returns false if its ID is taken.
+func (s *framesSession) add(stream *frameStream) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.streams[stream.id]; ok {
+		return false
+	}
+	s.streams[stream.id] = stream
+	return true
+}
+
+func (s *framesSession) stream(id int32) *frameStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+// Forget stream. Returns false if it was already forgotten, in which case
+// the other end has already been told it is gone or told us it is.
+func (s *framesSession) remove(stream *frameStream) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.streams[stream.id] != stream {
+		return false
+	}
+	delete(s.streams, stream.id)
+	return true
+}
+
+// A frameStream's bytes arrive on in, pushed by the session's reader, which
+// closes in once the other end is done with the stream
+type frameStream struct {
+	id         int32
+	session    *framesSession
+	remoteAddr net.Addr
+	target     string
+	in         chan []byte
+	buf        []byte        // What is left of the last Data frame, only touched by Read
+	ended      chan struct{} // Closed once the other end is done with the stream
+	endErr     error         // Why, set before ended is closed
+	closed     chan struct{} // Closed by Close or Reset
+	once       sync.Once
+
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+// Called by the session's reader only
+func (fs *frameStream) push(data []byte) {
+	select {
+	case fs.in <- data:
+	case <-fs.closed:
+	case <-fs.session.closing:
+	}
+}
+
+// Called by the session's reader only
+func (fs *frameStream) end(err error) {
+	fs.endErr = err
+	close(fs.ended)
+	close(fs.in)
+}
+
+func (fs *frameStream) Id() int32 {
+	return fs.id
+}
+
+func (fs *frameStream) Target() string {
+	return fs.target
+}
+
+func (fs *frameStream) Read(p []byte) (int, error) {
+	if len(fs.buf) == 0 {
+		fs.mu.Lock()
+		deadline := fs.readDeadline
+		fs.mu.Unlock()
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case data, ok := <-fs.in:
+			if !ok {
+				return 0, fs.endErr
+			}
+			fs.buf = data
+		case <-fs.closed:
+			return 0, net.ErrClosed
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	n := copy(p, fs.buf)
+	fs.buf = fs.buf[n:]
+	return n, nil
+}
+
+func (fs *frameStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		select {
+		case <-fs.closed:
+			return written, net.ErrClosed
+		case <-fs.ended:
+			return written, io.ErrClosedPipe
+		default:
+		}
+		chunk := p
+		if len(chunk) > maxChunk {
+			chunk = chunk[:maxChunk]
+		}
+		err := fs.session.writer.Send(&pb.TestMessage{
+			Type: pb.TestMessage_Data,
+			Data: chunk,
+			Id:   fs.id,
+		})
+		if err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// Close tells the other end the stream is done, unless it said so first
+func (fs *frameStream) Close() error {
+	return fs.finish(&pb.TestMessage{
+		Type: pb.TestMessage_ConnectionClose,
+		Data: []byte(pb.TestMessage_ConnectionClose.String()),
+		Id:   fs.id,
+	})
+}
+
+func (fs *frameStream) Reset(code pb.TestMessage_ResetCode, reason string) error {
+	return fs.finish(helper.ResetMessage(fs.id, code, reason))
+}
+
+func (fs *frameStream) finish(msg *pb.TestMessage) error {
+	var err error
+	fs.once.Do(func() {
+		close(fs.closed)
+		if fs.session.remove(fs) {
+			err = fs.session.writer.Send(msg)
+		}
+	})
+	if isClosed(err) {
+		return nil
+	}
+	return err
+}
+
+func (fs *frameStream) LocalAddr() net.Addr {
+	return fs.session.conn.LocalAddr()
+}
+
+func (fs *frameStream) RemoteAddr() net.Addr {
+	return fs.remoteAddr
+}
+
+func (fs *frameStream) SetDeadline(t time.Time) error {
+	return fs.SetReadDeadline(t)
+}
+
+func (fs *frameStream) SetReadDeadline(t time.Time) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.readDeadline = t
+	return nil
+}
+
+// Writes only wait for room in the session's queue, and the session gives
+// up on the connection once a write to it takes too long
+func (fs *frameStream) SetWriteDeadline(t time.Time) error {
+	return nil
+}
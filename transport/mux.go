@@ -0,0 +1,277 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/andysctu/go-tunnel/helper"
+	pb "github.com/andysctu/go-tunnel/protobuf"
+	"github.com/hashicorp/yamux"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// muxSession gives every user a yamux stream. The client opens the first
+// stream to carry control messages, then the rps server opens one per user,
+// starting it with a ConnectionOpen frame naming the user. After that a
+// stream carries Data frames, and a Reset frame if it is reset.
+type muxSession struct {
+	conn         net.Conn
+	mux          *yamux.Session
+	control      net.Conn
+	writer       *helper.FrameWriter // Everything sent on the control stream goes through it
+	writeTimeout time.Duration
+}
+
+func newMuxSession(conn net.Conn, server bool, writeTimeout time.Duration) (*muxSession, error) {
+	if writeTimeout <= 0 {
+		writeTimeout = helper.DefaultWriteTimeout
+	}
+	config := yamux.DefaultConfig()
+	config.ConnectionWriteTimeout = writeTimeout
+	config.LogOutput = nil
+	config.Logger = log.Default()
+
+	s := &muxSession{conn: conn, writeTimeout: writeTimeout}
+	var err error
+	if server {
+		s.mux, err = yamux.Server(conn, config)
+		if err == nil {
+			s.control, err = s.acceptControl()
+		}
+	} else {
+		s.mux, err = yamux.Client(conn, config)
+		if err == nil {
+			s.control, err = s.mux.OpenStream()
+		}
+	}
+	if err != nil {
+		if s.mux != nil {
+			s.mux.Close()
+		}
+		conn.Close()
+		return nil, err
+	}
+	s.writer = helper.NewFrameWriter(s.control, 0, writeTimeout)
+	return s, nil
+}
+
+// The client opens the control stream right after the hello
+func (s *muxSession) acceptControl() (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.writeTimeout)
+	defer cancel()
+	return s.mux.AcceptStreamWithContext(ctx)
+}
+
+func (s *muxSession) Send(msg *pb.TestMessage) error {
+	return s.writer.Send(msg)
+}
+
+func (s *muxSession) Receive() (*pb.TestMessage, error) {
+	msg, err := helper.ReceiveProtobuf(s.control)
+	if err != nil && (isClosed(err) || errors.Is(err, yamux.ErrConnectionReset)) {
+		return nil, io.EOF
+	}
+	return msg, err
+}
+
+func (s *muxSession) Open(id int32, remoteAddr string, target string) (Stream, error) {
+	conn, err := s.mux.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	err = helper.SendProtobuf(conn, &pb.TestMessage{
+		Type:   pb.TestMessage_ConnectionOpen,
+		Id:     id,
+		Data:   []byte(remoteAddr),
+		Target: target,
+	})
+	conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s.newStream(conn, id, remoteAddr, target), nil
+}
+
+func (s *muxSession) Accept() (Stream, error) {
+	for {
+		conn, err := s.mux.AcceptStream()
+		if err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(s.writeTimeout))
+		msg, err := helper.ReceiveProtobuf(conn)
+		conn.SetReadDeadline(time.Time{})
+		if err == nil && msg.Type != pb.TestMessage_ConnectionOpen {
+			err = fmt.Errorf("Unexpected %s message", msg.Type)
+		}
+		if err != nil {
+			log.Printf("Error opening stream: %s\n", err.Error())
+			conn.Close()
+			continue
+		}
+		return s.newStream(conn, msg.Id, string(msg.Data), msg.Target), nil
+	}
+}
+
+func (s *muxSession) Close() error {
+	// Closing the writer flushes the control messages
+	err := s.writer.Close()
+	s.control.Close()
+	s.mux.Close()
+	if err != nil && !isClosed(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *muxSession) newStream(conn *yamux.Stream, id int32, remoteAddr string, target string) *muxStream {
+	return &muxStream{
+		conn:         conn,
+		id:           id,
+		remoteAddr:   userAddr(remoteAddr),
+		target:       target,
+		writeTimeout: s.writeTimeout,
+	}
+}
+
+type muxStream struct {
+	conn         *yamux.Stream
+	id           int32
+	remoteAddr   net.Addr
+	target       string
+	writeTimeout time.Duration
+	buf          []byte // What is left of the last Data frame, only touched by Read
+	once         sync.Once
+	closed       bool // Set by Close or Reset, guarded by mu
+	mu           sync.Mutex
+}
+
+func (ms *muxStream) Id() int32 {
+	return ms.id
+}
+
+func (ms *muxStream) Target() string {
+	return ms.target
+}
+
+func (ms *muxStream) Read(p []byte) (int, error) {
+	for len(ms.buf) == 0 {
+		msg, err := helper.ReceiveProtobuf(ms.conn)
+		if err != nil {
+			if ms.isClosed() {
+				return 0, net.ErrClosed
+			}
+			if errors.Is(err, yamux.ErrStreamClosed) || errors.Is(err, yamux.ErrConnectionReset) {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		switch msg.Type {
+		case pb.TestMessage_Data:
+			ms.buf = msg.Data
+		case pb.TestMessage_Reset:
+			return 0, helper.ResetFrom(msg)
+		default:
+			reason := fmt.Sprintf("Unexpected %s message", msg.Type)
+			ms.Reset(pb.TestMessage_ProtocolError, reason)
+			return 0, &helper.ResetError{Code: pb.TestMessage_ProtocolError, Reason: reason}
+		}
+	}
+	n := copy(p, ms.buf)
+	ms.buf = ms.buf[n:]
+	return n, nil
+}
+
+func (ms *muxStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxChunk {
+			chunk = chunk[:maxChunk]
+		}
+		err := helper.SendProtobuf(ms.conn, &pb.TestMessage{
+			Type: pb.TestMessage_Data,
+			Data: chunk,
+			Id:   ms.id,
+		})
+		if err != nil {
+			if ms.isClosed() {
+				return written, net.ErrClosed
+			}
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// Close tells the other end the stream is done. Reads waiting here return
+// right away.
+func (ms *muxStream) Close() error {
+	return ms.finish(nil)
+}
+
+func (ms *muxStream) Reset(code pb.TestMessage_ResetCode, reason string) error {
+	return ms.finish(helper.ResetMessage(ms.id, code, reason))
+}
+
+func (ms *muxStream) finish(msg *pb.TestMessage) error {
+	var err error
+	ms.once.Do(func() {
+		ms.mu.Lock()
+		ms.closed = true
+		ms.mu.Unlock()
+		if msg != nil {
+			ms.conn.SetWriteDeadline(time.Now().Add(ms.writeTimeout))
+			err = helper.SendProtobuf(ms.conn, msg)
+		}
+		ms.conn.SetReadDeadline(time.Now())
+		ms.conn.Close()
+	})
+	if isClosed(err) {
+		return nil
+	}
+	return err
+}
+
+func (ms *muxStream) isClosed() bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.closed
+}
+
+func (ms *muxStream) LocalAddr() net.Addr {
+	return ms.conn.LocalAddr()
+}
+
+func (ms *muxStream) RemoteAddr() net.Addr {
+	return ms.remoteAddr
+}
+
+func (ms *muxStream) SetDeadline(t time.Time) error {
+	return ms.conn.SetDeadline(t)
+}
+
+func (ms *muxStream) SetReadDeadline(t time.Time) error {
+	return ms.conn.SetReadDeadline(t)
+}
+
+func (ms *muxStream) SetWriteDeadline(t time.Time) error {
+	return ms.conn.SetWriteDeadline(t)
+}
+
+// Errors from using something that was already closed
+func isClosed(err error) bool {
+	return err == helper.ErrWriterClosed ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, yamux.ErrSessionShutdown) ||
+		errors.Is(err, yamux.ErrStreamClosed)
+}
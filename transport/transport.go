@@ -0,0 +1,87 @@
+// Package transport carries a tunnel between a client and the rps server
+// once the client has said hello: control messages, and a stream for each
+// user that the two ends copy bytes to and from. The connection itself may
+// be a WebSocket, for clients that can only get out over HTTP.
+package transport
+
+import (
+	"fmt"
+	pb "github.com/andysctu/go-tunnel/protobuf"
+	"net"
+	"time"
+)
+
+// Transports a client may ask for in its hello
+const (
+	// Every user's bytes go in TestMessage Data frames on the control
+	// connection. Every client and server speaks it.
+	Frames = "frames"
+	// Every user gets a yamux stream with its own flow control, so a slow
+	// user can't hold up the others
+	Mux = "mux"
+)
+
+// Largest Data frame a stream writes
+const maxChunk = 32 * 1024
+
+// A Stream is one user's connection carried over a session. Read returns
+// io.EOF once the other end has closed it, or a *helper.ResetError if the
+// other end reset it. RemoteAddr is the user's address.
+type Stream interface {
+	net.Conn
+	Id() int32
+	// Target is the host:port the user asked to connect to, if the tunnel
+	// lets users choose
+	Target() string
+	// Reset closes the stream, telling the other end why
+	Reset(code pb.TestMessage_ResetCode, reason string) error
+}
+
+// A Session is one tunnel. The rps server opens a stream for each user and
+// the client accepts it. Everything else goes through Send and Receive.
+type Session interface {
+	// Send queues a control message
+	Send(msg *pb.TestMessage) error
+	// Receive blocks until the next control message arrives
+	Receive() (*pb.TestMessage, error)
+	// Open starts a stream for user <id> connecting from remoteAddr, to
+	// target if the user chose one
+	Open(id int32, remoteAddr string, target string) (Stream, error)
+	// Accept blocks until the other end opens a stream
+	Accept() (Stream, error)
+	// Close sends the control messages already queued, then ends the
+	// session along with every stream on it and closes the connection
+	Close() error
+}
+
+// New starts a session of the named transport on conn, which has just
+// finished the hello. server says which end of the tunnel this is.
+// writeTimeout falls back to helper.DefaultWriteTimeout when zero.
+func New(name string, conn net.Conn, server bool, writeTimeout time.Duration) (Session, error) {
+	switch name {
+	case Frames:
+		return newFramesSession(conn, server, writeTimeout), nil
+	case Mux:
+		return newMuxSession(conn, server, writeTimeout)
+	}
+	return nil, fmt.Errorf("Unknown transport %q", name)
+}
+
+// Choose returns the transport to use for a client asking for requested,
+// falling back to Frames for old clients and ones asking for something
+// unknown
+func Choose(requested string) string {
+	if requested == Mux {
+		return Mux
+	}
+	return Frames
+}
+
+// The user's address as given to Open
+func userAddr(remoteAddr string) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", remoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
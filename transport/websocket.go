@@ -0,0 +1,216 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How long closing a WebSocket waits to tell the other end
+const wsCloseTimeout = time.Second
+
+// DialWebSocket connects to the rps server at url, a ws:// or wss:// URL,
+// for networks that only let HTTP out. The connection it returns carries the
+// tunnel in binary messages, hello and all. tlsConfig is used for wss, and
+// may be nil. dial opens the TCP connection underneath.
+func DialWebSocket(ctx context.Context, url string, tlsConfig *tls.Config, dial func(ctx context.Context, network string, addr string) (net.Conn, error)) (net.Conn, error) {
+	dialer := &websocket.Dialer{
+		NetDialContext:  dial,
+		TLSClientConfig: tlsConfig,
+	}
+	ws, res, err := dialer.DialContext(ctx, url, nil)
+	if err != nil {
+		if res != nil {
+			return nil, fmt.Errorf("WebSocket upgrade refused: %s", res.Status)
+		}
+		return nil, err
+	}
+	return newWSConn(ws), nil
+}
+
+// NewWebSocketListener accepts tunnels as WebSocket upgrades of HTTP
+// requests for path on listener. Other requests get a 404.
+func NewWebSocketListener(listener net.Listener, path string) net.Listener {
+	l := &wsListener{
+		listener: listener,
+		path:     path,
+		conns:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+	l.server = &http.Server{Handler: l, ErrorLog: log.Default()}
+	go l.server.Serve(listener)
+	return l
+}
+
+type wsListener struct {
+	listener net.Listener
+	path     string
+	server   *http.Server
+	upgrader websocket.Upgrader
+	conns    chan net.Conn
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func (l *wsListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != l.path {
+		http.NotFound(w, r)
+		return
+	}
+	// Upgrade answers requests that aren't upgrades itself
+	ws, err := l.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	conn := newWSConn(ws)
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting upgrades. Connections already upgraded are left
+// open.
+func (l *wsListener) Close() error {
+	err := net.ErrClosed
+	l.once.Do(func() {
+		close(l.closed)
+		err = l.server.Close()
+	})
+	return err
+}
+
+func (l *wsListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// wsConn is a net.Conn over a WebSocket. Every Write is a binary message,
+// and Read returns their bytes in order, ignoring message boundaries.
+type wsConn struct {
+	ws     *websocket.Conn
+	reader io.Reader  // The message being read, only touched by Read
+	write  sync.Mutex // Keeps writes one at a time
+	mu     sync.Mutex
+	closed bool // Guarded by mu
+}
+
+func newWSConn(ws *websocket.Conn) *wsConn {
+	return &wsConn{ws: ws}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			messageType, reader, err := c.ws.NextReader()
+			if err != nil {
+				return 0, c.readError(err)
+			}
+			if messageType != websocket.BinaryMessage {
+				continue
+			}
+			c.reader = reader
+		}
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		if err != nil {
+			return n, c.readError(err)
+		}
+		return n, nil
+	}
+}
+
+// The other end closing the WebSocket is the end of the connection
+func (c *wsConn) readError(err error) error {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return io.EOF
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	return err
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.write.Lock()
+	defer c.write.Unlock()
+	err := c.ws.WriteMessage(websocket.BinaryMessage, p)
+	if err != nil {
+		return 0, c.writeError(err)
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) writeError(err error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || err == websocket.ErrCloseSent {
+		return net.ErrClosed
+	}
+	return err
+}
+
+// Close tells the other end, if it is still listening, then closes the
+// connection underneath, which unblocks a Write in progress
+func (c *wsConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.mu.Unlock()
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	c.ws.WriteControl(websocket.CloseMessage, message, time.Now().Add(wsCloseTimeout))
+	return c.ws.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	err := c.ws.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
@@ -0,0 +1,169 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxRetries = 5
+	defaultRetryDelay = 500 * time.Millisecond
+	defaultTimeout    = 10 * time.Second
+	queueSize         = 1024
+
+	// Header carrying the hex encoded HMAC-SHA256 of the body, keyed with the secret
+	SignatureHeader = "X-Rps-Signature"
+	// Header carrying the event type
+	EventHeader = "X-Rps-Event"
+)
+
+type EventType string
+
+const (
+	ClientConnected  EventType = "client_connected"
+	TunnelOpened     EventType = "tunnel_opened"
+	TunnelClosed     EventType = "tunnel_closed"
+	UserConnected    EventType = "user_connected"
+	UserDisconnected EventType = "user_disconnected"
+	AuthFailed       EventType = "auth_failed"
+)
+
+// An Event is the JSON body POSTed to the webhook URL
+type Event struct {
+	Type        EventType `json:"type"`
+	Time        time.Time `json:"time"`
+	ClientAddr  string    `json:"client_addr,omitempty"`
+	ExposedPort int       `json:"exposed_port,omitempty"`
+	Group       string    `json:"group,omitempty"`   // The tunnel's group, if it joined one
+	Address     string    `json:"address,omitempty"` // Public host:port of the tunnel, when PublicHost is set
+	UserId      int32     `json:"user_id,omitempty"`
+	UserAddr    string    `json:"user_addr,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+}
+
+// Notifier delivers events to a webhook URL in the background, in order,
+// retrying failed deliveries with exponential backoff
+type Notifier struct {
+	URL        string
+	Secret     string // Signs every body when set
+	PublicHost string // Used to fill in Event.Address
+	MaxRetries int
+	RetryDelay time.Duration
+	Client     *http.Client
+
+	mu     sync.Mutex // Guards sending to queue against closing it
+	closed bool
+	queue  chan *Event
+	wg     sync.WaitGroup
+}
+
+func New(url string, secret string) *Notifier {
+	n := &Notifier{
+		URL:        url,
+		Secret:     secret,
+		MaxRetries: defaultMaxRetries,
+		RetryDelay: defaultRetryDelay,
+		Client:     &http.Client{Timeout: defaultTimeout},
+		queue:      make(chan *Event, queueSize),
+	}
+	n.wg.Add(1)
+	go n.deliver()
+	return n
+}
+
+// Notify queues an event for delivery without blocking. Events after Close
+// are dropped.
+func (n *Notifier) Notify(event *Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Address == "" && event.ExposedPort != 0 && n.PublicHost != "" {
+		event.Address = net.JoinHostPort(n.PublicHost, strconv.Itoa(event.ExposedPort))
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return
+	}
+	select {
+	case n.queue <- event:
+	default:
+		log.Printf("Webhook queue is full, dropping %s event\n", event.Type)
+	}
+}
+
+// Close delivers the events already queued, then stops the notifier
+func (n *Notifier) Close() {
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.queue)
+	}
+	n.mu.Unlock()
+	n.wg.Wait()
+}
+
+// Sign returns the signature of body for the given secret
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (n *Notifier) deliver() {
+	defer n.wg.Done()
+	for event := range n.queue {
+		body, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Error encoding %s event: %s\n", event.Type, err.Error())
+			continue
+		}
+
+		delay := n.RetryDelay
+		for attempt := 0; ; attempt++ {
+			err = n.post(event.Type, body)
+			if err == nil {
+				break
+			}
+			if attempt >= n.MaxRetries {
+				log.Printf("Giving up on %s event: %s\n", event.Type, err.Error())
+				break
+			}
+			log.Printf("Error delivering %s event, retrying in %s: %s\n", event.Type, delay, err.Error())
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+func (n *Notifier) post(eventType EventType, body []byte) error {
+	req, err := http.NewRequest("POST", n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, string(eventType))
+	if n.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(n.Secret, body))
+	}
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New("Webhook responded with " + resp.Status)
+	}
+	return nil
+}